@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
+	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+	fuse_util_disk "github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/disk"
 	fuse_util_mem "github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/mem"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -37,12 +42,39 @@ func mount(fs fuse_util.FileStore, mountpoint string) error {
 	}
 	return mfs.Join(context.Background())
 }
+
+var mountpoint *string
+var store *string
+
+func init() {
+	mountpoint = flag.String("mnt", "mnt", "directory to mount at")
+	store = flag.String("store", "", "host directory to keep the files in, empty keeps them in memory")
+}
+
 func main() {
-	justRunCmd("fusermount -u mnt")
-	justRunCmd("mkdir mnt")
+	flag.Parse()
+	justRunCmd("fusermount -u " + *mountpoint)
+	justRunCmd("mkdir " + *mountpoint)
+
+	var files fuse_util.FileStore = fuse_util_mem.NewMemFileStore()
+	if *store != "" {
+		diskFiles, err := fuse_util_disk.NewDiskFileStore(*store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer diskFiles.Close()
+		files = diskFiles
+	}
+
+	// unmount on interrupt so that the store is closed, it is consistent even if the process is killed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		_ = fuse.Unmount(*mountpoint)
+	}()
 
-	files := fuse_util_mem.NewMemFileStore()
-	if err := mount(files, "mnt"); err != nil {
-		log.Fatal(err)
+	if err := mount(files, *mountpoint); err != nil {
+		log.Println(err)
 	}
 }
@@ -1,23 +1,96 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"strings"
+
 	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
 )
 
 var listenAddr *string
+var tokens *string
+var queueDir *string
+var hubName *string
+var links *string
+var linkToken *string
+var block *bool
+var adminAddr *string
+var adminToken *string
 
 func init() {
 	listenAddr = flag.String("listen", ":5010", "listen address")
+	tokens = flag.String("tokens", "", "comma separated name:token, names are first come first served if empty")
+	queueDir = flag.String("queue", "", "directory keeping messages for offline peers, in memory if empty")
+	hubName = flag.String("name", "", "name of this hub, federation is disabled if empty")
+	links = flag.String("links", "", "comma separated addresses of hubs to link to")
+	linkToken = flag.String("link-token", "", "token shared by linked hubs")
+	block = flag.Bool("block", false, "senders wait for slow receivers instead of being nacked")
+	adminAddr = flag.String("admin", "", "address of the admin rpc, e.g. rpc -addr ADDR call Admin.ListPeers, disabled if empty")
+	adminToken = flag.String("admin-token", "", "token required by the admin rpc")
 	flag.Parse()
 }
 
+func serveAdmin(hub relay.Hub) {
+	d := relay.RegisterAdmin(rpc.NewDispatcher(), relay.NewAdmin(hub)).Use(rpc.Recover())
+	if *adminToken != "" {
+		d.Use(rpc.RequireToken(func(t string) bool {
+			return t == *adminToken
+		}))
+	}
+	s, err := rpc.NewTCPServer(*adminAddr)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		err := s.ListenAndServe(context.Background(), d, rpc.NewMessageIO())
+		fmt.Printf("[hub] admin error: %v\n", err)
+	}()
+}
+
 func main() {
-	hub, err := relay.NewHub(*listenAddr)
+	config := relay.DefaultHubConfig()
+	if *tokens != "" {
+		tokenMap := make(map[string]string)
+		for _, pair := range strings.Split(*tokens, ",") {
+			name, token, ok := strings.Cut(pair, ":")
+			if !ok {
+				panic("invalid tokens: " + pair)
+			}
+			tokenMap[name] = token
+		}
+		config.Auth = relay.TokenAuth(tokenMap)
+	}
+	if *queueDir != "" {
+		storage, err := relay.DiskStorage(*queueDir)
+		if err != nil {
+			panic(err)
+		}
+		config.Queue.Storage = storage
+	}
+	if *block {
+		config.Outbound.Policy = relay.OverflowBlock
+	}
+	if *hubName != "" {
+		if *linkToken == "" {
+			panic("federation requires -link-token")
+		}
+		config.Federation.Name = *hubName
+		if *links != "" {
+			config.Federation.Links = strings.Split(*links, ",")
+		}
+		config.Federation.Credential = relay.TokenCredential(*linkToken)
+		config.Federation.Auth = relay.SharedTokenAuth(*linkToken)
+	}
+	hub, err := relay.NewHub(*listenAddr, config)
 	if err != nil {
 		panic(err)
 	}
+	if *adminAddr != "" {
+		serveAdmin(hub)
+	}
 	for {
 		if err := hub.ListenAndServe(); err != nil {
 			fmt.Printf("[hub] error: %v\n", err)
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
@@ -10,12 +13,36 @@ import (
 	"strings"
 )
 
+const usage = `usage: peer [flags], then one command per line:
+  RECEIVER TEXT        send TEXT to RECEIVER
+  /pub TOPIC TEXT      send TEXT to subscribers of TOPIC
+  /all TEXT            send TEXT to every peer
+  /sub PATTERN         subscribe to PATTERN, "*" matches one token and a trailing ">" the rest
+  /unsub PATTERN       unsubscribe from PATTERN
+  /sub $presence.>     be told when peers join or leave
+  /direct NAME         connect to NAME without the relay, needs -direct on both sides
+`
+
 var name *string
 var relayAddr *string
+var token *string
+var e2e *bool
+var listenAddr *string
+var direct *bool
+var directNetwork *string
 
 func init() {
 	name = flag.String("name", "", "name of client")
 	relayAddr = flag.String("relay", "127.0.0.1:5010", "address of relay")
+	token = flag.String("token", "", "token proving ownership of name")
+	listenAddr = flag.String("listen", "", "local address, also where direct connections are accepted")
+	direct = flag.Bool("direct", false, "accept direct connections from other peers")
+	directNetwork = flag.String("direct-network", "", "tcp or udp to punch only that kind of hole, empty tries both")
+	e2e = flag.Bool("e2e", false, "seal direct messages with a fresh X25519 key, peers must use -e2e too")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 }
 
@@ -23,18 +50,34 @@ func main() {
 	if *name == "" {
 		panic("name is required")
 	}
-	peer, err := relay.NewPeer(*name, "", *relayAddr)
+	config := relay.DefaultPeerConfig()
+	config.Credential = relay.TokenCredential(*token)
+	config.Direct = *direct
+	config.DirectNetwork = *directNetwork
+	config.OnState = func(state relay.PeerState) {
+		fmt.Printf("[peer] %s\n", state)
+	}
+	peer, err := relay.NewPeer(*name, *listenAddr, *relayAddr, config)
 	if err != nil {
 		panic(err)
 	}
+	if *e2e {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		peer = relay.NewSecurePeer(peer, relay.DefaultSecureConfig(key))
+	}
 	go func() {
-		for {
-			if err := peer.DialAndServe(func(m *relay_pb.Message) {
-				fmt.Printf("[%s] %s\n", m.Sender, string(m.Payload))
-			}); err != nil {
-				fmt.Printf("[peer] error: %v\n", err)
+		err := peer.DialAndServe(func(m *relay_pb.Message) {
+			if m.Kind == relay_pb.Kind_PRESENCE {
+				fmt.Printf("[%s] %s\n", m.Topic, m.Sender)
+				return
 			}
-		}
+			fmt.Printf("[%s] %s\n", m.Sender, string(m.Payload))
+		})
+		fmt.Printf("[peer] error: %v\n", err)
+		os.Exit(1)
 	}()
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -46,10 +89,33 @@ func main() {
 		if len(slice) != 2 {
 			continue
 		}
-		err = peer.Write(&relay_pb.Message{
-			Receiver: slice[0],
-			Payload:  []byte(slice[1]),
-		})
+		switch slice[0] {
+		case "/sub":
+			err = peer.Subscribe(strings.TrimSpace(slice[1]))
+		case "/unsub":
+			err = peer.Unsubscribe(strings.TrimSpace(slice[1]))
+		case "/direct":
+			err = peer.Direct(context.Background(), strings.TrimSpace(slice[1]))
+		case "/all":
+			err = peer.Write(&relay_pb.Message{
+				Broadcast: true,
+				Payload:   []byte(slice[1]),
+			})
+		case "/pub":
+			topic := strings.SplitN(slice[1], " ", 2)
+			if len(topic) != 2 {
+				continue
+			}
+			err = peer.Write(&relay_pb.Message{
+				Topic:   topic[0],
+				Payload: []byte(topic[1]),
+			})
+		default:
+			err = peer.Write(&relay_pb.Message{
+				Receiver: slice[0],
+				Payload:  []byte(slice[1]),
+			})
+		}
 		if err != nil {
 			fmt.Printf("error %s\n", err.Error())
 		}
@@ -0,0 +1,38 @@
+package main
+
+//go:generate go run github.com/fbundle/lab_public/lab/go_util/cmd/rpcgen -type Calculator
+
+type AddReq struct {
+	Values []int
+}
+
+type AddRes struct {
+	Sum int
+}
+
+type SubReq struct {
+	A int
+	B int
+}
+
+type Calculator interface {
+	Add(req *AddReq) *AddRes
+	Sub(req *SubReq) *int
+}
+
+type calculator struct{}
+
+func (calculator) Add(req *AddReq) *AddRes {
+	sum := 0
+	for _, v := range req.Values {
+		sum += v
+	}
+	return &AddRes{
+		Sum: sum,
+	}
+}
+
+func (calculator) Sub(req *SubReq) *int {
+	diff := req.A - req.B
+	return &diff
+}
@@ -0,0 +1,35 @@
+// Code generated by rpcgen. DO NOT EDIT.
+
+package main
+
+import (
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+// RegisterCalculator - register every method of s on d
+func RegisterCalculator(d rpc.Dispatcher, s Calculator) rpc.Dispatcher {
+	return d.
+		Register("Calculator.Add", s.Add).
+		Register("Calculator.Sub", s.Sub)
+}
+
+// CalculatorClient - typed client of Calculator
+type CalculatorClient struct {
+	transport    rpc.TransportFunc
+	interceptors []rpc.Interceptor
+}
+
+func NewCalculatorClient(transport rpc.TransportFunc, interceptors ...rpc.Interceptor) *CalculatorClient {
+	return &CalculatorClient{
+		transport:    transport,
+		interceptors: interceptors,
+	}
+}
+
+func (c *CalculatorClient) Add(req *AddReq) (*AddRes, error) {
+	return rpc.RPC[AddReq, AddRes](c.transport, "Calculator.Add", req, c.interceptors...)
+}
+
+func (c *CalculatorClient) Sub(req *SubReq) (*int, error) {
+	return rpc.RPC[SubReq, int](c.transport, "Calculator.Sub", req, c.interceptors...)
+}
@@ -1,13 +1,59 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 
+	"github.com/fbundle/lab_public/lab/go_util/pkg/logger"
 	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
 )
 
+const usage = `usage:
+  rpc [flags] list               list commands served at addr
+  rpc [flags] call CMD [JSON]    validate JSON against the schema of CMD, call it and print the response
+  rpc [flags] demo               serve Calculator.Add and Calculator.Sub at addr
+
+addr is host:port for tcp, unix:PATH for a unix socket or http://host:port/path for JSON-RPC over HTTP
+`
+
+var addr *string
+var token *string
+
+func init() {
+	addr = flag.String("addr", "localhost:14001", "address of the server")
+	token = flag.String("token", "", "token attached to every call")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+}
+
+func transport(ctx context.Context) rpc.TransportFunc {
+	switch {
+	case strings.HasPrefix(*addr, "http://") || strings.HasPrefix(*addr, "https://"):
+		return rpc.JSONRPCTransport(ctx, *addr)
+	case strings.HasPrefix(*addr, "unix:"):
+		return rpc.UnixTransport(ctx, strings.TrimPrefix(*addr, "unix:"), rpc.NewMessageIO())
+	default:
+		return rpc.TCPTransport(ctx, *addr, rpc.NewMessageIO())
+	}
+}
+
+func interceptors() []rpc.Interceptor {
+	if *token == "" {
+		return nil
+	}
+	return []rpc.Interceptor{rpc.AttachToken(*token)}
+}
+
 func mustMarshalJSON(o any) string {
 	b, err := json.Marshal(o)
 	if err != nil {
@@ -16,57 +62,113 @@ func mustMarshalJSON(o any) string {
 	return string(b)
 }
 
-func main() {
-	type AddReq struct {
-		Values []int
+func list(ctx context.Context) error {
+	desc, err := rpc.Describe(transport(ctx), interceptors()...)
+	if err != nil {
+		return err
 	}
-
-	type AddRes struct {
-		Sum int
+	for _, c := range desc.Commands {
+		fmt.Printf("%s\n  request:  %s\n  response: %s\n", c.Name, mustMarshalJSON(c.Request), mustMarshalJSON(c.Response))
 	}
+	return nil
+}
 
-	type SubReq struct {
-		A int
-		B int
+func call(ctx context.Context, cmd string, input string) error {
+	desc, err := rpc.Describe(transport(ctx), interceptors()...)
+	if err != nil {
+		return err
+	}
+	var schema *rpc.Schema
+	for _, c := range desc.Commands {
+		if c.Name == cmd {
+			schema = c.Request
+		}
+	}
+	if schema == nil {
+		return fmt.Errorf("command not found: %s", cmd)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var v any
+	if err := json.Unmarshal([]byte(input), &v); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	if err := schema.Validate(v); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
 
-	addr := "localhost:14001"
-	s, err := rpc.NewTCPServer(addr)
+	req := json.RawMessage(input)
+	res, err := rpc.RPC[json.RawMessage, json.RawMessage](transport(ctx), cmd, &req, interceptors()...)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, *res, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func demo(ctx context.Context) error {
+	d := RegisterCalculator(rpc.NewDispatcher(), calculator{}).
+		Use(rpc.Recover(), rpc.Logging(logger.NewDefaultLogger()))
+	if *token != "" {
+		d.Use(rpc.RequireToken(func(t string) bool {
+			return t == *token
+		}))
 	}
-	defer s.Close()
 
-	d := rpc.NewDispatcher().Register("add", func(req *AddReq) (res *AddRes) {
-		sum := 0
-		for _, v := range req.Values {
-			sum += v
+	switch {
+	case strings.HasPrefix(*addr, "http://"):
+		s := &http.Server{
+			Addr:    strings.TrimPrefix(*addr, "http://"),
+			Handler: rpc.NewJSONRPCHandler(d),
 		}
-		return &AddRes{
-			Sum: sum,
+		go func() {
+			<-ctx.Done()
+			_ = s.Shutdown(context.Background())
+		}()
+		return s.ListenAndServe()
+	case strings.HasPrefix(*addr, "unix:"):
+		s, err := rpc.NewUnixServer(strings.TrimPrefix(*addr, "unix:"))
+		if err != nil {
+			return err
 		}
-	}).Register("sub", func(req *SubReq) (res *int) {
-		diff := req.A - req.B
-		return &diff
-	})
-
-	go s.ListenAndServe(ctx, d, rpc.NewMessageIO())
+		return s.ListenAndServe(ctx, d, rpc.NewMessageIO())
+	default:
+		s, err := rpc.NewTCPServer(*addr)
+		if err != nil {
+			return err
+		}
+		return s.ListenAndServe(ctx, d, rpc.NewMessageIO())
+	}
+}
 
-	localTransport := d.Handle
-	remoteTransport := rpc.TCPTransport(ctx, addr, rpc.NewMessageIO())
+func main() {
+	flag.Parse()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
 
-	res1, err := rpc.RPC[AddReq, AddRes](localTransport, "add", &AddReq{Values: []int{1, 2, 3}})
-	if err != nil {
-		panic(err)
+	args := flag.Args()
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		err = list(ctx)
+	case len(args) == 2 && args[0] == "call":
+		err = call(ctx, args[1], "{}")
+	case len(args) == 3 && args[0] == "call":
+		err = call(ctx, args[1], args[2])
+	case len(args) == 1 && args[0] == "demo":
+		err = demo(ctx)
+		if errors.Is(err, rpc.ErrServerClosed) || errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
-	fmt.Println(mustMarshalJSON(res1))
-
-	res2, err := rpc.RPC[SubReq, int](remoteTransport, "sub", &SubReq{A: 7, B: 5})
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	fmt.Println(mustMarshalJSON(res2))
 }
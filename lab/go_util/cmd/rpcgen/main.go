@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc/rpcgen"
+)
+
+// usage in a go file of the package declaring the service interface:
+//
+//	//go:generate go run github.com/fbundle/lab_public/lab/go_util/cmd/rpcgen -type Calculator
+
+var typeName *string
+var prefix *string
+var output *string
+var dir *string
+
+func init() {
+	typeName = flag.String("type", "", "name of the service interface")
+	prefix = flag.String("prefix", "", "prefix of command names, default is the interface name followed by a dot")
+	output = flag.String("output", "", "output file, default is <type>_rpc.go in snake case")
+	dir = flag.String("dir", ".", "directory of the package declaring the interface")
+}
+
+// snakeCase - CalculatorService -> calculator_service, HTTPServer -> http_server
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func main() {
+	flag.Parse()
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *prefix == "" {
+		*prefix = *typeName + "."
+	}
+	if *output == "" {
+		*output = filepath.Join(*dir, snakeCase(*typeName)+"_rpc.go")
+	}
+
+	s, err := rpcgen.Parse(*dir, *typeName, *prefix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	b, err := rpcgen.Generate(s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/irifrance/gini v1.0.1
 	github.com/jacobsa/fuse v0.0.0-20250726160139-b8f47b05858b
+	golang.org/x/sys v0.34.0
 	google.golang.org/protobuf v1.36.6
 )
 
@@ -13,7 +14,6 @@ require (
 	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/rogpeppe/go-internal v1.13.1 // indirect
-	golang.org/x/sys v0.34.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
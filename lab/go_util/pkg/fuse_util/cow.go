@@ -0,0 +1,189 @@
+package fuse_util
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/persistent/ordered_map"
+)
+
+const cowBlockSize = 64 << 10
+
+// version - the state of a file for the snapshots taken in epochs [from, upto]
+// blocks changed since then are kept here, the others are read from the live file
+type version struct {
+	from   uint64
+	upto   uint64
+	attr   FileAttr
+	blocks ordered_map.OrderedMap[uint64, []byte] // by block index
+}
+
+// cowFile - a file of the store that keeps what snapshots see of it before every change
+type cowFile struct {
+	File
+	snapshots *snapshots
+
+	mu       sync.Mutex
+	epoch    uint64 // the file has not changed since this epoch began
+	versions []*version
+	gone     bool // deleted from the store, versions have all their blocks
+}
+
+func newCowFile(file File, s *snapshots) *cowFile {
+	return &cowFile{
+		File:      file,
+		snapshots: s,
+		epoch:     s.current(),
+	}
+}
+
+// freezeLocked - before a change, keep the state of the file for the snapshots taken since it last changed
+// versions no snapshot sees anymore are dropped here
+func (f *cowFile) freezeLocked() {
+	f.versions = slices.DeleteFunc(f.versions, func(v *version) bool {
+		return !f.snapshots.live(v.from, v.upto)
+	})
+	current := f.snapshots.current()
+	if f.epoch == current {
+		return
+	}
+	if f.snapshots.live(f.epoch, current-1) {
+		f.versions = append(f.versions, &version{
+			from: f.epoch,
+			upto: current - 1,
+			attr: mustAttr(f.File),
+		})
+	}
+	f.epoch = current
+}
+
+// saveLocked - copy the blocks overlapping [from, to) into the versions that still read them from the live file
+func (f *cowFile) saveLocked(from uint64, to uint64) error {
+	for i := from / cowBlockSize; len(f.versions) > 0 && i*cowBlockSize < to; i++ {
+		var block []byte
+		for _, v := range f.versions {
+			if i*cowBlockSize >= v.attr.Size {
+				continue
+			}
+			if _, ok := v.blocks.Get(i); ok {
+				continue
+			}
+			if block == nil {
+				block = make([]byte, cowBlockSize)
+				n, err := f.File.Read(i*cowBlockSize, block)
+				if err != nil {
+					return err
+				}
+				block = block[:n]
+			}
+			v.blocks = v.blocks.Set(i, block) // shared by the versions
+		}
+	}
+	return nil
+}
+
+func (f *cowFile) Write(offset uint64, buffer []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.freezeLocked()
+	if err := f.saveLocked(offset, offset+uint64(len(buffer))); err != nil {
+		return 0, err
+	}
+	return f.File.Write(offset, buffer)
+}
+
+func (f *cowFile) Trunc(size uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.freezeLocked()
+	old := mustAttr(f.File).Size
+	if err := f.saveLocked(min(size, old), old); err != nil {
+		return err
+	}
+	return f.File.Trunc(size)
+}
+
+func (f *cowFile) UpdateAttr(updater func(FileAttr) FileAttr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.freezeLocked()
+	return f.File.UpdateAttr(updater)
+}
+
+// retire - the file is about to be deleted from the store, versions take the blocks they still share with it
+func (f *cowFile) retire() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.freezeLocked()
+	var size uint64
+	for _, v := range f.versions {
+		size = max(size, v.attr.Size)
+	}
+	if err := f.saveLocked(0, size); err != nil {
+		return err
+	}
+	f.gone = true
+	return nil
+}
+
+// versionLocked - the version the snapshot of epoch sees, nil for the live file
+func (f *cowFile) versionLocked(epoch uint64) (*version, bool) {
+	for _, v := range f.versions {
+		if v.from <= epoch && epoch <= v.upto {
+			return v, true
+		}
+	}
+	return nil, epoch >= f.epoch && !f.gone
+}
+
+// attrAt - attributes the snapshot of epoch sees
+func (f *cowFile) attrAt(epoch uint64) (FileAttr, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.versionLocked(epoch)
+	switch {
+	case !ok:
+		return FileAttr{}, false
+	case v == nil:
+		return mustAttr(f.File), true
+	default:
+		return v.attr.Clone(), true
+	}
+}
+
+// readAt - data the snapshot of epoch sees
+func (f *cowFile) readAt(epoch uint64, offset uint64, buffer []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.versionLocked(epoch)
+	switch {
+	case !ok:
+		return 0, nil
+	case v == nil:
+		return f.File.Read(offset, buffer)
+	}
+	if offset >= v.attr.Size {
+		return 0, nil
+	}
+	buffer = buffer[:min(uint64(len(buffer)), v.attr.Size-offset)]
+	n := 0
+	for n < len(buffer) {
+		pos := offset + uint64(n)
+		i, within := pos/cowBlockSize, pos%cowBlockSize
+		end := min(len(buffer), n+int(cowBlockSize-within))
+		if block, ok := v.blocks.Get(i); ok {
+			copied := 0
+			if within < uint64(len(block)) {
+				copied = copy(buffer[n:end], block[within:])
+			}
+			clear(buffer[n+copied : end])
+			n = end
+			continue
+		}
+		if _, err := f.File.Read(pos, buffer[n:end]); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
@@ -1,44 +1,32 @@
 package fuse_util
 
 import (
-	"errors"
+	"os"
 	"time"
 )
 
-func newDir() File {
-	return &dir{
-		attr: FileAttr{
-			ID:    0,
-			IsDir: true,
-
-			Path:  nil,
-			Mtime: time.Now(),
-			Size:  0,
-		},
-	}
-}
-
-type dir struct {
-	attr FileAttr
-}
-
-func (d *dir) Attr() (FileAttr, error) {
-	return d.attr, nil
-}
-
-func (d *dir) Read(offset uint64, buffer []byte) (n int, err error) {
-	return 0, errors.New("no_permission")
-}
-
-func (d *dir) Write(offset uint64, buffer []byte) (n int, err error) {
-	return 0, errors.New("no_permission")
+// rootAttr - attributes of the root directory, the only file of the store at the empty path
+func rootAttr(attr FileAttr) FileAttr {
+	now := time.Now()
+	attr = dirAttr(attr)
+	attr.Paths = [][]string{{}}
+	attr.Mtime = now
+	attr.Atime = now
+	attr.Ctime = now
+	attr.Crtime = now
+	return attr
 }
 
-func (d *dir) Trunc(size uint64) error {
-	return errors.New("no_permission")
+// isRoot - whether attr is of the root directory
+func isRoot(attr FileAttr) bool {
+	return attr.IsDir && len(attr.Paths) == 1 && len(attr.Paths[0]) == 0
 }
 
-func (d *dir) UpdateAttr(f func(FileAttr) FileAttr) error {
-	d.attr = f(d.attr)
-	return nil
+// dirAttr - attributes of a directory made up by the file system, owned by its process
+func dirAttr(attr FileAttr) FileAttr {
+	attr.IsDir = true
+	attr.Mode = defaultDirMode
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	return attr
 }
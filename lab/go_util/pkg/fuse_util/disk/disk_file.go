@@ -0,0 +1,136 @@
+package fuse_util_disk
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+)
+
+const blobDir = "blobs"
+
+func (s *diskFileStore) blobPath(id uint64) string {
+	return filepath.Join(s.dir, blobDir, strconv.FormatUint(id, 10))
+}
+
+// diskFile - the blob is created on the first write, so directories and empty files have none
+type diskFile struct {
+	mu      sync.RWMutex
+	store   *diskFileStore
+	attr    fuse_util.FileAttr
+	dirty   bool // size and times changed by writes are not journaled yet
+	deleted bool // nothing is journaled for it anymore, it would come back on open otherwise
+}
+
+var errDeleted = errors.New("file deleted")
+
+// lockWrite - change the blob with m, which returns the new size
+// size and times are journaled with the next change of the file or on close, until then a crash takes them from the blob
+func (f *diskFile) lockWrite(m func(blob *os.File) (uint64, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.deleted {
+		return errDeleted
+	}
+
+	blob, err := os.OpenFile(f.store.blobPath(f.attr.ID), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	size, err := m(blob)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	f.attr.Size = size
+	f.attr.Mtime = now
+	f.attr.Ctime = now
+	f.dirty = true
+	return nil
+}
+
+// flush - journal what writes changed
+func (f *diskFile) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.deleted || !f.dirty {
+		return nil
+	}
+	if err := f.store.put(f.attr); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *diskFile) Attr() (fuse_util.FileAttr, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.attr.Clone(), nil
+}
+
+func (f *diskFile) UpdateAttr(updater func(fuse_util.FileAttr) fuse_util.FileAttr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.deleted {
+		return errDeleted
+	}
+
+	newAttr := updater(f.attr.Clone())
+	if f.attr.ID != newAttr.ID {
+		return errors.New("id cannot be changed")
+	}
+	if newAttr.IsDir != f.attr.IsDir && f.attr.Size > 0 {
+		return errors.New("only an empty file can change to or from directory")
+	}
+	if f.attr.Size != newAttr.Size {
+		return errors.New("size cannot be changed from attr")
+	}
+
+	if err := f.store.put(newAttr); err != nil {
+		return err
+	}
+	f.attr = newAttr
+	f.dirty = false
+	return nil
+}
+
+func (f *diskFile) Read(offset uint64, buffer []byte) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.attr.Size <= offset {
+		return 0, nil
+	}
+	blob, err := os.Open(f.store.blobPath(f.attr.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	n, err = blob.ReadAt(buffer[:min(uint64(len(buffer)), f.attr.Size-offset)], int64(offset))
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *diskFile) Write(offset uint64, buffer []byte) (n int, err error) {
+	err = f.lockWrite(func(blob *os.File) (uint64, error) {
+		n, err = blob.WriteAt(buffer, int64(offset))
+		return max(f.attr.Size, offset+uint64(n)), err
+	})
+	return n, err
+}
+
+func (f *diskFile) Trunc(size uint64) error {
+	return f.lockWrite(func(blob *os.File) (uint64, error) {
+		return size, blob.Truncate(int64(size))
+	})
+}
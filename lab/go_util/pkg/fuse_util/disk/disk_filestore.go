@@ -0,0 +1,301 @@
+package fuse_util_disk
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+)
+
+const DEFAULT_COMPACT_SIZE = 64 << 20
+
+// DiskConfig - the journal survives the process being killed at any point,
+// Sync makes it survive a power loss as well at the cost of an fsync per change
+type DiskConfig struct {
+	Sync        bool
+	CompactSize int64 // the journal is rewritten with one record per file once it grows past this many bytes
+}
+
+func DefaultDiskConfig() DiskConfig {
+	return DiskConfig{
+		Sync:        false,
+		CompactSize: DEFAULT_COMPACT_SIZE,
+	}
+}
+
+// DiskFileStore - FileStore in a host directory, the data of file ID is in blobs/ID and everything else in the journal
+type DiskFileStore interface {
+	fuse_util.FileStore
+	fuse_util.Batcher
+	Close() error
+}
+
+func NewDiskFileStore(dir string) (DiskFileStore, error) {
+	return NewDiskFileStoreWithConfig(dir, DefaultDiskConfig())
+}
+
+// NewDiskFileStoreWithConfig - open the store in dir, creating it if needed
+// what a crash left behind is settled here: sizes come from the blobs, so do times of blobs written since their file was journaled,
+// and blobs of no file are removed - a damaged journal fails the open before any blob is touched
+func NewDiskFileStoreWithConfig(dir string, config DiskConfig) (DiskFileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, blobDir), 0o700); err != nil {
+		return nil, err
+	}
+	attrs, err := replayJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, blobDir))
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[uint64]os.FileInfo)
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if _, ok := attrs[id]; err != nil || !ok {
+			if err := os.Remove(filepath.Join(dir, blobDir, entry.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		blobs[id] = info
+	}
+
+	s := &diskFileStore{
+		dir:    dir,
+		config: config,
+		files:  make(map[uint64]*diskFile),
+		attrs:  make(map[uint64]fuse_util.FileAttr),
+	}
+	for id, attr := range attrs {
+		attr.Size = 0
+		if info, ok := blobs[id]; ok {
+			attr.Size = uint64(info.Size())
+			if info.ModTime().After(attr.Ctime) {
+				attr.Mtime = info.ModTime()
+				attr.Ctime = info.ModTime()
+			}
+		}
+		s.attrs[id] = attr
+		s.files[id] = &diskFile{store: s, attr: attr}
+		s.lastId = max(s.lastId, id)
+	}
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type diskFileStore struct {
+	dir    string
+	config DiskConfig
+
+	mu     sync.RWMutex
+	files  map[uint64]*diskFile
+	lastId uint64
+
+	batchMu sync.Mutex // one batch at a time
+
+	journalMu   sync.Mutex
+	journal     *os.File
+	journalSize int64
+	attrs       map[uint64]fuse_util.FileAttr // as in the journal
+	batch       []record                      // records of the open batch, nil if there is none
+	batchBlobs  []uint64                      // blobs of files deleted in the open batch, removed once it is journaled
+}
+
+func (s *diskFileStore) Create() (fuse_util.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	attr := fuse_util.FileAttr{
+		ID:     s.lastId + 1,
+		IsDir:  false,
+		Paths:  nil,
+		Mtime:  now,
+		Size:   0,
+		Mode:   0o644,
+		Atime:  now,
+		Ctime:  now,
+		Crtime: now,
+	}
+	if err := s.put(attr); err != nil {
+		return nil, err
+	}
+	s.lastId++
+	file := &diskFile{store: s, attr: attr}
+	s.files[attr.ID] = file
+	return file, nil
+}
+
+// Delete - the blob is removed after the journal says so, a crash in between leaves a blob that is removed on open
+func (s *diskFileStore) Delete(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return errors.New("file not found")
+	}
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if err := s.append(record{Op: opDelete, ID: id}); err != nil {
+		return err
+	}
+	file.deleted = true
+	delete(s.files, id)
+
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	if s.batch != nil {
+		s.batchBlobs = append(s.batchBlobs, id)
+		return nil
+	}
+	return s.removeBlob(id)
+}
+
+func (s *diskFileStore) removeBlob(id uint64) error {
+	if err := os.Remove(s.blobPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Batch - the changes made while f runs are journaled as one record once it returns,
+// changes of other goroutines in the meantime join the batch
+func (s *diskFileStore) Batch(f func() error) error {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+
+	s.journalMu.Lock()
+	s.batch = []record{}
+	s.journalMu.Unlock()
+
+	err := f()
+
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	records, blobs := s.batch, s.batchBlobs
+	s.batch, s.batchBlobs = nil, nil
+	if len(records) > 0 {
+		err = errors.Join(err, s.writeLocked(record{Op: opBatch, Records: records}))
+	}
+	for _, id := range blobs {
+		err = errors.Join(err, s.removeBlob(id))
+	}
+	return err
+}
+
+func (s *diskFileStore) Iterate(yield func(file fuse_util.File) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range slices.Sorted(maps.Keys(s.files)) {
+		if ok := yield(s.files[id]); !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Close - journal what writes changed and close the journal
+func (s *diskFileStore) Close() error {
+	s.mu.RLock()
+	var err error
+	for _, file := range s.files {
+		err = errors.Join(err, file.flush())
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	err = s.journal.Close()
+	s.journal = nil
+	return err
+}
+
+// put - journal the attr of a file
+func (s *diskFileStore) put(attr fuse_util.FileAttr) error {
+	return s.append(record{Op: opPut, ID: attr.ID, Attr: &attr})
+}
+
+func (s *diskFileStore) append(r record) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+	if s.batch != nil {
+		if r.Op == opPut {
+			attr := r.Attr.Clone()
+			r.Attr = &attr
+		}
+		s.batch = append(s.batch, r)
+		return nil
+	}
+	return s.writeLocked(r)
+}
+
+// writeLocked - write r as one line of the journal
+func (s *diskFileStore) writeLocked(r record) error {
+	b, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	if s.journal == nil {
+		return os.ErrClosed
+	}
+	n, err := s.journal.Write(b)
+	s.journalSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.config.Sync {
+		if err := s.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	r.apply(s.attrs)
+	if s.config.CompactSize > 0 && s.journalSize > s.config.CompactSize {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked - replace the journal by the current attributes and append to the new one
+func (s *diskFileStore) compactLocked() error {
+	if err := writeJournal(s.dir, s.attrs); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(filepath.Join(s.dir, journalName), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := journal.Stat()
+	if err != nil {
+		_ = journal.Close()
+		return err
+	}
+	if s.journal != nil {
+		_ = s.journal.Close()
+	}
+	s.journal = journal
+	s.journalSize = info.Size()
+	return nil
+}
@@ -0,0 +1,306 @@
+package fuse_util_disk_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+	fuse_util_disk "github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/disk"
+)
+
+func open(t *testing.T, dir string) fuse_util_disk.DiskFileStore {
+	t.Helper()
+	files, err := fuse_util_disk.NewDiskFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = files.Close()
+	})
+	return files
+}
+
+// create - a file at path with data
+func create(t *testing.T, files fuse_util.FileStore, path string, data string) fuse_util.File {
+	t.Helper()
+	file, err := files.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(0, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.UpdateAttr(func(attr fuse_util.FileAttr) fuse_util.FileAttr {
+		attr.Paths = [][]string{{path}}
+		return attr
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// contents - data by path of every file in the store
+func contents(t *testing.T, files fuse_util.FileStore) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	if err := files.Iterate(func(file fuse_util.File) bool {
+		attr, err := file.Attr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, attr.Size+1)
+		n, err := file.Read(0, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(n) != attr.Size {
+			t.Fatalf("file %d: read %d bytes, size %d", attr.ID, n, attr.Size)
+		}
+		for _, path := range attr.Paths {
+			out[path[0]] = string(buffer[:n])
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDiskFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	files := open(t, dir)
+	create(t, files, "a", "hello")
+	b := create(t, files, "b", "world")
+	if err := b.Trunc(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdateAttr(func(attr fuse_util.FileAttr) fuse_util.FileAttr {
+		attr.Mode = 0o600
+		attr.Xattr = map[string][]byte{"user.k": []byte("v")}
+		return attr
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c := create(t, files, "c", "gone")
+	if err := files.Delete(mustAttr(t, c).ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(0, []byte("late")); err == nil {
+		t.Fatal("write to a deleted file")
+	}
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files = open(t, dir)
+	want := map[string]string{"a": "hello", "b": "wo"}
+	if got := contents(t, files); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	var attr fuse_util.FileAttr
+	_ = files.Iterate(func(file fuse_util.File) bool {
+		attr = mustAttr(t, file)
+		return attr.Paths[0][0] != "b"
+	})
+	if attr.Mode != 0o600 || string(attr.Xattr["user.k"]) != "v" {
+		t.Fatalf("attr of b %+v", attr)
+	}
+
+	// ids are not reused while their files are there
+	d := create(t, files, "d", "")
+	if id := mustAttr(t, d).ID; id <= attr.ID {
+		t.Fatalf("id %d reused", id)
+	}
+}
+
+func mustAttr(t *testing.T, file fuse_util.File) fuse_util.FileAttr {
+	t.Helper()
+	attr, err := file.Attr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attr
+}
+
+// TestDiskFileStoreLeftovers - what a process killed in the middle of a change leaves behind
+func TestDiskFileStoreLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	files := open(t, dir)
+	a := create(t, files, "a", "12345")
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn record, a blob written but not journaled and a blob of no file
+	journal, err := os.OpenFile(filepath.Join(dir, "journal"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.WriteString(`0badc0de {"op":"put","id":7,"at`); err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.Close()
+	blob := filepath.Join(dir, "blobs", fmt.Sprint(mustAttr(t, a).ID))
+	if err := os.WriteFile(blob, []byte("1234567"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, "blobs", "99")
+	if err := os.WriteFile(orphan, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	files = open(t, dir)
+	if got := contents(t, files); got["a"] != "1234567" || len(got) != 1 {
+		t.Fatalf("got %v", got)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphan blob still there: %v", err)
+	}
+	create(t, files, "b", "b")
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, open(t, dir)); len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// firstFile - the file of the store with the lowest id
+func firstFile(t *testing.T, files fuse_util.FileStore) fuse_util.File {
+	t.Helper()
+	var first fuse_util.File
+	_ = files.Iterate(func(file fuse_util.File) bool {
+		first = file
+		return false
+	})
+	if first == nil {
+		t.Fatal("empty store")
+	}
+	return first
+}
+
+// TestDiskFileStoreLazyWrites - writes do not grow the journal, size and times still survive a close and a crash
+func TestDiskFileStoreLazyWrites(t *testing.T) {
+	dir := t.TempDir()
+	files := open(t, dir)
+	a := create(t, files, "a", "")
+	journal, err := os.Stat(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := a.Write(uint64(i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "journal")); err != nil || info.Size() != journal.Size() {
+		t.Fatalf("journal grew by writes: %v", err)
+	}
+	written := mustAttr(t, a)
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files = open(t, dir)
+	a = firstFile(t, files)
+	if attr := mustAttr(t, a); attr.Size != 100 || !attr.Mtime.Equal(written.Mtime) {
+		t.Fatalf("attr after a close %+v, want %+v", attr, written)
+	}
+
+	// opened again without a close, as after the process is killed
+	time.Sleep(20 * time.Millisecond)
+	if err := a.Trunc(50); err != nil {
+		t.Fatal(err)
+	}
+	if attr := mustAttr(t, firstFile(t, open(t, dir))); attr.Size != 50 || !attr.Mtime.After(written.Mtime) {
+		t.Fatalf("attr after a crash %+v", attr)
+	}
+}
+
+// TestDiskFileStoreCorrupt - a bad record before the last one fails the open and no blob is removed
+func TestDiskFileStoreCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	files := open(t, dir)
+	a := create(t, files, "a", "hello")
+	b := create(t, files, "b", "world")
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "journal")
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, rest, _ := bytes.Cut(journal, []byte("\n"))
+	first[len(first)/2] ^= 1
+	if err := os.WriteFile(path, append(append(first, '\n'), rest...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fuse_util_disk.NewDiskFileStore(dir); !errors.Is(err, fuse_util_disk.ErrCorruptJournal) {
+		t.Fatalf("expected corrupt journal, got %v", err)
+	}
+	for _, file := range []fuse_util.File{a, b} {
+		if _, err := os.Stat(filepath.Join(dir, "blobs", fmt.Sprint(mustAttr(t, file).ID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const childEnv = "FUSE_UTIL_DISK_CHILD"
+
+// TestDiskFileStoreKill - a process writing to the store is killed, the store opens with every file whole
+func TestDiskFileStoreKill(t *testing.T) {
+	if dir := os.Getenv(childEnv); dir != "" {
+		files, err := fuse_util_disk.NewDiskFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			file := create(t, files, fmt.Sprint(i), "")
+			for j := 0; j < 10; j++ {
+				if _, err := file.Write(uint64(j)*4, []byte("data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if i%3 == 0 {
+				if err := files.Delete(mustAttr(t, file).ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	for round := 0; round < 3; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDiskFileStoreKill$")
+		cmd.Env = append(os.Environ(), childEnv+"="+dir)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if err := cmd.Process.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		_ = cmd.Wait()
+
+		files := open(t, dir)
+		got := contents(t, files)
+		if len(got) == 0 {
+			t.Fatal("nothing written before the kill")
+		}
+		for path, data := range got {
+			if len(data)%4 != 0 || !bytes.Equal([]byte(data), bytes.Repeat([]byte("data"), len(data)/4)) {
+				t.Fatalf("file %s: %q", path, data)
+			}
+		}
+		if err := files.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package fuse_util_disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+)
+
+const (
+	journalName = "journal"
+	opPut       = "put"
+	opDelete    = "delete"
+	opBatch     = "batch"
+)
+
+// ErrCorruptJournal - a record before the last one is not whole, the journal was damaged rather than torn by a crash
+var ErrCorruptJournal = errors.New("corrupt journal")
+
+// record - one line of the journal, put has the whole attr of a file, batch has the records of a change to several files
+type record struct {
+	Op      string              `json:"op"`
+	ID      uint64              `json:"id"`
+	Attr    *fuse_util.FileAttr `json:"attr,omitempty"`
+	Records []record            `json:"records,omitempty"`
+}
+
+// apply - the attributes after r
+func (r record) apply(attrs map[uint64]fuse_util.FileAttr) {
+	switch r.Op {
+	case opPut:
+		attrs[r.ID] = r.Attr.Clone()
+	case opDelete:
+		delete(attrs, r.ID)
+	case opBatch:
+		for _, r := range r.Records {
+			r.apply(attrs)
+		}
+	}
+}
+
+// valid - a put has the attr of its file and a batch is not nested
+func (r record) valid(nested bool) bool {
+	switch r.Op {
+	case opPut:
+		return r.Attr != nil && r.Attr.ID == r.ID
+	case opDelete:
+		return true
+	case opBatch:
+		return !nested && !slices.ContainsFunc(r.Records, func(r record) bool {
+			return !r.valid(true)
+		})
+	default:
+		return false
+	}
+}
+
+// encodeRecord - checksum, space, json, newline - a line is written with a single write so a crash leaves at most a torn last line
+func encodeRecord(r record) ([]byte, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "%08x %s\n", crc32.ChecksumIEEE(b), b), nil
+}
+
+func decodeRecord(line []byte) (r record, err error) {
+	sum, b, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok {
+		return r, errors.New("malformed record")
+	}
+	want, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil {
+		return r, err
+	}
+	if crc32.ChecksumIEEE(b) != uint32(want) {
+		return r, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return r, err
+	}
+	if !r.valid(false) {
+		return r, errors.New("malformed record")
+	}
+	return r, nil
+}
+
+// replayJournal - attributes of the files in the journal of dir
+// a crash can only tear the last line written, any other bad line fails the replay
+func replayJournal(dir string) (map[uint64]fuse_util.FileAttr, error) {
+	attrs := make(map[uint64]fuse_util.FileAttr)
+	f, err := os.Open(filepath.Join(dir, journalName))
+	if errors.Is(err, os.ErrNotExist) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var torn error // the last bad line, only fine if nothing follows it
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return attrs, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if torn != nil {
+			return nil, torn
+		}
+		if errors.Is(err, io.EOF) {
+			return attrs, nil // an unterminated line is torn
+		}
+		r, err := decodeRecord(line)
+		if err != nil {
+			torn = fmt.Errorf("%w: line %d: %w", ErrCorruptJournal, n, err)
+			continue
+		}
+		r.apply(attrs)
+	}
+}
+
+// writeJournal - replace the journal of dir by one put per file, atomically
+func writeJournal(dir string, attrs map[uint64]fuse_util.FileAttr) error {
+	tmp := filepath.Join(dir, journalName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for id, attr := range attrs {
+		b, err := encodeRecord(record{Op: opPut, ID: id, Attr: &attr})
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := writer.Write(b); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, journalName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir - make a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
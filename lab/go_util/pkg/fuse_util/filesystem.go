@@ -1,46 +1,98 @@
 package fuse_util
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"os"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 )
 
-func NewFuseFileSystem(files FileStore) (fuseutil.FileSystem, error) {
+// FileSystem - read-only snapshots of the tree are browsed under .snapshots/<name>/ in the root
+type FileSystem interface {
+	fuseutil.FileSystem
+	CreateSnapshot(name string) error
+	ListSnapshots() []SnapshotInfo
+	DeleteSnapshot(name string) error
+}
+
+func NewFuseFileSystem(files FileStore) (FileSystem, error) {
+	s := newSnapshots()
 	m := &memFS{
-		files: files,
-		inodePool: newInodePool(node{
-			inode: fuseops.RootInodeID,
-			path:  nil,
-			file:  newDir(),
-		}),
+		files:     files,
+		snapshots: s,
 	}
 	// populate the inodes for directories and files
-	iterErr := error(nil)
+	var root File
+	var dirs, others []File
 	if err := files.Iterate(func(file File) bool {
-		path := mustAttr(file).Path
-		if len(path) == 0 {
-			iterErr = errors.New("file must not have empty path")
-			return false
+		file = newCowFile(file, s)
+		attr := mustAttr(file)
+		switch {
+		case isRoot(attr) && root == nil:
+			root = file
+		case attr.IsDir:
+			dirs = append(dirs, file)
+		default:
+			others = append(others, file)
 		}
-		// populate the parent directories
-		for i := 0; i < len(path); i++ {
-			dirpath := path[:i]
-			if _, ok := m.inodePool.getNodeFromPath(dirpath); !ok {
-				m.inodePool.createNode(dirpath, newDir())
-			}
-		}
-		// set the file inode
-		m.inodePool.createNode(path, file)
 		return true
 	}); err != nil {
 		return nil, err
 	}
-	if iterErr != nil {
-		return nil, iterErr
+	// a store written before the root was kept in it
+	if root == nil {
+		file, err := m.createInStore()
+		if err != nil {
+			return nil, err
+		}
+		if err := file.UpdateAttr(rootAttr); err != nil {
+			return nil, err
+		}
+		root = file
+	}
+	m.inodePool = newInodePool(node{
+		inode: fuseops.RootInodeID,
+		path:  nil,
+		file:  root,
+	})
+	// parents first
+	slices.SortFunc(dirs, func(a File, b File) int {
+		return cmp.Compare(depth(mustAttr(a)), depth(mustAttr(b)))
+	})
+	for _, file := range append(dirs, others...) {
+		attr := mustAttr(file)
+		paths := attr.Paths
+		if len(paths) == 0 { // unlinked but not deleted when the process died
+			if err := files.Delete(attr.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var fileNode node
+		for i, path := range paths {
+			if len(path) == 0 {
+				return nil, errors.New("file must not have empty path")
+			}
+			// populate the parent directories missing from the store
+			for i := 1; i < len(path); i++ {
+				if err := m.populateDir(path[:i]); err != nil {
+					return nil, err
+				}
+			}
+			// set the file inode, hard links share it
+			if i == 0 {
+				fileNode, _ = m.inodePool.createNode(path, file)
+			} else {
+				m.inodePool.linkNode(path, fileNode)
+			}
+		}
 	}
 
 	m.updateAllMtimeWithoutLock()
@@ -48,10 +100,48 @@ func NewFuseFileSystem(files FileStore) (fuseutil.FileSystem, error) {
 	return m, nil
 }
 
+// populateDir - add the directory at path to the store if it is not in the tree
+func (m *memFS) populateDir(path []string) error {
+	if _, ok := m.inodePool.getNodeFromPath(path); ok {
+		return nil
+	}
+	file, err := m.createInStore()
+	if err != nil {
+		return err
+	}
+	if err := file.UpdateAttr(func(attr FileAttr) FileAttr {
+		attr = dirAttr(attr)
+		attr.Paths = [][]string{slices.Clone(path)}
+		return attr
+	}); err != nil {
+		return err
+	}
+	m.inodePool.createNode(path, file)
+	return nil
+}
+
 type memFS struct {
 	fuseutil.NotImplementedFileSystem
 	files     FileStore
 	inodePool *inodePool
+	snapshots *snapshots
+}
+
+// batch - run f as one change of the store if it can make one
+func (m *memFS) batch(f func() error) error {
+	if b, ok := m.files.(Batcher); ok {
+		return b.Batch(f)
+	}
+	return f()
+}
+
+// createInStore - a new file of the store, kept for the snapshots that will see it
+func (m *memFS) createInStore() (File, error) {
+	file, err := m.files.Create()
+	if err != nil {
+		return nil, err
+	}
+	return newCowFile(file, m.snapshots), nil
 }
 
 func (m *memFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
@@ -60,6 +150,14 @@ func (m *memFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
 
 // LookUpInode - get child info
 func (m *memFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	if m.snapshots.owns(op.Parent) {
+		return m.lookUpSnapshot(op)
+	}
+	if reserved(op.Parent, op.Name) {
+		op.Entry.Child = snapshotInodeBase
+		op.Entry.Attributes = m.snapshotDirAttributes()
+		return nil
+	}
 	path, err := getPathWithParent(m, op)
 	if err != nil {
 		return err
@@ -77,6 +175,9 @@ func (m *memFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) erro
 
 // GetInodeAttributes - get self info
 func (m *memFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	if m.snapshots.owns(op.Inode) {
+		return m.getSnapshotAttributes(op)
+	}
 	node, ok := m.inodePool.getNodeFromInode(op.Inode)
 	if !ok {
 		return fuse.ENOENT
@@ -90,26 +191,41 @@ func (m *memFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
 }
 
 // ReadDir - analogous to `ls`
+// the snapshot directory is not listed in the root so that walking the tree does not go through every snapshot
 func (m *memFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	if m.snapshots.owns(op.Inode) {
+		return m.readSnapshotDir(op)
+	}
 	node, ok := m.inodePool.getNodeFromInode(op.Inode)
 	if !ok {
 		return fuse.ENOENT
 	}
 
 	var entries []fuseutil.Dirent
-	var offset fuseops.DirOffset = 1
 	for name, child := range m.inodePool.list(node.path) {
-		dtype := fuseutil.DT_Directory
-		if !child.isDir() {
-			dtype = fuseutil.DT_File
+		if reserved(op.Inode, name) {
+			continue
+		}
+		attr := mustAttr(child.file)
+		dtype := fuseutil.DT_File
+		switch {
+		case attr.IsDir:
+			dtype = fuseutil.DT_Directory
+		case attr.IsSymlink:
+			dtype = fuseutil.DT_Link
 		}
 		entries = append(entries, fuseutil.Dirent{
-			Offset: offset,
-			Inode:  child.inode,
-			Name:   name,
-			Type:   dtype,
+			Inode: child.inode,
+			Name:  name,
+			Type:  dtype,
 		})
-		offset += 1
+	}
+	// sorted so that offsets stay the same from one call to the next
+	slices.SortFunc(entries, func(a fuseutil.Dirent, b fuseutil.Dirent) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(i + 1)
 	}
 
 	if op.Offset > fuseops.DirOffset(len(entries)) {
@@ -126,16 +242,21 @@ func (m *memFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
 	return nil
 }
 
-// MkDir -
+// MkDir - directories are kept in the store too so that empty ones are not lost
+// a directory made in the snapshot directory is a new snapshot
 func (m *memFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
-	path, err := getPathWithParent(m, op)
+	if op.Parent == snapshotInodeBase {
+		return m.mkSnapshot(op)
+	}
+	node, err := m.createFile(op.Parent, op.Name, op.Mode, op.OpContext, func(file File) error {
+		return file.UpdateAttr(func(attr FileAttr) FileAttr {
+			attr.IsDir = true
+			return attr
+		})
+	})
 	if err != nil {
 		return err
 	}
-	node, ok := m.inodePool.createNode(path, newDir())
-	if !ok {
-		return fuse.ENOENT
-	}
 
 	op.Entry = fuseops.ChildInodeEntry{
 		Child:      node.inode,
@@ -145,48 +266,98 @@ func (m *memFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 }
 
 func (m *memFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
-	path, err := getPathWithParent(m, op)
+	node, err := m.createFile(op.Parent, op.Name, op.Mode, op.OpContext, nil)
 	if err != nil {
 		return err
 	}
 
-	file, err := m.files.Create()
-	if err != nil {
-		return err
+	op.Handle = fuseops.HandleID(node.inode)
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      node.inode,
+		Attributes: getInodeAttributes(mustAttr(node.file)),
 	}
+	return nil
+}
 
-	err = file.UpdateAttr(func(attr FileAttr) FileAttr {
-		attr.Path = path
-		return attr
-	})
-	if err != nil {
-		return err
+// createFile - new file in the store at name under parent, setup if not nil runs before it shows up in the tree
+func (m *memFS) createFile(parentInode fuseops.InodeID, name string, mode os.FileMode, opCtx fuseops.OpContext, setup func(File) error) (node, error) {
+	if err := m.readOnly(parentInode); err != nil {
+		return node{}, err
 	}
-
-	node, ok := m.inodePool.createNode(path, file)
+	if reserved(parentInode, name) {
+		return node{}, fuse.EEXIST
+	}
+	parent, ok := m.inodePool.getNodeFromInode(parentInode)
 	if !ok {
-		return fuse.ENOENT
+		return node{}, fuse.ENOENT
 	}
+	path := append(slices.Clone(parent.path), name)
 
-	defer m.updateMtimeWithoutLock(node.path)
-
-	op.Handle = fuseops.HandleID(node.inode)
-	op.Entry = fuseops.ChildInodeEntry{
-		Child:      node.inode,
-		Attributes: getInodeAttributes(mustAttr(node.file)),
+	var file File
+	var n node
+	if err := m.batch(func() (err error) {
+		file, err = m.createInStore()
+		if err != nil {
+			return err
+		}
+		if err := file.UpdateAttr(func(attr FileAttr) FileAttr {
+			attr = ownAttr(attr, mode, opCtx, parent)
+			attr.Paths = [][]string{path}
+			return attr
+		}); err != nil {
+			return err
+		}
+		if setup != nil {
+			if err := setup(file); err != nil {
+				return err
+			}
+		}
+		var ok bool
+		n, ok = m.inodePool.createNode(path, file)
+		if !ok {
+			return fuse.EEXIST
+		}
+		return nil
+	}); err != nil {
+		if file != nil {
+			_ = m.files.Delete(mustAttr(file).ID)
+		}
+		return node{}, err
 	}
-	return nil
+
+	m.updateMtimeWithoutLock(n.path)
+	return n, nil
 }
 
-// RmDir - rmdir
+// RmDir - rmdir, in the snapshot directory it deletes a snapshot
 func (m *memFS) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	if op.Parent == snapshotInodeBase {
+		return m.rmSnapshot(op)
+	}
+	if err := m.readOnly(op.Parent); err != nil {
+		return err
+	}
+	if reserved(op.Parent, op.Name) {
+		return syscall.EROFS
+	}
 	path, err := getPathWithParent(m, op)
 	if err != nil {
 		return err
 	}
 	if ok := m.inodePool.deleteNodeIf(path, func(n node) bool {
-		return n.isDir()
+		if !n.isDir() {
+			return false
+		}
+		for range m.inodePool.pathToNode.List(path) { // the pool is locked already
+			err = fuse.ENOTEMPTY
+			return false
+		}
+		err = m.unlink(n)
+		return err == nil
 	}); !ok {
+		if err != nil {
+			return err
+		}
 		return fuse.ENOENT
 	}
 	return nil
@@ -194,6 +365,12 @@ func (m *memFS) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 
 // Unlink - rm
 func (m *memFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	if err := m.readOnly(op.Parent); err != nil {
+		return err
+	}
+	if reserved(op.Parent, op.Name) {
+		return syscall.EROFS
+	}
 	path, err := getPathWithParent(m, op)
 	if err != nil {
 		return err
@@ -203,12 +380,8 @@ func (m *memFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 		if n.isDir() {
 			return false
 		}
-		id := mustAttr(n.file).ID
-		err = m.files.Delete(id)
-		if err != nil {
-			return false
-		}
-		return true
+		err = m.unlink(n)
+		return err == nil
 	}); !ok {
 		if err != nil {
 			return err
@@ -219,15 +392,84 @@ func (m *memFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 	return nil
 }
 
-// TODO - support rename
-
+// Rename - mv, an existing target is replaced in the same step so that write-then-rename is atomic
 func (m *memFS) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	if err := m.readOnly(op.OldParent, op.NewParent); err != nil {
+		return err
+	}
+	if reserved(op.OldParent, op.OldName) || reserved(op.NewParent, op.NewName) {
+		return syscall.EROFS
+	}
 	oldParent, ok := m.inodePool.getNodeFromInode(op.OldParent)
-	oldName := op.OldName
+	if !ok {
+		return fuse.ENOENT
+	}
 	newParent, ok := m.inodePool.getNodeFromInode(op.NewParent)
-	newName := op.NewName
-	_ = []any{oldParent, oldName, newParent, newName, ok}
-	return errors.New("not implemented yet")
+	if !ok {
+		return fuse.ENOENT
+	}
+	oldPath := append(slices.Clone(oldParent.path), op.OldName)
+	newPath := append(slices.Clone(newParent.path), op.NewName)
+
+	// the store changes before the tree, which is left as is if the store fails
+	// the paths of the moved files are journaled together, a crash never leaves a tree half moved
+	now := time.Now()
+	if err := m.inodePool.moveNode(oldPath, newPath, func(replaced *node, moved []node) error {
+		var updated []node
+		err := m.batch(func() error {
+			var err error
+			// paths first as they can be put back, the replaced file may leave the store
+			if updated, err = movePaths(moved, newPath, oldPath, newPath, now); err != nil {
+				return err
+			}
+			if replaced != nil {
+				if err := m.unlink(*replaced); err != nil {
+					return err
+				}
+			}
+			// both parents changed
+			for _, parent := range []node{oldParent, newParent} {
+				_ = parent.file.UpdateAttr(func(attr FileAttr) FileAttr {
+					attr.Mtime = now
+					attr.Ctime = now
+					return attr
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			_, _ = movePaths(updated, newPath, newPath, oldPath, now) // as they were, for the tree that stays
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, parent := range []node{oldParent, newParent} {
+		m.updateMtimeWithoutLock(parent.path)
+	}
+	return nil
+}
+
+// movePaths - the link of each node under from goes to the same place under to, nodes are at their place under at
+// the first node is the one renamed and changes its ctime, updated are the nodes changed before an error
+func movePaths(nodes []node, at []string, from []string, to []string, ctime time.Time) (updated []node, err error) {
+	for i, n := range nodes {
+		rest := n.path[len(at):]
+		src, dst := append(slices.Clone(from), rest...), append(slices.Clone(to), rest...)
+		if err := n.file.UpdateAttr(func(attr FileAttr) FileAttr {
+			if j := attr.pathIndex(src); j >= 0 {
+				attr.Paths[j] = dst
+			}
+			if i == 0 {
+				attr.Ctime = ctime
+			}
+			return attr
+		}); err != nil {
+			return updated, err
+		}
+		updated = append(updated, n)
+	}
+	return updated, nil
 }
 
 func (m *memFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
@@ -235,6 +477,9 @@ func (m *memFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
 }
 
 func (m *memFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	if m.snapshots.owns(op.Inode) {
+		return m.readSnapshotFile(op)
+	}
 	node, ok := m.inodePool.getNodeFromInode(op.Inode)
 	if !ok || node.isDir() {
 		return fuse.ENOENT
@@ -245,28 +490,62 @@ func (m *memFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
 }
 
 func (m *memFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	if err := m.readOnly(op.Inode); err != nil {
+		return err
+	}
 	node, ok := m.inodePool.getNodeFromInode(op.Inode)
 	if !ok || node.isDir() {
 		return fuse.ENOENT
 	}
-	defer m.updateMtimeWithoutLock(node.path)
+	defer m.updateMtimeOfLinksWithoutLock(node)
 
 	_, err := node.file.Write(uint64(op.Offset), op.Data)
 	return err
 }
 
-// SetInodeAttributes -
+// SetInodeAttributes - truncate, chmod, chown and touch
 func (m *memFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	if err := m.readOnly(op.Inode); err != nil {
+		return err
+	}
+	node, ok := m.inodePool.getNodeFromInode(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+	if op.Size != nil || op.Mtime != nil {
+		defer m.updateMtimeOfLinksWithoutLock(node)
+	}
+
 	if op.Size != nil { // truncate
-		node, ok := m.inodePool.getNodeFromInode(op.Inode)
-		if !ok || node.isDir() {
-			return fuse.ENOENT
+		if node.isDir() {
+			return syscall.EISDIR
 		}
-
-		defer m.updateMtimeWithoutLock(node.path)
-
-		return node.file.Trunc(*op.Size)
+		if err := node.file.Trunc(*op.Size); err != nil {
+			return err
+		}
+	}
+	if err := node.file.UpdateAttr(func(attr FileAttr) FileAttr {
+		if op.Mode != nil {
+			attr.Mode = *op.Mode & modeMask
+		}
+		if op.Uid != nil {
+			attr.Uid = *op.Uid
+		}
+		if op.Gid != nil {
+			attr.Gid = *op.Gid
+		}
+		if op.Atime != nil {
+			attr.Atime = *op.Atime
+		}
+		if op.Mtime != nil {
+			attr.Mtime = *op.Mtime
+		}
+		attr.Ctime = time.Now()
+		return attr
+	}); err != nil {
+		return err
 	}
-	// other changes like mode are not supported yet
-	return errors.New("not implemented yet")
+
+	op.Attributes = getInodeAttributes(mustAttr(node.file))
+	return nil
 }
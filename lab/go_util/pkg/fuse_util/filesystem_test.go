@@ -0,0 +1,855 @@
+package fuse_util_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util"
+	fuse_util_disk "github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/disk"
+	fuse_util_mem "github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/mem"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// lookup - inode of path, slash separated
+func lookup(t *testing.T, fs fuseutil.FileSystem, path string) (fuseops.InodeID, error) {
+	t.Helper()
+	inode := fuseops.InodeID(fuseops.RootInodeID)
+	if path == "" {
+		return inode, nil
+	}
+	for _, name := range strings.Split(path, "/") {
+		op := &fuseops.LookUpInodeOp{Parent: inode, Name: name}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			return 0, err
+		}
+		inode = op.Entry.Child
+	}
+	return inode, nil
+}
+
+func mustLookup(t *testing.T, fs fuseutil.FileSystem, path string) fuseops.InodeID {
+	t.Helper()
+	inode, err := lookup(t, fs, path)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", path, err)
+	}
+	return inode
+}
+
+func split(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+func mkdir(t *testing.T, fs fuseutil.FileSystem, path string) {
+	t.Helper()
+	dir, name := split(path)
+	op := &fuseops.MkDirOp{Parent: mustLookup(t, fs, dir), Name: name}
+	if err := fs.MkDir(context.Background(), op); err != nil {
+		t.Fatalf("mkdir %s: %v", path, err)
+	}
+}
+
+func writeFile(t *testing.T, fs fuseutil.FileSystem, path string, data string) {
+	t.Helper()
+	dir, name := split(path)
+	op := &fuseops.CreateFileOp{Parent: mustLookup(t, fs, dir), Name: name}
+	if err := fs.CreateFile(context.Background(), op); err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	if err := fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: op.Entry.Child, Data: []byte(data)}); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func readFile(t *testing.T, fs fuseutil.FileSystem, path string) string {
+	t.Helper()
+	op := &fuseops.ReadFileOp{Inode: mustLookup(t, fs, path), Dst: make([]byte, 1024)}
+	if err := fs.ReadFile(context.Background(), op); err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(op.Dst[:op.BytesRead])
+}
+
+func rename(t *testing.T, fs fuseutil.FileSystem, oldPath string, newPath string) error {
+	t.Helper()
+	oldDir, oldName := split(oldPath)
+	newDir, newName := split(newPath)
+	return fs.Rename(context.Background(), &fuseops.RenameOp{
+		OldParent: mustLookup(t, fs, oldDir),
+		OldName:   oldName,
+		NewParent: mustLookup(t, fs, newDir),
+		NewName:   newName,
+	})
+}
+
+// storedPaths - paths of the files in the store, directories aside
+func storedPaths(t *testing.T, files fuse_util.FileStore) []string {
+	t.Helper()
+	var paths []string
+	if err := files.Iterate(func(file fuse_util.File) bool {
+		attr, err := file.Attr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.IsDir {
+			return true
+		}
+		for _, path := range attr.Paths {
+			paths = append(paths, strings.Join(path, "/"))
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func newFS(t *testing.T, files fuse_util.FileStore) fuseutil.FileSystem {
+	t.Helper()
+	fs, err := fuse_util.NewFuseFileSystem(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestRename(t *testing.T) {
+	files := fuse_util_mem.NewMemFileStore()
+	fs := newFS(t, files)
+
+	mkdir(t, fs, "a")
+	mkdir(t, fs, "a/sub")
+	mkdir(t, fs, "b")
+	writeFile(t, fs, "a/sub/x", "x")
+	writeFile(t, fs, "a/y", "y")
+
+	// file across directories
+	if err := rename(t, fs, "a/y", "b/y2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookup(t, fs, "a/y"); !errors.Is(err, fuse.ENOENT) {
+		t.Fatalf("old path still there: %v", err)
+	}
+	if got := readFile(t, fs, "b/y2"); got != "y" {
+		t.Fatalf("got %q", got)
+	}
+
+	// write then rename over an existing file
+	writeFile(t, fs, "b/tmp", "new")
+	inode := mustLookup(t, fs, "b/tmp")
+	if err := rename(t, fs, "b/tmp", "b/y2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustLookup(t, fs, "b/y2"); got != inode {
+		t.Fatalf("inode %d, want %d", got, inode)
+	}
+	if got := readFile(t, fs, "b/y2"); got != "new" {
+		t.Fatalf("got %q", got)
+	}
+
+	// directory with its subtree
+	if err := rename(t, fs, "a", "b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "b/c/sub/x"); got != "x" {
+		t.Fatalf("got %q", got)
+	}
+	readDir := &fuseops.ReadDirOp{Inode: mustLookup(t, fs, "b/c/sub"), Dst: make([]byte, 1024)}
+	if err := fs.ReadDir(context.Background(), readDir); err != nil {
+		t.Fatal(err)
+	}
+	if readDir.BytesRead == 0 {
+		t.Fatal("moved directory lost its children")
+	}
+
+	want := []string{"b/c/sub/x", "b/y2"}
+	if got := storedPaths(t, files); !slices.Equal(got, want) {
+		t.Fatalf("stored paths %v, want %v", got, want)
+	}
+
+	// the store is enough to mount the same tree again
+	fs = newFS(t, files)
+	if got := readFile(t, fs, "b/c/sub/x"); got != "x" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestRenameErrors(t *testing.T) {
+	fs := newFS(t, fuse_util_mem.NewMemFileStore())
+
+	mkdir(t, fs, "full")
+	mkdir(t, fs, "empty")
+	mkdir(t, fs, "dir")
+	mkdir(t, fs, "dir/inner")
+	writeFile(t, fs, "full/f", "f")
+	writeFile(t, fs, "file", "file")
+
+	for _, c := range []struct {
+		oldPath string
+		newPath string
+		want    error
+	}{
+		{"missing", "x", fuse.ENOENT},
+		{"dir", "full", fuse.ENOTEMPTY},
+		{"file", "empty", syscall.EISDIR},
+		{"dir", "file", fuse.ENOTDIR},
+		{"dir", "dir/inner/dir", fuse.EINVAL},
+	} {
+		if err := rename(t, fs, c.oldPath, c.newPath); !errors.Is(err, c.want) {
+			t.Errorf("rename %s %s: got %v, want %v", c.oldPath, c.newPath, err, c.want)
+		}
+	}
+
+	// nothing moved
+	mustLookup(t, fs, "dir/inner")
+	mustLookup(t, fs, "full/f")
+
+	// an empty directory is replaced
+	if err := rename(t, fs, "dir", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	mustLookup(t, fs, "empty/inner")
+	if _, err := lookup(t, fs, "dir"); !errors.Is(err, fuse.ENOENT) {
+		t.Fatalf("old path still there: %v", err)
+	}
+}
+
+var errUpdate = errors.New("update")
+
+// failingStore - a store whose files fail to update their attributes once left updates are made, left < 0 never fails
+type failingStore struct {
+	fuse_util.FileStore
+	left *int
+}
+
+type failingFile struct {
+	fuse_util.File
+	left *int
+}
+
+func (s failingStore) Create() (fuse_util.File, error) {
+	file, err := s.FileStore.Create()
+	return failingFile{File: file, left: s.left}, err
+}
+
+func (s failingStore) Iterate(yield func(file fuse_util.File) bool) error {
+	return s.FileStore.Iterate(func(file fuse_util.File) bool {
+		return yield(failingFile{File: file, left: s.left})
+	})
+}
+
+func (f failingFile) UpdateAttr(update func(fuse_util.FileAttr) fuse_util.FileAttr) error {
+	if *f.left == 0 {
+		return errUpdate
+	}
+	if *f.left > 0 {
+		*f.left--
+	}
+	return f.File.UpdateAttr(update)
+}
+
+func TestRenameStoreError(t *testing.T) {
+	left := -1
+	files := failingStore{FileStore: fuse_util_mem.NewMemFileStore(), left: &left}
+	fs := newFS(t, files)
+	mkdir(t, fs, "a")
+	writeFile(t, fs, "a/x", "x")
+	writeFile(t, fs, "y", "y")
+
+	// the directory is moved in the store, its file is not
+	left = 1
+	if err := rename(t, fs, "a", "b"); !errors.Is(err, errUpdate) {
+		t.Fatalf("expected the update error, got %v", err)
+	}
+	left = -1
+	if got := readFile(t, fs, "a/x"); got != "x" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := lookup(t, fs, "b"); !errors.Is(err, fuse.ENOENT) {
+		t.Fatalf("new path is there: %v", err)
+	}
+	if got := storedPaths(t, files); !slices.Equal(got, []string{"a/x", "y"}) {
+		t.Fatalf("stored %v", got)
+	}
+	fs = newFS(t, files)
+	mustLookup(t, fs, "a/x")
+
+	// the replaced file stays if the rename fails
+	left = 0
+	if err := rename(t, fs, "y", "a/x"); !errors.Is(err, errUpdate) {
+		t.Fatalf("expected the update error, got %v", err)
+	}
+	left = -1
+	if readFile(t, fs, "a/x") != "x" || readFile(t, fs, "y") != "y" {
+		t.Fatal("files changed")
+	}
+	if err := rename(t, fs, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedPaths(t, files); !slices.Equal(got, []string{"b/x", "y"}) {
+		t.Fatalf("stored %v", got)
+	}
+}
+
+func getAttr(t *testing.T, fs fuseutil.FileSystem, path string) fuseops.InodeAttributes {
+	t.Helper()
+	op := &fuseops.GetInodeAttributesOp{Inode: mustLookup(t, fs, path)}
+	if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+		t.Fatalf("getattr %s: %v", path, err)
+	}
+	return op.Attributes
+}
+
+func TestSetInodeAttributes(t *testing.T) {
+	fs := newFS(t, fuse_util_mem.NewMemFileStore())
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "f", Mode: 0o640, OpContext: fuseops.OpContext{Uid: 1000}}
+	if err := fs.CreateFile(context.Background(), create); err != nil {
+		t.Fatal(err)
+	}
+	if got := create.Entry.Attributes; got.Mode != 0o640 || got.Uid != 1000 {
+		t.Fatalf("created with mode %v uid %d", got.Mode, got.Uid)
+	}
+	if err := fs.MkDir(context.Background(), &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "d", Mode: 0o750}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getAttr(t, fs, "d").Mode; got != os.ModeDir|0o750 {
+		t.Fatalf("directory mode %v", got)
+	}
+
+	before := getAttr(t, fs, "f")
+	mode := os.ModeSetuid | 0o755
+	uid, gid := uint32(1), uint32(2)
+	atime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	mtime := time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := &fuseops.SetInodeAttributesOp{
+		Inode: mustLookup(t, fs, "f"),
+		Mode:  &mode,
+		Uid:   &uid,
+		Gid:   &gid,
+		Atime: &atime,
+		Mtime: &mtime,
+	}
+	if err := fs.SetInodeAttributes(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	got := getAttr(t, fs, "f")
+	if got != op.Attributes {
+		t.Fatalf("setattr answered %v, getattr %v", op.Attributes, got)
+	}
+	if got.Mode != os.ModeSetuid|0o755 || got.Uid != uid || got.Gid != gid {
+		t.Fatalf("mode %v uid %d gid %d", got.Mode, got.Uid, got.Gid)
+	}
+	if !got.Atime.Equal(atime) || !got.Mtime.Equal(mtime) {
+		t.Fatalf("atime %v mtime %v", got.Atime, got.Mtime)
+	}
+	if !got.Ctime.After(before.Ctime) || !got.Crtime.Equal(before.Crtime) {
+		t.Fatalf("ctime %v crtime %v, before %v %v", got.Ctime, got.Crtime, before.Ctime, before.Crtime)
+	}
+
+	// truncate
+	size := uint64(10)
+	if err := fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{Inode: mustLookup(t, fs, "f"), Size: &size}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getAttr(t, fs, "f"); got.Size != size || got.Mode != os.ModeSetuid|0o755 {
+		t.Fatalf("size %d mode %v", got.Size, got.Mode)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	files := fuse_util_mem.NewMemFileStore()
+	fs := newFS(t, files)
+	writeFile(t, fs, "f", "")
+	inode := mustLookup(t, fs, "f")
+	ctx := context.Background()
+
+	set := func(name string, value string, flags uint32) error {
+		return fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: inode, Name: name, Value: []byte(value), Flags: flags})
+	}
+	if err := set("user.a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("user.b", "22", 0x1); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("user.b", "x", 0x1); !errors.Is(err, fuse.EEXIST) {
+		t.Fatalf("create existing: %v", err)
+	}
+	if err := set("user.c", "x", 0x2); !errors.Is(err, fuse.ENOATTR) {
+		t.Fatalf("replace missing: %v", err)
+	}
+
+	// size first, then the value
+	get := &fuseops.GetXattrOp{Inode: inode, Name: "user.b"}
+	if err := fs.GetXattr(ctx, get); err != nil || get.BytesRead != 2 {
+		t.Fatalf("size %d: %v", get.BytesRead, err)
+	}
+	get.Dst = make([]byte, 1)
+	if err := fs.GetXattr(ctx, get); !errors.Is(err, syscall.ERANGE) {
+		t.Fatalf("small buffer: %v", err)
+	}
+	get.Dst = make([]byte, 2)
+	if err := fs.GetXattr(ctx, get); err != nil || string(get.Dst[:get.BytesRead]) != "22" {
+		t.Fatalf("got %q: %v", get.Dst[:get.BytesRead], err)
+	}
+
+	list := &fuseops.ListXattrOp{Inode: inode, Dst: make([]byte, 64)}
+	if err := fs.ListXattr(ctx, list); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(list.Dst[:list.BytesRead]); got != "user.a\x00user.b\x00" {
+		t.Fatalf("list %q", got)
+	}
+
+	if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: inode, Name: "user.a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: inode, Name: "user.a"}); !errors.Is(err, fuse.ENOATTR) {
+		t.Fatalf("remove missing: %v", err)
+	}
+
+	// kept by the store
+	fs = newFS(t, files)
+	get = &fuseops.GetXattrOp{Inode: mustLookup(t, fs, "f"), Name: "user.b", Dst: make([]byte, 8)}
+	if err := fs.GetXattr(ctx, get); err != nil || string(get.Dst[:get.BytesRead]) != "22" {
+		t.Fatalf("got %q: %v", get.Dst[:get.BytesRead], err)
+	}
+}
+
+func unlink(t *testing.T, fs fuseutil.FileSystem, path string) {
+	t.Helper()
+	dir, name := split(path)
+	if err := fs.Unlink(context.Background(), &fuseops.UnlinkOp{Parent: mustLookup(t, fs, dir), Name: name}); err != nil {
+		t.Fatalf("unlink %s: %v", path, err)
+	}
+}
+
+func link(t *testing.T, fs fuseutil.FileSystem, target string, path string) error {
+	t.Helper()
+	dir, name := split(path)
+	return fs.CreateLink(context.Background(), &fuseops.CreateLinkOp{
+		Parent: mustLookup(t, fs, dir),
+		Name:   name,
+		Target: mustLookup(t, fs, target),
+	})
+}
+
+func TestHardLink(t *testing.T) {
+	files := fuse_util_mem.NewMemFileStore()
+	fs := newFS(t, files)
+	mkdir(t, fs, "d")
+	writeFile(t, fs, "f", "data")
+
+	if err := link(t, fs, "f", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := link(t, fs, "f", "d/g"); !errors.Is(err, fuse.EEXIST) {
+		t.Fatalf("link over existing: %v", err)
+	}
+	if err := link(t, fs, "d", "e"); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("link directory: %v", err)
+	}
+	if mustLookup(t, fs, "f") != mustLookup(t, fs, "d/g") {
+		t.Fatal("links have different inodes")
+	}
+	if got := getAttr(t, fs, "f").Nlink; got != 2 {
+		t.Fatalf("nlink %d", got)
+	}
+	if got := readFile(t, fs, "d/g"); got != "data" {
+		t.Fatalf("got %q", got)
+	}
+
+	// the tree is mounted again with both links to the same inode
+	fs = newFS(t, files)
+	if mustLookup(t, fs, "f") != mustLookup(t, fs, "d/g") {
+		t.Fatal("links have different inodes after mounting again")
+	}
+
+	// a link survives the removal of another, also when moved
+	unlink(t, fs, "f")
+	if err := rename(t, fs, "d/g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "h"); got != "data" {
+		t.Fatalf("got %q", got)
+	}
+	if got := getAttr(t, fs, "h").Nlink; got != 1 {
+		t.Fatalf("nlink %d", got)
+	}
+	if got := storedPaths(t, files); !slices.Equal(got, []string{"h"}) {
+		t.Fatalf("stored paths %v", got)
+	}
+
+	// renaming onto another link of the same file does nothing
+	if err := link(t, fs, "h", "i"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(t, fs, "h", "i"); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedPaths(t, files); !slices.Equal(got, []string{"h", "i"}) {
+		t.Fatalf("stored paths %v", got)
+	}
+
+	// the last link takes the file out of the store
+	unlink(t, fs, "h")
+	unlink(t, fs, "i")
+	if got := storedPaths(t, files); len(got) != 0 {
+		t.Fatalf("stored paths %v", got)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	files := fuse_util_mem.NewMemFileStore()
+	fs := newFS(t, files)
+	writeFile(t, fs, "f", "data")
+
+	op := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "s", Target: "../f"}
+	if err := fs.CreateSymlink(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if got := op.Entry.Attributes; got.Mode != os.ModeSymlink|0o777 || got.Size != 4 || got.Nlink != 1 {
+		t.Fatalf("mode %v size %d nlink %d", got.Mode, got.Size, got.Nlink)
+	}
+
+	fs = newFS(t, files)
+	read := &fuseops.ReadSymlinkOp{Inode: mustLookup(t, fs, "s")}
+	if err := fs.ReadSymlink(context.Background(), read); err != nil || read.Target != "../f" {
+		t.Fatalf("target %q: %v", read.Target, err)
+	}
+	read = &fuseops.ReadSymlinkOp{Inode: mustLookup(t, fs, "f")}
+	if err := fs.ReadSymlink(context.Background(), read); !errors.Is(err, fuse.EINVAL) {
+		t.Fatalf("readlink of a file: %v", err)
+	}
+}
+
+func TestMountAgainFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	files, err := fuse_util_disk.NewDiskFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFS(t, files)
+	ctx := context.Background()
+
+	mkdir(t, fs, "empty")
+	mkdir(t, fs, "d")
+	writeFile(t, fs, "d/f", "data")
+	if err := link(t, fs, "d/f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "s", Target: "d/f"}); err != nil {
+		t.Fatal(err)
+	}
+	mode := os.FileMode(0o700)
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: mustLookup(t, fs, "empty"), Mode: &mode}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: mustLookup(t, fs, "d"), Name: "user.k", Value: []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+	rootMode := os.FileMode(0o750)
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: fuseops.RootInodeID, Mode: &rootMode}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: fuseops.RootInodeID, Name: "user.root", Value: []byte("r")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "d"}); !errors.Is(err, fuse.ENOTEMPTY) {
+		t.Fatalf("rmdir of a full directory: %v", err)
+	}
+	mkdir(t, fs, "gone")
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err = fuse_util_disk.NewDiskFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	fs = newFS(t, files)
+
+	if got := getAttr(t, fs, "empty").Mode; got != os.ModeDir|0o700 {
+		t.Fatalf("mode of empty %v", got)
+	}
+	if _, err := lookup(t, fs, "gone"); !errors.Is(err, fuse.ENOENT) {
+		t.Fatalf("removed directory is back: %v", err)
+	}
+	if got := readFile(t, fs, "g"); got != "data" {
+		t.Fatalf("got %q", got)
+	}
+	if mustLookup(t, fs, "g") != mustLookup(t, fs, "d/f") || getAttr(t, fs, "g").Nlink != 2 {
+		t.Fatal("hard link lost")
+	}
+	read := &fuseops.ReadSymlinkOp{Inode: mustLookup(t, fs, "s")}
+	if err := fs.ReadSymlink(ctx, read); err != nil || read.Target != "d/f" {
+		t.Fatalf("target %q: %v", read.Target, err)
+	}
+	get := &fuseops.GetXattrOp{Inode: mustLookup(t, fs, "d"), Name: "user.k", Dst: make([]byte, 8)}
+	if err := fs.GetXattr(ctx, get); err != nil || string(get.Dst[:get.BytesRead]) != "v" {
+		t.Fatalf("got %q: %v", get.Dst[:get.BytesRead], err)
+	}
+	root := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fs.GetInodeAttributes(ctx, root); err != nil || root.Attributes.Mode != os.ModeDir|0o750 {
+		t.Fatalf("mode of the root %v: %v", root.Attributes.Mode, err)
+	}
+	get = &fuseops.GetXattrOp{Inode: fuseops.RootInodeID, Name: "user.root", Dst: make([]byte, 8)}
+	if err := fs.GetXattr(ctx, get); err != nil || string(get.Dst[:get.BytesRead]) != "r" {
+		t.Fatalf("got %q: %v", get.Dst[:get.BytesRead], err)
+	}
+}
+
+// TestRenameCut - the journal cut anywhere in a rename opens with the tree either before or after it
+func TestRenameCut(t *testing.T) {
+	dir := t.TempDir()
+	files, err := fuse_util_disk.NewDiskFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	fs := newFS(t, files)
+	mkdir(t, fs, "a")
+	mkdir(t, fs, "a/sub")
+	writeFile(t, fs, "a/sub/x", "x")
+	writeFile(t, fs, "a/y", "y")
+
+	path := filepath.Join(dir, "journal")
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(t, fs, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// at the start, in the middle and at the end of every line written by the rename
+	cuts := []int{int(before.Size())}
+	for start := int(before.Size()); start < len(journal); {
+		end := start + bytes.IndexByte(journal[start:], '\n') + 1
+		cuts = append(cuts, (start+end)/2, end)
+		start = end
+	}
+	old, moved := []string{"a/sub/x", "a/y"}, []string{"b/sub/x", "b/y"}
+	for _, cut := range cuts {
+		cutDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(cutDir, "journal"), journal[:cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cutFiles, err := fuse_util_disk.NewDiskFileStore(cutDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := storedPaths(t, cutFiles)
+		_ = cutFiles.Close()
+		want := old
+		if cut == len(journal) {
+			want = moved
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("journal cut at %d of %d: got %v, want %v", cut, len(journal), got, want)
+		}
+	}
+}
+
+// readDir - names in the directory at path
+func readDir(t *testing.T, fs fuseutil.FileSystem, path string) []string {
+	t.Helper()
+	op := &fuseops.ReadDirOp{Inode: mustLookup(t, fs, path), Dst: make([]byte, 4096)}
+	if err := fs.ReadDir(context.Background(), op); err != nil {
+		t.Fatalf("readdir %s: %v", path, err)
+	}
+	var names []string
+	for b := op.Dst[:op.BytesRead]; len(b) > 0; {
+		// struct fuse_dirent: ino, off, namelen, type, name padded to 8 bytes
+		namelen := int(b[16]) | int(b[17])<<8
+		names = append(names, string(b[24:24+namelen]))
+		b = b[(24+namelen+7)/8*8:]
+	}
+	return names
+}
+
+func TestSnapshot(t *testing.T) {
+	files := fuse_util_mem.NewMemFileStore()
+	fs, err := fuse_util.NewFuseFileSystem(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mkdir(t, fs, "d")
+	writeFile(t, fs, "d/a", "alpha")
+	writeFile(t, fs, "b", "beta")
+	if err := fs.CreateSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the live tree changes after the snapshot
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: mustLookup(t, fs, "d/a"), Data: []byte("ALPHA!"), Offset: 0}); err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(1)
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: mustLookup(t, fs, "b"), Size: &size}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(t, fs, "b", "d/c"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "e", "new")
+
+	// a second snapshot by mkdir in the snapshot directory
+	mkdir(t, fs, ".snapshots/s2")
+	unlink(t, fs, "d/a")
+
+	if got := readDir(t, fs, ""); !slices.Equal(got, []string{"d", "e"}) {
+		t.Fatalf("root %v", got)
+	}
+	if got := readDir(t, fs, ".snapshots"); !slices.Equal(got, []string{"s1", "s2"}) {
+		t.Fatalf("snapshots %v", got)
+	}
+	if got := readDir(t, fs, ".snapshots/s1"); !slices.Equal(got, []string{"b", "d"}) {
+		t.Fatalf("s1 %v", got)
+	}
+	if got := readFile(t, fs, ".snapshots/s1/d/a"); got != "alpha" {
+		t.Fatalf("s1 d/a %q", got)
+	}
+	if got := readFile(t, fs, ".snapshots/s1/b"); got != "beta" {
+		t.Fatalf("s1 b %q", got)
+	}
+	if _, err := lookup(t, fs, ".snapshots/s1/e"); !errors.Is(err, fuse.ENOENT) {
+		t.Fatalf("lookup s1 e: %v", err)
+	}
+	if got := readDir(t, fs, ".snapshots/s2/d"); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("s2 d %v", got)
+	}
+	if got := readFile(t, fs, ".snapshots/s2/d/a"); got != "ALPHA!" {
+		t.Fatalf("s2 d/a %q", got)
+	}
+	if got := readFile(t, fs, ".snapshots/s2/d/c"); got != "b" {
+		t.Fatalf("s2 d/c %q", got)
+	}
+	if got := getAttr(t, fs, ".snapshots/s1/b").Size; got != 4 {
+		t.Fatalf("s1 b size %d", got)
+	}
+	if mustLookup(t, fs, ".snapshots/s1/b") != mustLookup(t, fs, ".snapshots/s1/b") {
+		t.Fatal("inode changed between lookups")
+	}
+
+	// snapshots are read only
+	inode := mustLookup(t, fs, ".snapshots/s1/b")
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: inode, Data: []byte("x")}); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: inode, Size: &size}); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: mustLookup(t, fs, ".snapshots/s1"), Name: "x"}); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("create: %v", err)
+	}
+	if err := rename(t, fs, ".snapshots/s1/b", "b"); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("rename out: %v", err)
+	}
+	if err := fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: inode, Name: "user.k", Value: []byte("v")}); !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("setxattr: %v", err)
+	}
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: ".snapshots"}); !errors.Is(err, fuse.EEXIST) {
+		t.Fatalf("mkdir .snapshots: %v", err)
+	}
+
+	// list and delete
+	if err := fs.CreateSnapshot("s1"); !errors.Is(err, fuse_util.ErrSnapshotExists) {
+		t.Fatalf("create again: %v", err)
+	}
+	if err := fs.CreateSnapshot("a/b"); !errors.Is(err, fuse_util.ErrSnapshotName) {
+		t.Fatalf("create a/b: %v", err)
+	}
+	var names []string
+	for _, info := range fs.ListSnapshots() {
+		names = append(names, info.Name)
+	}
+	if !slices.Equal(names, []string{"s1", "s2"}) {
+		t.Fatalf("list %v", names)
+	}
+	if err := fs.DeleteSnapshot("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DeleteSnapshot("s1"); !errors.Is(err, fuse_util.ErrSnapshotNotFound) {
+		t.Fatalf("delete again: %v", err)
+	}
+	if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: mustLookup(t, fs, ".snapshots"), Name: "s2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.ListSnapshots(); len(got) != 0 {
+		t.Fatalf("list %v", got)
+	}
+	if got := readFile(t, fs, "d/c"); got != "b" {
+		t.Fatalf("d/c %q", got)
+	}
+}
+
+// TestSnapshotBlocks - a snapshot keeps only the blocks changed since, also once the file is deleted from the store
+func TestSnapshotBlocks(t *testing.T) {
+	files, err := fuse_util_disk.NewDiskFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	fs, err := fuse_util.NewFuseFileSystem(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	data := make([]byte, 200<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	writeFile(t, fs, "f", string(data))
+	if err := fs.CreateSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: mustLookup(t, fs, "f"), Data: []byte("changed"), Offset: 100 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(10)
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: mustLookup(t, fs, "f"), Size: &size}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() []byte {
+		op := &fuseops.ReadFileOp{Inode: mustLookup(t, fs, ".snapshots/s/f"), Offset: 1000, Dst: make([]byte, len(data))}
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		return op.Dst[:op.BytesRead]
+	}
+	if got := read(); !slices.Equal(got, data[1000:]) {
+		t.Fatalf("read %d bytes, not the data before the changes", len(got))
+	}
+	unlink(t, fs, "f")
+	if got := read(); !slices.Equal(got, data[1000:]) {
+		t.Fatalf("read %d bytes after delete, not the data before the changes", len(got))
+	}
+}
@@ -1,9 +1,12 @@
 package fuse_util
 
 import (
+	"slices"
 	"sync"
+	"syscall"
 
 	"github.com/fbundle/lab_public/lab/go_util/pkg/fuse_util/trie"
+	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 )
 
@@ -15,6 +18,7 @@ func newInodePool(rootNode node) *inodePool {
 			rootNode.inode: rootNode,
 		},
 		pathToNode: trie.New[string, node](rootNode),
+		tree:       tree{file: rootNode.file},
 	}
 }
 
@@ -26,6 +30,8 @@ func newNode(inode fuseops.InodeID, path []string, file File) node {
 	}
 }
 
+// node - an entry of the tree, the entries of hard links to a file share inode and file
+// path is where the entry is, a node looked up by inode has one of the paths of its file
 type node struct {
 	inode fuseops.InodeID
 	path  []string
@@ -37,13 +43,28 @@ func (n node) isDir() bool {
 	return mustAttr(n.file).IsDir
 }
 
+// unlinked - whether no entry is left for the file of n, files are unlinked from their attr first
+func (n node) unlinked() bool {
+	attr := mustAttr(n.file)
+	return attr.IsDir || len(attr.Paths) == 0
+}
+
 type inodePool struct {
 	mu          sync.RWMutex
 	inodeToNode map[fuseops.InodeID]node
 	pathToNode  *trie.Trie[string, node]
+	tree        tree // the same namespace, for snapshots
 	maxInode    fuseops.InodeID
 }
 
+// snapshot - the namespace as it is now, f runs before any other change to it
+func (p *inodePool) snapshot(f func(t tree)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	f(p.tree)
+}
+
 func (p *inodePool) list(prefix []string) func(yield func(name string, child node) bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -79,9 +100,38 @@ func (p *inodePool) createNode(path []string, file File) (n node, ok bool) {
 		return n, false
 	}
 	p.inodeToNode[p.maxInode] = n
+	p.tree = p.tree.set(path, tree{file: file})
+	return n, true
+}
+
+// linkNode - another entry for the inode of n at path
+func (p *inodePool) linkNode(path []string, n node) (node, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n.path = path
+	if _, ok := p.inodeToNode[n.inode]; !ok {
+		return n, false
+	}
+	if ok := p.pathToNode.Insert(path, n); !ok {
+		return n, false
+	}
+	p.tree = p.tree.set(path, tree{file: n.file})
 	return n, true
 }
 
+// forgetLocked - drop the inode of n once the entry at path is gone
+func (p *inodePool) forgetLocked(n node, path []string) {
+	if n.unlinked() {
+		delete(p.inodeToNode, n.inode)
+		return
+	}
+	if current, ok := p.inodeToNode[n.inode]; ok && slices.Equal(current.path, path) {
+		current.path = mustAttr(n.file).Paths[0]
+		p.inodeToNode[n.inode] = current
+	}
+}
+
 func (p *inodePool) deleteNodeIf(path []string, filters ...func(node) bool) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -99,6 +149,77 @@ func (p *inodePool) deleteNodeIf(path []string, filters ...func(node) bool) bool
 	if !ok {
 		return false
 	}
-	delete(p.inodeToNode, n.inode)
+	p.tree = p.tree.del(path)
+	p.forgetLocked(n, path)
 	return true
 }
+
+// moveNode - move the node at oldPath together with its subtree to newPath in one step
+// an existing node at newPath is replaced, update is called first with it (nil if there is none) and with
+// the nodes of the subtree at their new paths, the moved node first, and the pool is left as is if it fails
+func (p *inodePool) moveNode(oldPath []string, newPath []string, update func(replaced *node, moved []node) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	src, ok := p.pathToNode.Load(oldPath)
+	if !ok {
+		return fuse.ENOENT
+	}
+	parent, ok := p.pathToNode.Load(newPath[:len(newPath)-1])
+	if !ok {
+		return fuse.ENOENT
+	}
+	if !parent.isDir() {
+		return fuse.ENOTDIR
+	}
+	if slices.Equal(oldPath, newPath) {
+		return nil
+	}
+	if dst, ok := p.pathToNode.Load(newPath); ok && dst.inode == src.inode {
+		return nil // hard links to the same file
+	}
+	if len(newPath) > len(oldPath) && slices.Equal(oldPath, newPath[:len(oldPath)]) {
+		return fuse.EINVAL // a directory cannot be moved into itself
+	}
+
+	var replaced *node
+	if dst, ok := p.pathToNode.Load(newPath); ok {
+		switch {
+		case src.isDir() && !dst.isDir():
+			return fuse.ENOTDIR
+		case !src.isDir() && dst.isDir():
+			return syscall.EISDIR
+		case dst.isDir():
+			for range p.pathToNode.List(newPath) {
+				return fuse.ENOTEMPTY
+			}
+		}
+		replaced = &dst
+	}
+	var moved []node
+	for path, n := range p.pathToNode.Walk(slices.Clone(oldPath)) {
+		n.path = append(slices.Clone(newPath), path[len(oldPath):]...)
+		moved = append(moved, n)
+	}
+	if err := update(replaced, moved); err != nil {
+		return err
+	}
+
+	if replaced != nil {
+		if ok := p.pathToNode.Delete(newPath); !ok {
+			return fuse.ENOENT
+		}
+		p.tree = p.tree.del(newPath)
+		p.forgetLocked(*replaced, newPath)
+	}
+	if ok := p.pathToNode.Move(oldPath, newPath); !ok {
+		return fuse.ENOENT
+	}
+	subtree, _ := p.tree.get(oldPath)
+	p.tree = p.tree.del(oldPath).set(newPath, subtree)
+	for _, n := range moved {
+		p.pathToNode.Store(n.path, n)
+		p.inodeToNode[n.inode] = n
+	}
+	return nil
+}
@@ -1,22 +1,38 @@
 package fuse_util
 
 import (
+	"maps"
+	"os"
 	"slices"
 	"time"
 )
 
 type FileAttr struct {
-	ID    uint64
-	IsDir bool
+	ID        uint64
+	IsDir     bool
+	IsSymlink bool // the target is the data of the file
 
-	Path  []string
+	Paths [][]string // every hard link to the file, Nlink is their number
 	Mtime time.Time
 	Size  uint64
+
+	Mode   os.FileMode // permission bits, setuid, setgid and sticky - the type comes from IsDir
+	Uid    uint32
+	Gid    uint32
+	Atime  time.Time
+	Ctime  time.Time // last change of data or attributes
+	Crtime time.Time
+
+	Xattr map[string][]byte // values are replaced, never modified in place
 }
 
 func (a FileAttr) Clone() FileAttr {
 	newAttr := a
-	newAttr.Path = slices.Clone(a.Path)
+	newAttr.Paths = make([][]string, 0, len(a.Paths))
+	for _, path := range a.Paths {
+		newAttr.Paths = append(newAttr.Paths, slices.Clone(path))
+	}
+	newAttr.Xattr = maps.Clone(a.Xattr)
 	return newAttr
 }
 
@@ -36,9 +52,21 @@ type File interface {
 	FileUpdater
 }
 
-// FileStore - just a map[path]File - there is no hardlink or symlink
+// FileStore - just a map[id]File - a file is linked at every path in its Paths
 type FileStore interface {
 	Create() (file File, err error)
 	Delete(id uint64) (err error)
 	Iterate(yield func(file File) bool) (err error)
 }
+
+// Batcher - a FileStore that can make the changes of several files durable together, a crash keeps all of them or none
+type Batcher interface {
+	Batch(f func() error) error
+}
+
+// pathIndex - index of path in attr.Paths, -1 if it is not a link to the file
+func (a FileAttr) pathIndex(path []string) int {
+	return slices.IndexFunc(a.Paths, func(p []string) bool {
+		return slices.Equal(p, path)
+	})
+}
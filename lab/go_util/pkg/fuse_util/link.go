@@ -0,0 +1,117 @@
+package fuse_util
+
+import (
+	"context"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CreateSymlink - ln -s, the target is kept as the data of a file in the store
+func (m *memFS) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	node, err := m.createFile(op.Parent, op.Name, 0o777, op.OpContext, func(file File) error {
+		if _, err := file.Write(0, []byte(op.Target)); err != nil {
+			return err
+		}
+		return file.UpdateAttr(func(attr FileAttr) FileAttr {
+			attr.IsSymlink = true
+			return attr
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      node.inode,
+		Attributes: getInodeAttributes(mustAttr(node.file)),
+	}
+	return nil
+}
+
+// ReadSymlink - readlink
+func (m *memFS) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	if m.snapshots.owns(op.Inode) {
+		return m.readSnapshotSymlink(op)
+	}
+	node, ok := m.inodePool.getNodeFromInode(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+	attr := mustAttr(node.file)
+	if !attr.IsSymlink {
+		return fuse.EINVAL
+	}
+	target := make([]byte, attr.Size)
+	n, err := node.file.Read(0, target)
+	if err != nil {
+		return err
+	}
+	op.Target = string(target[:n])
+	return nil
+}
+
+// CreateLink - ln, directories cannot be hard linked
+func (m *memFS) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
+	if err := m.readOnly(op.Target, op.Parent); err != nil {
+		return err
+	}
+	if reserved(op.Parent, op.Name) {
+		return fuse.EEXIST
+	}
+	target, ok := m.inodePool.getNodeFromInode(op.Target)
+	if !ok {
+		return fuse.ENOENT
+	}
+	if target.isDir() {
+		return syscall.EPERM
+	}
+	parent, ok := m.inodePool.getNodeFromInode(op.Parent)
+	if !ok {
+		return fuse.ENOENT
+	}
+	path := append(slices.Clone(parent.path), op.Name)
+
+	if err := target.file.UpdateAttr(func(attr FileAttr) FileAttr {
+		attr.Paths = append(attr.Paths, path)
+		attr.Ctime = time.Now()
+		return attr
+	}); err != nil {
+		return err
+	}
+	node, ok := m.inodePool.linkNode(path, target)
+	if !ok {
+		_ = m.unlink(node)
+		return fuse.EEXIST
+	}
+	m.updateMtimeWithoutLock(path)
+
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      node.inode,
+		Attributes: getInodeAttributes(mustAttr(node.file)),
+	}
+	return nil
+}
+
+// unlink - remove the link at n.path from the file of n, the file leaves the store with its last link
+func (m *memFS) unlink(n node) error {
+	if err := n.file.UpdateAttr(func(attr FileAttr) FileAttr {
+		if i := attr.pathIndex(n.path); i >= 0 {
+			attr.Paths = slices.Delete(attr.Paths, i, i+1)
+		}
+		attr.Ctime = time.Now()
+		return attr
+	}); err != nil {
+		return err
+	}
+	if !n.unlinked() {
+		return nil
+	}
+	if err := retire(n.file); err != nil {
+		return err
+	}
+	return m.files.Delete(mustAttr(n.file).ID)
+}
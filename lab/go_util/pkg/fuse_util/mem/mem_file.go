@@ -25,8 +25,10 @@ func (f *memFile) lockWrite(m func()) {
 	defer f.mu.Unlock()
 	m()
 	// update attr
+	now := time.Now()
 	f.attr.Size = uint64(len(f.data))
-	f.attr.Mtime = time.Now()
+	f.attr.Mtime = now
+	f.attr.Ctime = now
 }
 
 func (f *memFile) Attr() (attr fuse_util.FileAttr, err error) {
@@ -36,24 +38,23 @@ func (f *memFile) Attr() (attr fuse_util.FileAttr, err error) {
 	return attr, nil
 }
 
-func (f *memFile) UpdateAttr(updater func(fuse_util.FileAttr) fuse_util.FileAttr) (err error) {
-	f.lockWrite(func() {
-		newAttr := updater(f.attr)
-		if f.attr.ID != newAttr.ID {
-			err = errors.New("id cannot be changed")
-			return
-		}
-		if newAttr.IsDir {
-			err = errors.New("cannot change to directory")
-			return
-		}
-		if f.attr.Size != newAttr.Size {
-			err = errors.New("size cannot be changed from attr")
-			return
-		}
+// UpdateAttr - data is not touched so Size and Mtime stay as they are unless updater changes Mtime
+func (f *memFile) UpdateAttr(updater func(fuse_util.FileAttr) fuse_util.FileAttr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-		f.attr = newAttr
-	})
+	newAttr := updater(f.attr.Clone())
+	if f.attr.ID != newAttr.ID {
+		return errors.New("id cannot be changed")
+	}
+	if newAttr.IsDir != f.attr.IsDir && len(f.data) > 0 {
+		return errors.New("only an empty file can change to or from directory")
+	}
+	if f.attr.Size != newAttr.Size {
+		return errors.New("size cannot be changed from attr")
+	}
+
+	f.attr = newAttr
 	return nil
 }
 
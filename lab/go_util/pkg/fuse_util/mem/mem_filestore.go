@@ -27,15 +27,20 @@ func (f *memFileStore) Create() (fuse_util.File, error) {
 	defer f.mu.Unlock()
 
 	f.lastId++
+	now := time.Now()
 	file := &memFile{
 		mu:   sync.RWMutex{},
 		data: nil,
 		attr: fuse_util.FileAttr{
-			ID:    f.lastId,
-			IsDir: false,
-			Path:  nil,
-			Mtime: time.Now(),
-			Size:  0,
+			ID:     f.lastId,
+			IsDir:  false,
+			Paths:  nil,
+			Mtime:  now,
+			Size:   0,
+			Mode:   0o644,
+			Atime:  now,
+			Ctime:  now,
+			Crtime: now,
 		},
 	}
 
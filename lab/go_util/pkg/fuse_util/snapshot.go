@@ -0,0 +1,399 @@
+package fuse_util
+
+import (
+	"cmp"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+var (
+	ErrSnapshotExists   = errors.New("snapshot exists")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotName     = errors.New("invalid snapshot name")
+)
+
+const (
+	snapshotDir = ".snapshots"
+	// inodes of snapshot entries are numbered from here, far from those of the live tree
+	snapshotInodeBase fuseops.InodeID = 1 << 63
+)
+
+type SnapshotInfo struct {
+	Name      string
+	CreatedAt time.Time
+}
+
+// snapshot - the namespace at the end of epoch, files give the state they had then
+type snapshot struct {
+	name      string
+	epoch     uint64
+	createdAt time.Time
+	root      tree
+}
+
+// snapshotKey - a snapshot entry is its file, hard links in a snapshot share an inode too
+type snapshotKey struct {
+	name string
+	id   uint64
+}
+
+type snapshotEntry struct {
+	snap *snapshot
+	node tree
+}
+
+// snapshots - taking one ends the current epoch, files keep a version for every epoch a snapshot sees
+type snapshots struct {
+	mu      sync.RWMutex
+	epoch   uint64
+	byName  map[string]*snapshot
+	entries map[fuseops.InodeID]snapshotEntry
+	inodes  map[snapshotKey]fuseops.InodeID
+	last    fuseops.InodeID
+}
+
+func newSnapshots() *snapshots {
+	return &snapshots{
+		byName:  make(map[string]*snapshot),
+		entries: make(map[fuseops.InodeID]snapshotEntry),
+		inodes:  make(map[snapshotKey]fuseops.InodeID),
+		last:    snapshotInodeBase, // the snapshot directory
+	}
+}
+
+func (s *snapshots) current() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.epoch
+}
+
+// live - whether a snapshot was taken in an epoch within [from, upto]
+func (s *snapshots) live(from uint64, upto uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, snap := range s.byName {
+		if from <= snap.epoch && snap.epoch <= upto {
+			return true
+		}
+	}
+	return false
+}
+
+// owns - whether inode is the snapshot directory or in it
+func (s *snapshots) owns(inode fuseops.InodeID) bool {
+	return inode >= snapshotInodeBase
+}
+
+func (s *snapshots) get(inode fuseops.InodeID) (snapshotEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[inode]
+	return e, ok
+}
+
+// inodeOf - the inode of node in snap, the same every time it is looked up
+func (s *snapshots) inodeOf(snap *snapshot, node tree) fuseops.InodeID {
+	key := snapshotKey{name: snap.name, id: mustAttr(node.file).ID}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inode, ok := s.inodes[key]; ok {
+		return inode
+	}
+	s.last++
+	s.inodes[key] = s.last
+	s.entries[s.last] = snapshotEntry{snap: snap, node: node}
+	return s.last
+}
+
+func (s *snapshots) byNameSorted() []*snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(s.byName), func(a *snapshot, b *snapshot) int {
+		return cmp.Compare(a.epoch, b.epoch)
+	})
+}
+
+func (s *snapshots) lookUp(name string) (*snapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap, ok := s.byName[name]
+	return snap, ok
+}
+
+// CreateSnapshot - nothing is copied, files keep what the snapshot sees of them as they change
+func (m *memFS) CreateSnapshot(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return ErrSnapshotName
+	}
+	var err error
+	m.inodePool.snapshot(func(t tree) {
+		m.snapshots.mu.Lock()
+		defer m.snapshots.mu.Unlock()
+		if _, ok := m.snapshots.byName[name]; ok {
+			err = ErrSnapshotExists
+			return
+		}
+		m.snapshots.byName[name] = &snapshot{
+			name:      name,
+			epoch:     m.snapshots.epoch,
+			createdAt: time.Now(),
+			root:      t,
+		}
+		m.snapshots.epoch++
+	})
+	return err
+}
+
+func (m *memFS) ListSnapshots() []SnapshotInfo {
+	var infos []SnapshotInfo
+	for _, snap := range m.snapshots.byNameSorted() {
+		infos = append(infos, SnapshotInfo{Name: snap.name, CreatedAt: snap.createdAt})
+	}
+	return infos
+}
+
+// DeleteSnapshot - files drop the versions only it saw as they change
+func (m *memFS) DeleteSnapshot(name string) error {
+	s := m.snapshots
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap, ok := s.byName[name]
+	if !ok {
+		return ErrSnapshotNotFound
+	}
+	delete(s.byName, name)
+	for key, inode := range s.inodes {
+		if key.name == snap.name {
+			delete(s.inodes, key)
+			delete(s.entries, inode)
+		}
+	}
+	return nil
+}
+
+// readOnly - EROFS if any of inodes is in the snapshot directory
+func (m *memFS) readOnly(inodes ...fuseops.InodeID) error {
+	for _, inode := range inodes {
+		if m.snapshots.owns(inode) {
+			return syscall.EROFS
+		}
+	}
+	return nil
+}
+
+// reserved - the snapshot directory hides whatever is at its name in the root
+func reserved(parent fuseops.InodeID, name string) bool {
+	return parent == fuseops.RootInodeID && name == snapshotDir
+}
+
+// snapshotDirAttributes - the directory of snapshots looks like the root, read only
+func (m *memFS) snapshotDirAttributes() fuseops.InodeAttributes {
+	root, _ := m.inodePool.getNodeFromInode(fuseops.RootInodeID)
+	attr := mustAttr(root.file)
+	attr.Mode = 0o555
+	return getInodeAttributes(attr)
+}
+
+// snapshotAttributes - attributes of an entry in a snapshot
+func (m *memFS) snapshotAttributes(e snapshotEntry) (fuseops.InodeAttributes, error) {
+	attr, ok := e.node.file.(*cowFile).attrAt(e.snap.epoch)
+	if !ok {
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+	return getInodeAttributes(attr), nil
+}
+
+// lookUpSnapshot - child of the snapshot directory or of a directory in a snapshot
+func (m *memFS) lookUpSnapshot(op *fuseops.LookUpInodeOp) error {
+	var e snapshotEntry
+	if op.Parent == snapshotInodeBase {
+		snap, ok := m.snapshots.lookUp(op.Name)
+		if !ok {
+			return fuse.ENOENT
+		}
+		e = snapshotEntry{snap: snap, node: snap.root}
+	} else {
+		parent, ok := m.snapshots.get(op.Parent)
+		if !ok {
+			return fuse.ENOENT
+		}
+		child, ok := parent.node.children.Get(op.Name)
+		if !ok {
+			return fuse.ENOENT
+		}
+		e = snapshotEntry{snap: parent.snap, node: child}
+	}
+	attributes, err := m.snapshotAttributes(e)
+	if err != nil {
+		return err
+	}
+	op.Entry.Child = m.snapshots.inodeOf(e.snap, e.node)
+	op.Entry.Attributes = attributes
+	return nil
+}
+
+func (m *memFS) getSnapshotAttributes(op *fuseops.GetInodeAttributesOp) (err error) {
+	if op.Inode == snapshotInodeBase {
+		op.Attributes = m.snapshotDirAttributes()
+		return nil
+	}
+	e, ok := m.snapshots.get(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+	op.Attributes, err = m.snapshotAttributes(e)
+	return err
+}
+
+func (m *memFS) readSnapshotDir(op *fuseops.ReadDirOp) error {
+	var entries []fuseutil.Dirent
+	add := func(name string, inode fuseops.InodeID, attr FileAttr) {
+		dtype := fuseutil.DT_File
+		switch {
+		case attr.IsDir:
+			dtype = fuseutil.DT_Directory
+		case attr.IsSymlink:
+			dtype = fuseutil.DT_Link
+		}
+		entries = append(entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(entries) + 1),
+			Inode:  inode,
+			Name:   name,
+			Type:   dtype,
+		})
+	}
+
+	if op.Inode == snapshotInodeBase {
+		for _, snap := range m.snapshots.byNameSorted() {
+			add(snap.name, m.snapshots.inodeOf(snap, snap.root), FileAttr{IsDir: true})
+		}
+	} else {
+		e, ok := m.snapshots.get(op.Inode)
+		if !ok {
+			return fuse.ENOENT
+		}
+		var err error
+		e.node.children.Iter(func(name string, child tree) bool {
+			attr, ok := child.file.(*cowFile).attrAt(e.snap.epoch)
+			if !ok {
+				err = fuse.EIO
+				return false
+			}
+			add(name, m.snapshots.inodeOf(e.snap, child), attr)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return nil
+	}
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+	return nil
+}
+
+// snapshotFile - the file of inode in a snapshot and the epoch it is seen at
+func (m *memFS) snapshotFile(inode fuseops.InodeID) (*cowFile, uint64, error) {
+	e, ok := m.snapshots.get(inode)
+	if !ok {
+		return nil, 0, fuse.ENOENT
+	}
+	return e.node.file.(*cowFile), e.snap.epoch, nil
+}
+
+func (m *memFS) readSnapshotFile(op *fuseops.ReadFileOp) (err error) {
+	file, epoch, err := m.snapshotFile(op.Inode)
+	if err != nil {
+		return err
+	}
+	if attr, ok := file.attrAt(epoch); !ok || attr.IsDir {
+		return fuse.ENOENT
+	}
+	op.BytesRead, err = file.readAt(epoch, uint64(op.Offset), op.Dst)
+	return err
+}
+
+func (m *memFS) readSnapshotSymlink(op *fuseops.ReadSymlinkOp) error {
+	file, epoch, err := m.snapshotFile(op.Inode)
+	if err != nil {
+		return err
+	}
+	attr, ok := file.attrAt(epoch)
+	if !ok {
+		return fuse.ENOENT
+	}
+	if !attr.IsSymlink {
+		return fuse.EINVAL
+	}
+	target := make([]byte, attr.Size)
+	n, err := file.readAt(epoch, 0, target)
+	op.Target = string(target[:n])
+	return err
+}
+
+// snapshotXattr - extended attributes of inode in a snapshot, none for the snapshot directory
+func (m *memFS) snapshotXattr(inode fuseops.InodeID) (map[string][]byte, error) {
+	if inode == snapshotInodeBase {
+		return nil, nil
+	}
+	file, epoch, err := m.snapshotFile(inode)
+	if err != nil {
+		return nil, err
+	}
+	attr, ok := file.attrAt(epoch)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return attr.Xattr, nil
+}
+
+// mkSnapshot - mkdir in the snapshot directory takes a snapshot
+func (m *memFS) mkSnapshot(op *fuseops.MkDirOp) error {
+	if err := m.CreateSnapshot(op.Name); err != nil {
+		switch {
+		case errors.Is(err, ErrSnapshotExists):
+			return fuse.EEXIST
+		default:
+			return fuse.EINVAL
+		}
+	}
+	lookUp := &fuseops.LookUpInodeOp{Parent: snapshotInodeBase, Name: op.Name}
+	if err := m.lookUpSnapshot(lookUp); err != nil {
+		return err
+	}
+	op.Entry = lookUp.Entry
+	return nil
+}
+
+// rmSnapshot - rmdir in the snapshot directory deletes a snapshot
+func (m *memFS) rmSnapshot(op *fuseops.RmDirOp) error {
+	if err := m.DeleteSnapshot(op.Name); err != nil {
+		return fuse.ENOENT
+	}
+	return nil
+}
+
+// retire - f is leaving the store, snapshots that see it take its data first
+func retire(f File) error {
+	if c, ok := f.(*cowFile); ok {
+		return c.retire()
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package fuse_util
+
+import (
+	"github.com/fbundle/lab_public/lab/go_util/pkg/persistent/ordered_map"
+)
+
+// tree - persistent copy of the namespace, a change makes a new tree sharing everything off its path
+// so a snapshot of the namespace is just the tree at that time
+type tree struct {
+	file     File
+	children ordered_map.OrderedMap[string, tree]
+}
+
+func (t tree) get(path []string) (tree, bool) {
+	if len(path) == 0 {
+		return t, true
+	}
+	child, ok := t.children.Get(path[0])
+	if !ok {
+		return tree{}, false
+	}
+	return child.get(path[1:])
+}
+
+// set - v with its subtree at path, the parents of path must be there
+func (t tree) set(path []string, v tree) tree {
+	if len(path) == 0 {
+		return v
+	}
+	child, _ := t.children.Get(path[0])
+	t.children = t.children.Set(path[0], child.set(path[1:], v))
+	return t
+}
+
+func (t tree) del(path []string) tree {
+	if len(path) == 1 {
+		t.children = t.children.Del(path[0])
+		return t
+	}
+	child, ok := t.children.Get(path[0])
+	if !ok {
+		return t
+	}
+	t.children = t.children.Set(path[0], child.del(path[1:]))
+	return t
+}
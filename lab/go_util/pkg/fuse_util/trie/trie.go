@@ -101,6 +101,25 @@ func (t *Trie[E, T]) Delete(path []E) (ok bool) {
 	return true
 }
 
+// Move - move the node at from together with its subtree to to, replacing the node at to if there is one
+func (t *Trie[E, T]) Move(from []E, to []E) (ok bool) {
+	fromParentPath, fromName := from[:len(from)-1], from[len(from)-1]
+	toParentPath, toName := to[:len(to)-1], to[len(to)-1]
+
+	fromParent := t.resolve(fromParentPath)
+	toParent := t.resolve(toParentPath)
+	if fromParent == nil || toParent == nil {
+		return false
+	}
+	node, ok := fromParent.children[fromName]
+	if !ok {
+		return false
+	}
+	delete(fromParent.children, fromName)
+	toParent.children[toName] = node
+	return true
+}
+
 // List - yield all childrens of a path
 func (t *Trie[E, T]) List(prefix []E) func(yield func(name E, value T) bool) {
 	root := t.resolve(prefix)
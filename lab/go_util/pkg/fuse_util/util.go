@@ -11,8 +11,8 @@ import (
 )
 
 const (
-	defaultFileMode = 0o666
-	defaultDirMode  = os.ModeDir | 0o777
+	defaultDirMode = 0o777
+	modeMask       = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
 )
 
 func (m *memFS) updateAllMtimeWithoutLock() {
@@ -23,6 +23,18 @@ func (m *memFS) updateMtimeWithoutLock(path []string) {
 	m.inodePool.pathToNode.ReducePartial(path, mtimeReducer)
 }
 
+// updateMtimeOfLinksWithoutLock - the directories of every hard link to n see its change
+func (m *memFS) updateMtimeOfLinksWithoutLock(n node) {
+	attr := mustAttr(n.file)
+	if attr.IsDir {
+		m.updateMtimeWithoutLock(n.path)
+		return
+	}
+	for _, path := range attr.Paths {
+		m.updateMtimeWithoutLock(path)
+	}
+}
+
 func getField[T any](o any, name string) (t T, err error) {
 	v := reflect.ValueOf(o)
 	// If it's a pointer, dereference it
@@ -54,21 +66,37 @@ func getPathWithParent(m *memFS, op any) ([]string, error) {
 }
 
 func getInodeAttributes(a FileAttr) fuseops.InodeAttributes {
-	var mode os.FileMode
-	if a.IsDir {
-		mode = defaultDirMode
-	} else {
-		mode = defaultFileMode
+	mode := a.Mode & modeMask
+	nlink := uint32(len(a.Paths))
+	switch {
+	case a.IsDir:
+		mode |= os.ModeDir
+		nlink = 1 // not counted, as on btrfs
+	case a.IsSymlink:
+		mode |= os.ModeSymlink
 	}
 
 	return fuseops.InodeAttributes{
-		Size:  a.Size,
-		Nlink: 1,
-		Mode:  mode,
-		Mtime: a.Mtime,
+		Size:   a.Size,
+		Nlink:  nlink,
+		Mode:   mode,
+		Atime:  a.Atime,
+		Mtime:  a.Mtime,
+		Ctime:  a.Ctime,
+		Crtime: a.Crtime,
+		Uid:    a.Uid,
+		Gid:    a.Gid,
 	}
 }
 
+// ownAttr - attributes of a new child of parent with mode, owned by the caller of op and the group of parent
+func ownAttr(attr FileAttr, mode os.FileMode, opCtx fuseops.OpContext, parent node) FileAttr {
+	attr.Mode = mode & modeMask
+	attr.Uid = opCtx.Uid
+	attr.Gid = mustAttr(parent.file).Gid
+	return attr
+}
+
 func mtimeReducer(parent node, child node) (newParent node) {
 	parentMtime := mustAttr(parent.file).Mtime
 	childMtime := mustAttr(child.file).Mtime
@@ -92,3 +120,13 @@ func mustAttr(file File) FileAttr {
 	}
 	return meta
 }
+
+// depth - length of the shortest path of a file, 0 if it has none
+func depth(attr FileAttr) int {
+	if len(attr.Paths) == 0 {
+		return 0
+	}
+	return len(slices.MinFunc(attr.Paths, func(a []string, b []string) int {
+		return len(a) - len(b)
+	}))
+}
@@ -0,0 +1,120 @@
+package fuse_util
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// flags of setxattr(2)
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// copyXattr - an empty dst asks for the size only
+func copyXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+	return copy(dst, value), nil
+}
+
+func (m *memFS) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	xattr, err := m.xattr(op.Inode)
+	if err != nil {
+		return err
+	}
+	value, ok := xattr[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = copyXattr(op.Dst, value)
+	return err
+}
+
+// ListXattr - names separated by NUL
+func (m *memFS) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	xattr, err := m.xattr(op.Inode)
+	if err != nil {
+		return err
+	}
+	var names []byte
+	for _, name := range slices.Sorted(maps.Keys(xattr)) {
+		names = append(names, name...)
+		names = append(names, 0)
+	}
+	op.BytesRead, err = copyXattr(op.Dst, names)
+	return err
+}
+
+func (m *memFS) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return m.updateXattr(op.Inode, func(xattr map[string][]byte) error {
+		_, exists := xattr[op.Name]
+		switch {
+		case op.Flags&xattrCreate != 0 && exists:
+			return fuse.EEXIST
+		case op.Flags&xattrReplace != 0 && !exists:
+			return fuse.ENOATTR
+		}
+		xattr[op.Name] = slices.Clone(op.Value)
+		return nil
+	})
+}
+
+func (m *memFS) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return m.updateXattr(op.Inode, func(xattr map[string][]byte) error {
+		if _, ok := xattr[op.Name]; !ok {
+			return fuse.ENOATTR
+		}
+		delete(xattr, op.Name)
+		return nil
+	})
+}
+
+// xattr - extended attributes of inode, live or in a snapshot
+func (m *memFS) xattr(inode fuseops.InodeID) (map[string][]byte, error) {
+	if m.snapshots.owns(inode) {
+		return m.snapshotXattr(inode)
+	}
+	node, ok := m.inodePool.getNodeFromInode(inode)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return mustAttr(node.file).Xattr, nil
+}
+
+// updateXattr - apply update to a copy of the extended attributes of inode, nothing changes if it fails
+func (m *memFS) updateXattr(inode fuseops.InodeID, update func(xattr map[string][]byte) error) error {
+	if err := m.readOnly(inode); err != nil {
+		return err
+	}
+	node, ok := m.inodePool.getNodeFromInode(inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+	var updateErr error
+	if err := node.file.UpdateAttr(func(attr FileAttr) FileAttr {
+		xattr := maps.Clone(attr.Xattr)
+		if xattr == nil {
+			xattr = make(map[string][]byte)
+		}
+		if updateErr = update(xattr); updateErr != nil {
+			return attr
+		}
+		attr.Xattr = xattr
+		attr.Ctime = time.Now()
+		return attr
+	}); err != nil {
+		return err
+	}
+	return updateErr
+}
@@ -15,6 +15,7 @@ type LineSlice[T any] interface {
 	Close() error
 	Get(i int) (T, error)
 	Push(v T) error
+	Len() int
 }
 
 type lineSlice[T any] struct {
@@ -67,6 +68,10 @@ func (l *lineSlice[T]) Push(v T) error {
 	return nil
 }
 
+func (l *lineSlice[T]) Len() int {
+	return len(l.index)
+}
+
 func (l *lineSlice[T]) Close() error {
 	return l.file.Close()
 }
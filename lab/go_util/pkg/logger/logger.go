@@ -32,10 +32,10 @@ func NewLogger(info func(string), err func(string)) Logger {
 func NewDefaultLogger() Logger {
 	return &logger{
 		info: func(msg string) {
-			_, _ = fmt.Fprintf(os.Stdout, msg)
+			_, _ = fmt.Fprint(os.Stdout, msg)
 		},
 		err: func(msg string) {
-			_, _ = fmt.Fprintf(os.Stderr, msg)
+			_, _ = fmt.Fprint(os.Stderr, msg)
 		},
 	}
 }
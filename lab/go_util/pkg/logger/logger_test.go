@@ -17,11 +17,11 @@ func TestLogger(t *testing.T) {
 	b := bytes.NewBuffer(make([]byte, 0))
 	info := func(msg string) {
 		b.Write([]byte(msg))
-		_, _ = fmt.Fprintf(os.Stdout, msg)
+		_, _ = fmt.Fprint(os.Stdout, msg)
 	}
 	err := func(msg string) {
 		b.Write([]byte(msg))
-		_, _ = fmt.Fprintf(os.Stderr, msg)
+		_, _ = fmt.Fprint(os.Stderr, msg)
 	}
 	l = logger.NewLogger(info, err)
 	l.Now().Info("hello")
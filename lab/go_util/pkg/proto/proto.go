@@ -1,48 +1,141 @@
 package proto
 
 import (
-	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/codec"
+)
+
+var (
+	ErrNotRegistered = errors.New("type was not registered")
+	ErrUnknownType   = errors.New("unknown type")
+	ErrNoUpgrade     = errors.New("no upgrade")
 )
 
-type message struct {
-	Type    Type        `json:"type"`
-	Payload interface{} `json:"payload"`
+type header struct {
+	XMLName xml.Name `json:"-" yaml:"-" xml:"message"`
+	Type    Type     `json:"type" yaml:"type" xml:"type"`
+	Version int      `json:"version,omitempty" yaml:"version,omitempty" xml:"version,omitempty"`
 }
 
 type Type string
 
+// Proto - MustRegister registers version 0 of a type, Marshal writes the latest version of a type
+// and Unmarshal upgrades older versions to it one version after another
 type Proto interface {
 	MustRegister(mType Type, mPayload interface{})
+	MustRegisterVersion(mType Type, version int, mPayload interface{})
+	MustRegisterUpgrade(mType Type, from int, upgrade interface{})
 	Marshal(m interface{}) (b []byte, err error)
 	Unmarshal(b []byte) (m interface{}, err error)
+	Schema() Schema
 	NewEncoder(w io.Writer) Encoder
 	NewDecoder(r io.Reader) Decoder
 }
 
+// Config - Codec encodes messages, Framing separates them in a stream
+type Config struct {
+	Codec        codec.Codec
+	Framing      Framing
+	MaxFrameSize int
+}
+
+// DefaultConfig - newline delimited json
+func DefaultConfig() Config {
+	return Config{
+		Codec:        codec.NewJsonCodec(),
+		Framing:      NewlineFraming,
+		MaxFrameSize: DEFAULT_MAX_FRAME_SIZE,
+	}
+}
+
 func NewProto() Proto {
+	return NewProtoWithConfig(DefaultConfig())
+}
+
+func NewProtoWithConfig(config Config) Proto {
 	return &proto{
+		config:   config,
 		protoMap: make(map[Type]interface{}),
+		versions: make(map[Type][]*version),
 	}
 }
 
+// version - payload of a version of a type and the upgrade to the next version
+type version struct {
+	version int
+	payload reflect.Type
+	upgrade reflect.Value // func(*ThisVersion) *NextVersion, invalid if not registered
+}
+
 type proto struct {
-	protoMap map[Type]interface{}
+	config   Config
+	protoMap map[Type]interface{} // latest version of every type
+	versions map[Type][]*version  // sorted by version
+}
+
+// envelopeOf - pointer to a struct holding the header and a payload of payloadType, so that any codec can read it
+func envelopeOf(payloadType reflect.Type) reflect.Value {
+	envelopeType := reflect.StructOf([]reflect.StructField{
+		{Name: "XMLName", Type: reflect.TypeOf(xml.Name{}), Tag: `json:"-" yaml:"-" xml:"message"`},
+		{Name: "Type", Type: reflect.TypeOf(Type("")), Tag: `json:"type" yaml:"type" xml:"type"`},
+		{Name: "Version", Type: reflect.TypeOf(0), Tag: `json:"version,omitempty" yaml:"version,omitempty" xml:"version,omitempty"`},
+		{Name: "Payload", Type: payloadType, Tag: `json:"payload" yaml:"payload" xml:"payload"`},
+	})
+	return reflect.New(envelopeType)
 }
 
 func (p *proto) MustRegister(mType Type, mPayload interface{}) {
+	p.MustRegisterVersion(mType, 0, mPayload)
+}
+
+// MustRegisterVersion - the payload of every version of a type must be a different struct
+func (p *proto) MustRegisterVersion(mType Type, v int, mPayload interface{}) {
 	if err := mustBePtrOfStruct(mPayload); err != nil {
 		panic(err)
 	}
-	if ptr, ok := p.protoMap[mType]; ok {
-		if reflect.TypeOf(mPayload) != reflect.TypeOf(ptr) {
+	payloadType := reflect.TypeOf(mPayload)
+	for _, registered := range p.versions[mType] {
+		if registered.version == v && registered.payload == payloadType {
+			return
+		}
+		if registered.version == v || registered.payload == payloadType {
 			panic(fmt.Errorf("type exists %s", mType))
 		}
-	} else {
-		p.protoMap[mType] = mPayload
 	}
+	versions := append(p.versions[mType], &version{version: v, payload: payloadType})
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version < versions[j].version
+	})
+	p.versions[mType] = versions
+	p.protoMap[mType] = reflect.New(versions[len(versions)-1].payload.Elem()).Interface()
+}
+
+// MustRegisterUpgrade - upgrade is func(*PayloadOfFrom) *PayloadOfNextVersion, versions must be registered before
+func (p *proto) MustRegisterUpgrade(mType Type, from int, upgrade interface{}) {
+	versions := p.versions[mType]
+	for i, registered := range versions {
+		if registered.version != from {
+			continue
+		}
+		if i+1 == len(versions) {
+			panic(fmt.Errorf("no version of %s after %d", mType, from))
+		}
+		upgradeValue := reflect.ValueOf(upgrade)
+		upgradeType := upgradeValue.Type()
+		if upgradeType.Kind() != reflect.Func || upgradeType.NumIn() != 1 || upgradeType.NumOut() != 1 ||
+			upgradeType.In(0) != registered.payload || upgradeType.Out(0) != versions[i+1].payload {
+			panic(fmt.Errorf("upgrade of %s from %d must be of form func(%s) %s", mType, from, registered.payload, versions[i+1].payload))
+		}
+		registered.upgrade = upgradeValue
+		return
+	}
+	panic(fmt.Errorf("%w %s version %d", ErrUnknownType, mType, from))
 }
 
 func (p *proto) Marshal(payload interface{}) (b []byte, err error) {
@@ -51,33 +144,44 @@ func (p *proto) Marshal(payload interface{}) (b []byte, err error) {
 	}
 	for mType, mPayload := range p.protoMap {
 		if reflect.TypeOf(mPayload) == reflect.TypeOf(payload) {
-			m := &message{
-				Type:    mType,
-				Payload: payload,
-			}
-			return json.Marshal(m)
+			versions := p.versions[mType]
+			m := envelopeOf(reflect.TypeOf(payload)).Elem()
+			m.FieldByName("Type").Set(reflect.ValueOf(mType))
+			m.FieldByName("Version").SetInt(int64(versions[len(versions)-1].version))
+			m.FieldByName("Payload").Set(reflect.ValueOf(payload))
+			return p.config.Codec.Marshal(m.Addr().Interface())
 		}
 	}
-	return nil, fmt.Errorf("type was not registered")
+	return nil, ErrNotRegistered
 }
 
 func (p *proto) Unmarshal(b []byte) (payload interface{}, err error) {
-	h := &message{
-		Type: "",
-	}
-	err = json.Unmarshal(b, h)
+	h := &header{}
+	err = p.config.Codec.Unmarshal(b, h)
 	if err != nil {
 		return nil, err
 	}
-	if _, ok := p.protoMap[h.Type]; !ok {
-		return nil, fmt.Errorf("unknown type %s\n", string(b))
-	}
-	m := &message{
-		Payload: reflect.New(reflect.TypeOf(p.protoMap[h.Type]).Elem()).Interface(),
+	versions := p.versions[h.Type]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].version >= h.Version
+	})
+	if i == len(versions) || versions[i].version != h.Version {
+		return nil, fmt.Errorf("%w %s version %d", ErrUnknownType, h.Type, h.Version)
 	}
-	err = json.Unmarshal(b, m)
+	m := envelopeOf(versions[i].payload).Elem()
+	err = p.config.Codec.Unmarshal(b, m.Addr().Interface())
 	if err != nil {
 		return nil, err
 	}
-	return m.Payload, nil
+	payloadValue := m.FieldByName("Payload")
+	if payloadValue.IsNil() {
+		payloadValue.Set(reflect.New(payloadValue.Type().Elem())) // no payload
+	}
+	for ; i+1 < len(versions); i++ {
+		if !versions[i].upgrade.IsValid() {
+			return nil, fmt.Errorf("%w of %s from version %d", ErrNoUpgrade, h.Type, versions[i].version)
+		}
+		payloadValue = versions[i].upgrade.Call([]reflect.Value{payloadValue})[0]
+	}
+	return payloadValue.Interface(), nil
 }
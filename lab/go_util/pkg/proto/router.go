@@ -0,0 +1,127 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/dispatcher"
+)
+
+// Router - call the handler registered with Handle for the type of every message of a decoder
+type Router interface {
+	Serve(ctx context.Context, dec Decoder) error
+	handle(t reflect.Type, h func(ctx context.Context, m interface{}) error) error
+}
+
+// RouterConfig - Dispatcher runs handlers, nil runs them one after another in the order of the stream
+// a handler the dispatcher rejects runs right away in the serve loop, which slows down reading
+// OnUnknown gets messages without a handler, or a nil message with the error of a type the proto does not know
+// OnError gets the errors returned by handlers, both may be called concurrently through the dispatcher
+// Proto is the proto of the decoders, if set Handle rejects types it never decodes to
+type RouterConfig struct {
+	Dispatcher dispatcher.Dispatcher
+	OnUnknown  func(m interface{}, err error)
+	OnError    func(m interface{}, err error)
+	Proto      Proto
+}
+
+func DefaultRouterConfig() RouterConfig {
+	return RouterConfig{
+		Dispatcher: nil,
+		OnUnknown:  func(m interface{}, err error) {},
+		OnError:    func(m interface{}, err error) {},
+		Proto:      nil,
+	}
+}
+
+func NewRouter(config RouterConfig) Router {
+	return &router{
+		config:   config,
+		handlers: make(map[reflect.Type]func(ctx context.Context, m interface{}) error),
+	}
+}
+
+type router struct {
+	config   RouterConfig
+	mu       sync.Mutex
+	handlers map[reflect.Type]func(ctx context.Context, m interface{}) error // by pointer type
+}
+
+// Handle - register h for messages of type *T, replacing the previous handler
+// an error if T is not a struct, ErrNotRegistered if *T is not the latest version of a type of the proto of r
+func Handle[T any](r Router, h func(ctx context.Context, m *T) error) error {
+	return r.handle(reflect.TypeOf((*T)(nil)), func(ctx context.Context, m interface{}) error {
+		return h(ctx, m.(*T))
+	})
+}
+
+func (r *router) handle(t reflect.Type, h func(ctx context.Context, m interface{}) error) error {
+	// payloads are always pointers to struct, the proto panics on anything else
+	if err := mustBePtrOfStruct(reflect.New(t.Elem()).Interface()); err != nil {
+		return fmt.Errorf("%s: %w", t, err)
+	}
+	if r.config.Proto != nil {
+		// only the latest version of a type is written, and decoded to
+		if _, err := r.config.Proto.Marshal(reflect.New(t.Elem()).Interface()); errors.Is(err, ErrNotRegistered) {
+			return fmt.Errorf("%w: %s", ErrNotRegistered, t)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[t] = h
+	return nil
+}
+
+func (r *router) handlerOf(m interface{}) (func(ctx context.Context, m interface{}) error, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.handlers[reflect.TypeOf(m)]
+	return h, ok
+}
+
+// Serve - route messages until dec returns io.EOF, another error, or ctx is done
+// a blocked Decode is not interrupted by ctx, handlers still running are waited for
+func (r *router) Serve(ctx context.Context, dec Decoder) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for ctx.Err() == nil {
+		m, err := dec.Decode()
+		if errors.Is(err, ErrUnknownType) {
+			r.config.OnUnknown(nil, err)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		h, ok := r.handlerOf(m)
+		if !ok {
+			r.config.OnUnknown(m, nil)
+			continue
+		}
+		task := func() {
+			if err := h(ctx, m); err != nil {
+				r.config.OnError(m, err)
+			}
+		}
+		if r.config.Dispatcher == nil {
+			task()
+			continue
+		}
+		wg.Add(1)
+		if !r.config.Dispatcher.Dispatch(func() {
+			defer wg.Done()
+			task()
+		}) {
+			task()
+			wg.Done()
+		}
+	}
+	return ctx.Err()
+}
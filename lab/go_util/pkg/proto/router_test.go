@@ -0,0 +1,131 @@
+package proto_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/dispatcher"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/proto"
+)
+
+type ping struct {
+	N int `json:"n"`
+}
+
+type pong struct {
+	N int `json:"n"`
+}
+
+func TestRouter(t *testing.T) {
+	p := proto.NewProto()
+	p.MustRegister("ping", &ping{})
+	p.MustRegister("pong", &pong{})
+	p.MustRegister("message", &Message{})
+	b := &bytes.Buffer{}
+	e := p.NewEncoder(b)
+	for i := 0; i < 5; i++ {
+		_ = e.Encode(&ping{N: i})
+	}
+	_ = e.Encode(&pong{N: -1})
+	_ = e.Encode(&Message{Data: "no handler"})
+	b.WriteString(`{"type":"unknown","payload":{}}` + "\n")
+
+	var mu sync.Mutex
+	var pings []int
+	var unknown []interface{}
+	var errs []error
+	config := proto.DefaultRouterConfig()
+	config.OnUnknown = func(m interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		unknown = append(unknown, m)
+		if m == nil && !errors.Is(err, proto.ErrUnknownType) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	config.OnError = func(m interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	r := proto.NewRouter(config)
+	proto.Handle(r, func(ctx context.Context, m *ping) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pings = append(pings, m.N)
+		return nil
+	})
+	failed := errors.New("failed")
+	proto.Handle(r, func(ctx context.Context, m *pong) error {
+		return failed
+	})
+
+	if err := r.Serve(context.Background(), p.NewDecoder(b)); err != nil {
+		t.Fatal(err)
+	}
+	if len(pings) != 5 || pings[0] != 0 || pings[4] != 4 {
+		t.Fatalf("unexpected pings %v", pings)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], failed) {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(unknown) != 2 || unknown[0].(*Message).Data != "no handler" || unknown[1] != nil {
+		t.Fatalf("unexpected unknown messages %v", unknown)
+	}
+}
+
+func TestRouterDispatcher(t *testing.T) {
+	p := proto.NewProto()
+	p.MustRegister("ping", &ping{})
+	b := &bytes.Buffer{}
+	e := p.NewEncoder(b)
+	const count = 100
+	for i := 0; i < count; i++ {
+		_ = e.Encode(&ping{N: i})
+	}
+
+	config := proto.DefaultRouterConfig()
+	config.Dispatcher = dispatcher.NewQueueDispatcher(4, 4)
+	r := proto.NewRouter(config)
+	var sum atomic.Int64
+	proto.Handle(r, func(ctx context.Context, m *ping) error {
+		sum.Add(int64(m.N))
+		return nil
+	})
+	if err := r.Serve(context.Background(), p.NewDecoder(b)); err != nil {
+		t.Fatal(err)
+	}
+	// every handler is done once Serve returns, even those the full queue rejected
+	if sum.Load() != count*(count-1)/2 {
+		t.Fatalf("unexpected sum %d", sum.Load())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Serve(ctx, p.NewDecoder(b)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestRouterRejectsUnknownTypes(t *testing.T) {
+	config := proto.DefaultRouterConfig()
+	config.Proto = userProto(1)
+	r := proto.NewRouter(config)
+	if err := proto.Handle(r, func(ctx context.Context, m *userV1) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// an older version is upgraded before it is routed
+	if err := proto.Handle(r, func(ctx context.Context, m *userV0) error { return nil }); !errors.Is(err, proto.ErrNotRegistered) {
+		t.Fatalf("expected not registered, got %v", err)
+	}
+	if err := proto.Handle(r, func(ctx context.Context, m *ping) error { return nil }); !errors.Is(err, proto.ErrNotRegistered) {
+		t.Fatalf("expected not registered, got %v", err)
+	}
+	if err := proto.Handle(r, func(ctx context.Context, m *string) error { return nil }); err == nil {
+		t.Fatal("a handler of a non struct must be rejected")
+	}
+}
@@ -0,0 +1,223 @@
+package proto
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Schema - registered versions of every type
+type Schema map[Type][]VersionSchema
+
+// VersionSchema - fields of the payload by json name, Upgradable if there is an upgrade to the next version
+type VersionSchema struct {
+	Version    int
+	Fields     map[string]string
+	Upgradable bool
+}
+
+// Change - difference between two schemas, Breaking if messages written with one can not be read with the other
+type Change struct {
+	Type     Type
+	Breaking bool
+	Reason   string
+}
+
+func (c Change) String() string {
+	kind := "compatible"
+	if c.Breaking {
+		kind = "breaking"
+	}
+	return fmt.Sprintf("%s %s: %s", kind, c.Type, c.Reason)
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+func fieldsOf(payload reflect.Type) map[string]string {
+	t := payload.Elem()
+	return structFields(t, map[reflect.Type]bool{t: true})
+}
+
+// structFields - json name to type of the fields of t, fields of embedded structs are flattened like json does
+func structFields(t reflect.Type, visiting map[reflect.Type]bool) map[string]string {
+	fields := make(map[string]string)
+	var embedded []map[string]string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if !f.IsExported() && (!f.Anonymous || ft.Kind() != reflect.Struct) {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" && f.Anonymous && ft.Kind() == reflect.Struct && !marshaler(ft) && !visiting[ft] {
+			visiting[ft] = true
+			embedded = append(embedded, structFields(ft, visiting))
+			delete(visiting, ft)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = typeOf(f.Type, visiting)
+	}
+	for _, e := range embedded {
+		for name, ft := range e {
+			if _, ok := fields[name]; !ok {
+				fields[name] = ft // outer fields win
+			}
+		}
+	}
+	return fields
+}
+
+func marshaler(t reflect.Type) bool {
+	for _, m := range []reflect.Type{jsonMarshalerType, textMarshalerType} {
+		if t.Implements(m) || reflect.PointerTo(t).Implements(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf - t as its values are written, nested structs by their fields so that a change inside them is seen
+// types that marshal themselves and recursive structs are named
+func typeOf(t reflect.Type, visiting map[reflect.Type]bool) string {
+	if marshaler(t) {
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return "*" + typeOf(t.Elem(), visiting)
+	case reflect.Slice:
+		return "[]" + typeOf(t.Elem(), visiting)
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), typeOf(t.Elem(), visiting))
+	case reflect.Map:
+		return "map[" + typeOf(t.Key(), visiting) + "]" + typeOf(t.Elem(), visiting)
+	case reflect.Struct:
+		if visiting[t] {
+			return t.String()
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		fields := structFields(t, visiting)
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts := make([]string, 0, len(names))
+		for _, name := range names {
+			parts = append(parts, name+" "+fields[name])
+		}
+		return "struct{" + strings.Join(parts, "; ") + "}"
+	default:
+		return t.String()
+	}
+}
+
+func (p *proto) Schema() Schema {
+	schema := make(Schema)
+	for mType, versions := range p.versions {
+		for _, v := range versions {
+			schema[mType] = append(schema[mType], VersionSchema{
+				Version:    v.version,
+				Fields:     fieldsOf(v.payload),
+				Upgradable: v.upgrade.IsValid(),
+			})
+		}
+	}
+	return schema
+}
+
+// Diff - what changes from old to new, sorted by type
+// new can read what old writes if it still has the latest version of old with the same fields and upgrades from it,
+// old logs stay readable if new keeps every version of old and its upgrades
+func Diff(old Schema, new Schema) []Change {
+	var changes []Change
+	report := func(mType Type, breaking bool, format string, args ...interface{}) {
+		changes = append(changes, Change{Type: mType, Breaking: breaking, Reason: fmt.Sprintf(format, args...)})
+	}
+	for mType, oldVersions := range old {
+		newVersions, ok := new[mType]
+		if !ok {
+			report(mType, true, "type removed")
+			continue
+		}
+		byVersion := make(map[int]VersionSchema)
+		for _, v := range newVersions {
+			byVersion[v.Version] = v
+		}
+		for _, o := range oldVersions {
+			n, ok := byVersion[o.Version]
+			if !ok {
+				report(mType, true, "version %d removed", o.Version)
+				continue
+			}
+			if o.Upgradable && !n.Upgradable {
+				report(mType, true, "version %d: upgrade removed", o.Version)
+			}
+			diffFields(o, n, func(breaking bool, format string, args ...interface{}) {
+				report(mType, breaking, format, args...)
+			})
+		}
+		oldLatest, newLatest := oldVersions[len(oldVersions)-1], newVersions[len(newVersions)-1]
+		switch {
+		case newLatest.Version < oldLatest.Version:
+			report(mType, true, "latest version went back from %d to %d", oldLatest.Version, newLatest.Version)
+		case newLatest.Version > oldLatest.Version:
+			report(mType, false, "version %d added", newLatest.Version)
+			for _, n := range newVersions {
+				if n.Version >= oldLatest.Version && n.Version < newLatest.Version && !n.Upgradable {
+					report(mType, true, "no upgrade from version %d", n.Version)
+				}
+			}
+		}
+	}
+	for mType := range new {
+		if _, ok := old[mType]; !ok {
+			report(mType, false, "type added")
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Type < changes[j].Type
+	})
+	return changes
+}
+
+func diffFields(o VersionSchema, n VersionSchema, report func(breaking bool, format string, args ...interface{})) {
+	names := make([]string, 0, len(o.Fields)+len(n.Fields))
+	for name := range o.Fields {
+		names = append(names, name)
+	}
+	for name := range n.Fields {
+		if _, ok := o.Fields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldType, inOld := o.Fields[name]
+		newType, inNew := n.Fields[name]
+		switch {
+		case !inNew:
+			report(true, "version %d: field %s removed", o.Version, name)
+		case !inOld:
+			report(false, "version %d: field %s added", o.Version, name)
+		case oldType != newType:
+			report(true, "version %d: field %s changed from %s to %s", o.Version, name, oldType, newType)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package proto_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/proto"
+)
+
+type userV0 struct {
+	Name string `json:"name"`
+}
+
+type userV1 struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+}
+
+type userV2 struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Admin bool   `json:"admin"`
+}
+
+func upgradeV0(u *userV0) *userV1 {
+	return &userV1{First: u.Name}
+}
+
+func upgradeV1(u *userV1) *userV2 {
+	return &userV2{First: u.First, Last: u.Last}
+}
+
+func userProto(latest int) proto.Proto {
+	p := proto.NewProto()
+	p.MustRegister("user", &userV0{})
+	if latest >= 1 {
+		p.MustRegisterVersion("user", 1, &userV1{})
+		p.MustRegisterUpgrade("user", 0, upgradeV0)
+	}
+	if latest >= 2 {
+		p.MustRegisterVersion("user", 2, &userV2{})
+		p.MustRegisterUpgrade("user", 1, upgradeV1)
+	}
+	return p
+}
+
+func TestProtoUpgrade(t *testing.T) {
+	old, _ := userProto(0).Marshal(&userV0{Name: "khanh"})
+	if string(old) != `{"type":"user","payload":{"name":"khanh"}}` {
+		t.Fatalf("version 0 must keep the format, got %s", old)
+	}
+	p := userProto(2)
+	m, err := p.Unmarshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, &userV2{First: "khanh"}) {
+		t.Fatalf("unexpected upgrade %v", m)
+	}
+	b, err := p.Marshal(&userV2{First: "a", Admin: true})
+	if err != nil || string(b) != `{"type":"user","version":2,"payload":{"first":"a","last":"","admin":true}}` {
+		t.Fatalf("unexpected %s %v", b, err)
+	}
+	if _, err := p.Marshal(&userV1{}); !errors.Is(err, proto.ErrNotRegistered) {
+		t.Fatalf("old versions are not written, got %v", err)
+	}
+	if _, err := userProto(1).Unmarshal(b); !errors.Is(err, proto.ErrUnknownType) {
+		t.Fatalf("expected unknown version, got %v", err)
+	}
+
+	noUpgrade := proto.NewProto()
+	noUpgrade.MustRegister("user", &userV0{})
+	noUpgrade.MustRegisterVersion("user", 1, &userV1{})
+	if _, err := noUpgrade.Unmarshal(old); !errors.Is(err, proto.ErrNoUpgrade) {
+		t.Fatalf("expected no upgrade, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("upgrade of the wrong type must panic")
+		}
+	}()
+	noUpgrade.MustRegisterUpgrade("user", 0, upgradeV1)
+}
+
+type userRenamed struct {
+	Name string `json:"full_name"`
+}
+
+func TestDiff(t *testing.T) {
+	breaking := func(changes []proto.Change) []string {
+		var reasons []string
+		for _, c := range changes {
+			if c.Breaking {
+				reasons = append(reasons, c.Reason)
+			}
+		}
+		return reasons
+	}
+	if reasons := breaking(proto.Diff(userProto(0).Schema(), userProto(2).Schema())); len(reasons) != 0 {
+		t.Fatalf("upgradable versions must be compatible, got %v", reasons)
+	}
+
+	renamed := proto.NewProto()
+	renamed.MustRegister("user", &userRenamed{})
+	renamed.MustRegister("other", &userV1{})
+	changes := proto.Diff(userProto(0).Schema(), renamed.Schema())
+	expected := []string{"version 0: field full_name added", "version 0: field name removed"}
+	if reasons := breaking(changes); !reflect.DeepEqual(reasons, expected[1:]) {
+		t.Fatalf("unexpected breaking changes %v", reasons)
+	}
+	if len(changes) != 3 || changes[0].Type != "other" || changes[0].Reason != "type added" || changes[1].Reason != expected[0] {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+
+	noUpgrade := proto.NewProto()
+	noUpgrade.MustRegister("user", &userV0{})
+	noUpgrade.MustRegisterVersion("user", 1, &userV1{})
+	if reasons := breaking(proto.Diff(userProto(0).Schema(), noUpgrade.Schema())); !reflect.DeepEqual(reasons, []string{"no upgrade from version 0"}) {
+		t.Fatalf("unexpected breaking changes %v", reasons)
+	}
+	// stored version 0 data could no longer be read
+	if reasons := breaking(proto.Diff(userProto(1).Schema(), noUpgrade.Schema())); !reflect.DeepEqual(reasons, []string{"version 0: upgrade removed"}) {
+		t.Fatalf("unexpected breaking changes %v", reasons)
+	}
+	if reasons := breaking(proto.Diff(userProto(2).Schema(), proto.NewProto().Schema())); !reflect.DeepEqual(reasons, []string{"type removed"}) {
+		t.Fatalf("unexpected breaking changes %v", reasons)
+	}
+}
+
+type item struct {
+	Name string `json:"name"`
+}
+
+type itemRenamed struct {
+	Name string `json:"title"`
+}
+
+type node struct {
+	Children []*node `json:"children"`
+}
+
+type stamp struct {
+	At time.Time `json:"at"`
+}
+
+type orderV0 struct {
+	Items map[string][]*item `json:"items"`
+	node
+	stamp `json:"stamp"`
+}
+
+type orderRenamed struct {
+	Items map[string][]*itemRenamed `json:"items"`
+	node
+	stamp `json:"stamp"`
+}
+
+func TestDiffNested(t *testing.T) {
+	order := func(payload interface{}) proto.Schema {
+		p := proto.NewProto()
+		p.MustRegister("order", payload)
+		return p.Schema()
+	}
+	fields := order(&orderV0{})["order"][0].Fields
+	expected := map[string]string{
+		"items":    "map[string][]*struct{name string}",
+		"children": "[]*proto_test.node",
+		"stamp":    "struct{at time.Time}",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	changes := proto.Diff(order(&orderV0{}), order(&orderRenamed{}))
+	if len(changes) != 1 || !changes[0].Breaking {
+		t.Fatalf("a field renamed in a nested struct must be breaking, got %v", changes)
+	}
+}
@@ -1,23 +1,43 @@
 package proto
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"sync"
 )
 
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrNewline       = errors.New("message contains a newline, use LengthFraming")
+)
+
+const (
+	DEFAULT_MAX_FRAME_SIZE = 16 << 20
+	separator              = '\n'
+)
+
+type Framing int
+
 const (
-	separator = '\n'
+	NewlineFraming Framing = iota // one message per line, the codec must not write '\n' (json does not)
+	LengthFraming                 // 8 bytes little endian length then the message, for any codec
 )
 
 func (p *proto) NewEncoder(w io.Writer) Encoder {
-	return &encoder{w: w}
+	return &encoder{p: p, w: w}
 }
 
+// Encoder - safe for concurrent use, every message is written with a single Write
 type Encoder interface {
 	Encode(m interface{}) error
 }
 type encoder struct {
-	p *proto
-	w io.Writer
+	p  *proto
+	mu sync.Mutex
+	w  io.Writer
 }
 
 func (enc *encoder) Encode(m interface{}) error {
@@ -25,27 +45,55 @@ func (enc *encoder) Encode(m interface{}) error {
 	if err != nil {
 		return err
 	}
-	_, err = enc.w.Write(append(b, separator))
+	if len(b) > enc.p.config.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	switch enc.p.config.Framing {
+	case LengthFraming:
+		frame := make([]byte, 8, 8+len(b))
+		binary.LittleEndian.PutUint64(frame, uint64(len(b)))
+		b = append(frame, b...)
+	default:
+		if bytes.IndexByte(b, separator) >= 0 {
+			return ErrNewline
+		}
+		b = append(b, separator)
+	}
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	_, err = enc.w.Write(b)
 	return err
 }
 
 func (p *proto) NewDecoder(r io.Reader) Decoder {
-	return &decoder{r: r}
+	return &decoder{p: p, r: bufio.NewReader(r)}
 }
 
+// Decoder - safe for concurrent use, reads are buffered so r must not be read by anyone else
 type Decoder interface {
 	Decode() (interface{}, error)
 }
 
 type decoder struct {
-	p *proto
-	r io.Reader
+	p  *proto
+	mu sync.Mutex
+	r  *bufio.Reader
 }
 
 func (dec *decoder) Decode() (interface{}, error) {
-	b, err := readUntil(dec.r, separator)
+	b, err := dec.next()
 	if err != nil {
 		return nil, err
 	}
 	return dec.p.Unmarshal(b)
 }
+
+// next - the next frame, io.EOF if there is none
+func (dec *decoder) next() ([]byte, error) {
+	dec.mu.Lock()
+	defer dec.mu.Unlock()
+	if dec.p.config.Framing == LengthFraming {
+		return readFrame(dec.r, dec.p.config.MaxFrameSize)
+	}
+	return readLine(dec.r, dec.p.config.MaxFrameSize)
+}
@@ -2,10 +2,17 @@ package proto_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/fbundle/lab_public/lab/go_util/pkg/codec"
 	"github.com/fbundle/lab_public/lab/go_util/pkg/proto"
 )
 
@@ -40,3 +47,131 @@ func TestStream(t *testing.T) {
 		fmt.Println(m)
 	}
 }
+
+func TestStreamLengthFraming(t *testing.T) {
+	for _, c := range []codec.Codec{codec.NewJsonCodec(), codec.NewYamlCodec(), codec.NewXmlCodec()} {
+		config := proto.DefaultConfig()
+		config.Codec = c
+		config.Framing = proto.LengthFraming
+		p := proto.NewProtoWithConfig(config)
+		p.MustRegister("message", &Message{})
+
+		b := &bytes.Buffer{}
+		e := p.NewEncoder(b)
+		expected := []string{"line 1\nline 2", "", "hello"}
+		for _, data := range expected {
+			if err := e.Encode(&Message{Data: data}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d := p.NewDecoder(b)
+		for _, data := range expected {
+			m, err := d.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.(*Message).Data != data {
+				t.Fatalf("expected %q, got %q", data, m.(*Message).Data)
+			}
+		}
+		if _, err := d.Decode(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	}
+}
+
+func TestStreamNewline(t *testing.T) {
+	config := proto.DefaultConfig()
+	config.Codec = codec.NewYamlCodec()
+	p := proto.NewProtoWithConfig(config)
+	p.MustRegister("message", &Message{})
+	if err := p.NewEncoder(io.Discard).Encode(&Message{Data: "a"}); !errors.Is(err, proto.ErrNewline) {
+		t.Fatalf("expected newline error, got %v", err)
+	}
+
+	// json escapes newlines, the last message needs no separator
+	b := bytes.NewBufferString(`{"type":"message","payload":{"data":"a\nb"}}` + "\n" + `{"type":"message","payload":{"data":"c"}}`)
+	d := protoStream.NewDecoder(b)
+	for _, data := range []string{"a\nb", "c"} {
+		m, err := d.Decode()
+		if err != nil || m.(*Message).Data != data {
+			t.Fatalf("expected %q, got %v %v", data, m, err)
+		}
+	}
+}
+
+func TestStreamMaxFrameSize(t *testing.T) {
+	for _, framing := range []proto.Framing{proto.NewlineFraming, proto.LengthFraming} {
+		config := proto.DefaultConfig()
+		config.Framing = framing
+		config.MaxFrameSize = 64
+		p := proto.NewProtoWithConfig(config)
+		p.MustRegister("message", &Message{})
+		if err := p.NewEncoder(io.Discard).Encode(&Message{Data: strings.Repeat("x", 64)}); !errors.Is(err, proto.ErrFrameTooLarge) {
+			t.Fatalf("expected frame too large, got %v", err)
+		}
+
+		b := &bytes.Buffer{}
+		_ = protoStream.NewEncoder(b).Encode(&Message{Data: strings.Repeat("x", 64)})
+		if framing == proto.LengthFraming {
+			b = bytes.NewBuffer(binary.LittleEndian.AppendUint64(nil, 1<<20))
+		}
+		if _, err := p.NewDecoder(b).Decode(); !errors.Is(err, proto.ErrFrameTooLarge) {
+			t.Fatalf("expected frame too large, got %v", err)
+		}
+	}
+}
+
+func TestStreamConcurrent(t *testing.T) {
+	config := proto.DefaultConfig()
+	config.Framing = proto.LengthFraming
+	p := proto.NewProtoWithConfig(config)
+	p.MustRegister("message", &Message{})
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	e := p.NewEncoder(client)
+	d := p.NewDecoder(server)
+	const writers, count = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				if err := e.Encode(&Message{Data: fmt.Sprintf("%d.%d", i, j)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	received := make(chan string, writers*count)
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				m, err := d.Decode()
+				if err != nil {
+					return
+				}
+				received <- m.(*Message).Data
+			}
+		}()
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for len(seen) < writers*count {
+		select {
+		case data := <-received:
+			seen[data] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d messages", len(seen))
+		}
+	}
+	_ = client.Close()
+	readers.Wait()
+}
@@ -1,6 +1,8 @@
 package proto
 
 import (
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"io"
 	"reflect"
@@ -16,24 +18,45 @@ func mustBePtrOfStruct(i interface{}) error {
 	return nil
 }
 
-// readUntil : read bytes from reader
-// messages are separated by separator or io.EOF
+// readLine : read bytes until separator or io.EOF, without the separator
 // if err is io.EOF, b is empty
-func readUntil(reader io.Reader, separator byte) (b []byte, err error) {
-	buf := make([]byte, 1)
-	n := 0
+func readLine(reader *bufio.Reader, maxSize int) (b []byte, err error) {
 	for {
-		n, err = reader.Read(buf)
-		if err == nil && buf[0] == separator {
-			break
+		chunk, err := reader.ReadSlice(separator)
+		b = append(b, chunk...)
+		if len(b) > maxSize+1 {
+			return nil, ErrFrameTooLarge
 		}
-		b = append(b, buf[:n]...)
-		if err != nil {
-			break
+		switch {
+		case err == nil:
+			return b[:len(b)-1], nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(b) > 0:
+			return b, nil
+		default:
+			return nil, err
 		}
 	}
-	if len(b) > 0 && err == io.EOF {
-		err = nil
+}
+
+// readFrame : read a length prefixed frame
+// if err is io.EOF, there was no frame, a frame cut short is io.ErrUnexpectedEOF
+func readFrame(reader io.Reader, maxSize int) ([]byte, error) {
+	sizeBuffer := make([]byte, 8)
+	if _, err := io.ReadFull(reader, sizeBuffer); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint64(sizeBuffer)
+	if size > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
-	return b, err
+	return b, nil
 }
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+var (
+	ErrUnknownReceiver = errors.New("unknown_receiver")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrWriteFailed     = errors.New("write_failed")
+	ErrNoAck           = errors.New("no_ack")
+	ErrNotDirect       = errors.New("not_direct") // acks are only for messages to a single receiver
+)
+
+var reasonErrors = map[relay_pb.Reason]error{
+	relay_pb.Reason_UNKNOWN_RECEIVER: ErrUnknownReceiver,
+	relay_pb.Reason_QUEUE_FULL:       ErrQueueFull,
+	relay_pb.Reason_UNAUTHORIZED:     ErrUnauthorized,
+	relay_pb.Reason_WRITE_FAILED:     ErrWriteFailed,
+}
+
+// reasonOf - reason of a nack for a delivery error
+func reasonOf(err error) relay_pb.Reason {
+	for reason, reasonErr := range reasonErrors {
+		if errors.Is(err, reasonErr) {
+			return reason
+		}
+	}
+	return relay_pb.Reason_WRITE_FAILED
+}
+
+// errorOf - delivery error of a nack
+func errorOf(m *relay_pb.Message) error {
+	if err, ok := reasonErrors[m.Reason]; ok {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrWriteFailed, m.Reason)
+}
+
+// pendingAck - only receiver can ack, receiver or a hub can nack
+type pendingAck struct {
+	receiver string
+	done     chan error
+}
+
+// acker - messages waiting for an ack or a nack, by id
+type acker struct {
+	mu      sync.Mutex
+	lastId  uint64
+	waiting map[uint64]pendingAck
+}
+
+func newAcker() *acker {
+	return &acker{waiting: make(map[uint64]pendingAck)}
+}
+
+func (a *acker) wait(receiver string) (uint64, chan error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastId++
+	done := make(chan error, 1)
+	a.waiting[a.lastId] = pendingAck{receiver: receiver, done: done}
+	return a.lastId, done
+}
+
+func (a *acker) cancel(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.waiting, id)
+}
+
+// resolve - deliver the ack or nack m to whoever waits for it, nacks of a hub have no sender
+func (a *acker) resolve(m *relay_pb.Message) {
+	a.mu.Lock()
+	w, ok := a.waiting[m.Id]
+	if !ok || (m.Sender != w.receiver && (m.Kind != relay_pb.Kind_NACK || m.Sender != "")) {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.waiting, m.Id)
+	a.mu.Unlock()
+	if m.Kind == relay_pb.Kind_NACK {
+		w.done <- errorOf(m)
+	} else {
+		w.done <- nil
+	}
+}
@@ -0,0 +1,77 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func send(p relay.Peer, receiver string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.Send(ctx, &relay_pb.Message{Receiver: receiver, Payload: []byte("hi")})
+}
+
+func TestPeerSendAck(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.ACL = relay.ACLFromMap(map[string][]string{"alice": {"*"}})
+	config.Queue.MaxMessages = 1
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+	bob, bobReceived := mustRegister(t, addr, "bob")
+
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, bobReceived); !m.WantAck || m.Id == 0 {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if err := send(bob, "alice", time.Second); !errors.Is(err, relay.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	if err := bob.Send(context.Background(), &relay_pb.Message{Topic: "a"}); !errors.Is(err, relay.ErrNotDirect) {
+		t.Fatalf("expected not direct, got %v", err)
+	}
+
+	// a queued message is only acked once its receiver connects
+	if err := send(alice, "carol", 50*time.Millisecond); !errors.Is(err, relay.ErrNoAck) {
+		t.Fatalf("expected no ack, got %v", err)
+	}
+	if err := send(alice, "carol", time.Second); !errors.Is(err, relay.ErrQueueFull) {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+}
+
+func TestPeerSendUnknownReceiver(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.Storage = nil
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+
+	if err := send(alice, "bob", time.Second); !errors.Is(err, relay.ErrUnknownReceiver) {
+		t.Fatalf("expected unknown receiver, got %v", err)
+	}
+}
+
+func TestPeerSendForgedAck(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice, _ := mustRegister(t, addr, "alice")
+	mallory, _ := mustRegister(t, addr, "mallory")
+
+	// carol is offline, only she can ack what is queued for her
+	done := make(chan error, 1)
+	go func() {
+		done <- send(alice, "carol", 300*time.Millisecond)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for id := uint64(1); id <= 4; id++ {
+		_ = mallory.Write(&relay_pb.Message{Kind: relay_pb.Kind_ACK, Receiver: "alice", Id: id})
+	}
+	if err := <-done; !errors.Is(err, relay.ErrNoAck) {
+		t.Fatalf("expected no ack, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"time"
+)
+
+//go:generate go run github.com/fbundle/lab_public/lab/go_util/cmd/rpcgen -type Admin
+
+// PeerInfo - a peer connected to the hub, In counts what it sent and Out what the hub wrote to it
+type PeerInfo struct {
+	Name        string
+	Addr        string
+	ConnectedAt time.Time
+	MessagesIn  uint64
+	BytesIn     uint64
+	MessagesOut uint64
+	BytesOut    uint64
+	Dropped     uint64 // messages to the peer dropped because its outbox was full
+}
+
+type ListPeersReq struct{}
+
+type ListPeersRes struct {
+	Peers []PeerInfo
+}
+
+type DisconnectReq struct {
+	Name string
+}
+
+type DisconnectRes struct {
+	Disconnected bool
+}
+
+// Admin - operator view of a hub, served over pkg/rpc with RegisterAdmin
+type Admin interface {
+	ListPeers(req *ListPeersReq) *ListPeersRes
+	Disconnect(req *DisconnectReq) *DisconnectRes
+}
+
+func NewAdmin(h Hub) Admin {
+	return &admin{hub: h}
+}
+
+type admin struct {
+	hub Hub
+}
+
+func (a *admin) ListPeers(req *ListPeersReq) *ListPeersRes {
+	return &ListPeersRes{Peers: a.hub.Peers()}
+}
+
+func (a *admin) Disconnect(req *DisconnectReq) *DisconnectRes {
+	return &DisconnectRes{Disconnected: a.hub.Disconnect(req.Name)}
+}
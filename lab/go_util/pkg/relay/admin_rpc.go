@@ -0,0 +1,35 @@
+// Code generated by rpcgen. DO NOT EDIT.
+
+package relay
+
+import (
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+// RegisterAdmin - register every method of s on d
+func RegisterAdmin(d rpc.Dispatcher, s Admin) rpc.Dispatcher {
+	return d.
+		Register("Admin.ListPeers", s.ListPeers).
+		Register("Admin.Disconnect", s.Disconnect)
+}
+
+// AdminClient - typed client of Admin
+type AdminClient struct {
+	transport    rpc.TransportFunc
+	interceptors []rpc.Interceptor
+}
+
+func NewAdminClient(transport rpc.TransportFunc, interceptors ...rpc.Interceptor) *AdminClient {
+	return &AdminClient{
+		transport:    transport,
+		interceptors: interceptors,
+	}
+}
+
+func (c *AdminClient) ListPeers(req *ListPeersReq) (*ListPeersRes, error) {
+	return rpc.RPC[ListPeersReq, ListPeersRes](c.transport, "Admin.ListPeers", req, c.interceptors...)
+}
+
+func (c *AdminClient) Disconnect(req *DisconnectReq) (*DisconnectRes, error) {
+	return rpc.RPC[DisconnectReq, DisconnectRes](c.transport, "Admin.Disconnect", req, c.interceptors...)
+}
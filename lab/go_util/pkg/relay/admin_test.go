@@ -0,0 +1,84 @@
+package relay_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+func TestHubAdmin(t *testing.T) {
+	addr := freeAddr(t)
+	h := runHub(t, addr, relay.DefaultHubConfig())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rpc.NewServer(listener, rpc.DefaultServerConfig())
+	go func() {
+		_ = s.ListenAndServe(context.Background(), relay.RegisterAdmin(rpc.NewDispatcher(), relay.NewAdmin(h)), rpc.NewMessageIO())
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	client := relay.NewAdminClient(rpc.TCPTransport(context.Background(), listener.Addr().String(), rpc.NewMessageIO()))
+
+	alice, _ := mustRegister(t, addr, "alice")
+	bob := connect(t, addr, "bob", nil)
+	waitState(t, bob, relay.PeerConnected)
+	_ = alice.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte("hi")})
+	receive(t, bob.received)
+
+	res, err := client.ListPeers(&relay.ListPeersReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 2 || res.Peers[0].Name != "alice" || res.Peers[1].Name != "bob" {
+		t.Fatalf("unexpected peers %v", res.Peers)
+	}
+	if a, b := res.Peers[0], res.Peers[1]; a.MessagesIn != 1 || b.MessagesOut < 2 || b.BytesOut == 0 || a.ConnectedAt.IsZero() || a.Addr == "" {
+		t.Fatalf("unexpected counters %+v %+v", a, b)
+	}
+
+	if res, err := client.Disconnect(&relay.DisconnectReq{Name: "bob"}); err != nil || !res.Disconnected {
+		t.Fatalf("bob not disconnected: %v", err)
+	}
+	waitState(t, bob, relay.PeerDisconnected)
+	if res, err := client.Disconnect(&relay.DisconnectReq{Name: "carol"}); err != nil || res.Disconnected {
+		t.Fatalf("carol is not connected: %v", err)
+	}
+}
+
+func TestHubPresence(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.ACL = relay.ACLFromMap(map[string][]string{"alice": {"bob"}, "carol": {"*"}})
+	addr := startHub(t, config)
+	alice, aliceReceived := mustRegister(t, addr, "alice")
+	if err := alice.Subscribe("$presence.>"); err != nil {
+		t.Fatal(err)
+	}
+	everything, everythingReceived := mustRegister(t, addr, "everything")
+	if err := everything.Subscribe(">"); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, aliceReceived) // alice may not send to everything
+
+	bob := connect(t, addr, "bob", nil)
+	waitState(t, bob, relay.PeerConnected)
+	if m := receive(t, aliceReceived); m.Kind != relay_pb.Kind_PRESENCE || m.Topic != relay.PresenceJoin || m.Sender != "bob" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	_ = bob.Close()
+	if m := receive(t, aliceReceived); m.Topic != relay.PresenceLeave || m.Sender != "bob" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	// peers can not publish presence themselves, wildcards do not match it
+	carol, _ := mustRegister(t, addr, "carol")
+	_ = carol.Write(&relay_pb.Message{Topic: relay.PresenceJoin})
+	expectNothing(t, aliceReceived)
+	expectNothing(t, everythingReceived)
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+)
+
+// Authenticator - decide whether credential proves ownership of name for the challenge sent by the hub
+type Authenticator func(name string, challenge []byte, credential []byte) bool
+
+// Credential - compute the credential of a peer for the challenge sent by the hub
+type Credential func(challenge []byte) []byte
+
+// ACL - decide whether sender may send to receiver
+type ACL func(sender string, receiver string) bool
+
+// AllowAll - any peer can claim any free name
+func AllowAll(name string, challenge []byte, credential []byte) bool {
+	return true
+}
+
+// AllowAllACL - every peer can send to every peer
+func AllowAllACL(sender string, receiver string) bool {
+	return true
+}
+
+// TokenAuth - a name is owned by whoever knows its token
+func TokenAuth(tokens map[string]string) Authenticator {
+	return func(name string, challenge []byte, credential []byte) bool {
+		token, ok := tokens[name]
+		if !ok {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(token), credential) == 1
+	}
+}
+
+// SharedTokenAuth - every name is owned by whoever knows token, nobody if token is empty
+func SharedTokenAuth(token string) Authenticator {
+	return func(name string, challenge []byte, credential []byte) bool {
+		return token != "" && subtle.ConstantTimeCompare([]byte(token), credential) == 1
+	}
+}
+
+// TokenCredential - credential for TokenAuth and SharedTokenAuth
+func TokenCredential(token string) Credential {
+	return func(challenge []byte) []byte {
+		return []byte(token)
+	}
+}
+
+// Ed25519Auth - a name is owned by whoever can sign the challenge with the private key of its public key
+func Ed25519Auth(keys map[string]ed25519.PublicKey) Authenticator {
+	return func(name string, challenge []byte, credential []byte) bool {
+		key, ok := keys[name]
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(key, challenge, credential)
+	}
+}
+
+// Ed25519Credential - credential for Ed25519Auth
+func Ed25519Credential(key ed25519.PrivateKey) Credential {
+	return func(challenge []byte) []byte {
+		return ed25519.Sign(key, challenge)
+	}
+}
+
+// ACLFromMap - sender may send to receivers listed in acl[sender] or acl["*"], "*" as receiver matches every receiver
+func ACLFromMap(acl map[string][]string) ACL {
+	return func(sender string, receiver string) bool {
+		for _, key := range []string{sender, "*"} {
+			for _, allowed := range acl[key] {
+				if allowed == "*" || allowed == receiver {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
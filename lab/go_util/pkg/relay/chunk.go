@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrMessageTooLarge = errors.New("message_too_large")
+
+const (
+	DEFAULT_CHUNK_SIZE       = 256 << 10
+	DEFAULT_MAX_MESSAGE_SIZE = 64 << 20
+	DEFAULT_CHUNK_TIMEOUT    = 30 * time.Second
+	DEFAULT_CHUNK_STREAMS    = 16
+	DEFAULT_CHUNK_BUFFER     = 256 << 20
+)
+
+// split - messages carrying the payload of m in parts of at most size bytes, m itself if it fits
+func split(m *relay_pb.Message, stream uint64, size int) []*relay_pb.Message {
+	if size <= 0 || len(m.Payload) <= size {
+		return []*relay_pb.Message{m}
+	}
+	payload := m.Payload
+	m.Payload = nil
+	header := proto.Clone(m).(*relay_pb.Message)
+	m.Payload = payload
+	count := (len(payload) + size - 1) / size
+	chunks := make([]*relay_pb.Message, 0, count)
+	for i := 0; i < count; i++ {
+		c := proto.Clone(header).(*relay_pb.Message)
+		c.Payload = payload[i*size : min((i+1)*size, len(payload))]
+		c.Chunk = &relay_pb.Chunk{Stream: stream, Index: uint32(i), Count: uint32(count)}
+		chunks = append(chunks, c)
+	}
+	return chunks
+}
+
+// partial - chunks of a message received so far
+type partial struct {
+	parts  map[uint32][]byte
+	count  uint32
+	size   int
+	expire time.Time
+}
+
+type streamKey struct {
+	sender string
+	stream uint64
+}
+
+// assembler - put chunks back together by sender and stream
+// up to maxStreams messages of a sender at once and maxBuffer bytes across all of them
+type assembler struct {
+	mu         sync.Mutex
+	maxSize    int
+	maxStreams int
+	maxBuffer  int
+	timeout    time.Duration
+	streams    map[streamKey]*partial
+	senders    map[string]int // open streams by sender
+	buffered   int
+}
+
+func newAssembler(maxSize int, maxStreams int, maxBuffer int, timeout time.Duration) *assembler {
+	return &assembler{
+		maxSize:    maxSize,
+		maxStreams: maxStreams,
+		maxBuffer:  maxBuffer,
+		timeout:    timeout,
+		streams:    make(map[streamKey]*partial),
+		senders:    make(map[string]int),
+	}
+}
+
+func (a *assembler) dropLocked(key streamKey) {
+	p, ok := a.streams[key]
+	if !ok {
+		return
+	}
+	a.buffered -= p.size
+	if a.senders[key.sender]--; a.senders[key.sender] == 0 {
+		delete(a.senders, key.sender)
+	}
+	delete(a.streams, key)
+}
+
+// add - the whole message once its last chunk is added, nil before that
+// every chunk but the last is as large as the first, so count chunks of that size must fit in maxSize
+func (a *assembler) add(m *relay_pb.Message) (*relay_pb.Message, error) {
+	if m.Chunk == nil {
+		return m, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for key, p := range a.streams {
+		if now.After(p.expire) {
+			a.dropLocked(key)
+		}
+	}
+	key := streamKey{sender: m.Sender, stream: m.Chunk.Stream}
+	c := m.Chunk
+	p, ok := a.streams[key]
+	if !ok {
+		if c.Count == 0 || int(c.Count) > a.maxSize {
+			return nil, fmt.Errorf("%w: %d chunks", ErrMessageTooLarge, c.Count)
+		}
+		if a.senders[key.sender] >= a.maxStreams {
+			return nil, fmt.Errorf("%w: %d chunked messages of %s", ErrBufferFull, a.maxStreams, key.sender)
+		}
+		p = &partial{parts: make(map[uint32][]byte), count: c.Count}
+		a.streams[key] = p
+		a.senders[key.sender]++
+	}
+	p.expire = now.Add(a.timeout)
+	if _, dup := p.parts[c.Index]; c.Count != p.count || c.Index >= p.count || dup {
+		a.dropLocked(key)
+		return nil, fmt.Errorf("invalid chunk %d/%d of %s/%d", c.Index, c.Count, key.sender, key.stream)
+	}
+	if c.Index < c.Count-1 && int(c.Count-1)*len(m.Payload) > a.maxSize {
+		a.dropLocked(key)
+		return nil, fmt.Errorf("%w: %d chunks of %d bytes", ErrMessageTooLarge, c.Count, len(m.Payload))
+	}
+	if p.size+len(m.Payload) > a.maxSize {
+		a.dropLocked(key)
+		return nil, fmt.Errorf("%w: %s/%d", ErrMessageTooLarge, key.sender, key.stream)
+	}
+	if a.buffered+len(m.Payload) > a.maxBuffer {
+		a.dropLocked(key)
+		return nil, fmt.Errorf("%w: %d bytes of chunks", ErrBufferFull, a.maxBuffer)
+	}
+	p.parts[c.Index] = append([]byte{}, m.Payload...)
+	p.size += len(m.Payload)
+	a.buffered += len(m.Payload)
+	if len(p.parts) < int(p.count) {
+		return nil, nil
+	}
+	a.dropLocked(key)
+	payload := make([]byte, 0, p.size)
+	for i := uint32(0); i < p.count; i++ {
+		payload = append(payload, p.parts[i]...)
+	}
+	m.Payload = payload
+	m.Chunk = nil
+	return m, nil
+}
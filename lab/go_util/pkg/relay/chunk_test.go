@@ -0,0 +1,89 @@
+package relay_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func TestPeerChunkedPayload(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.MaxFrameSize = 64 << 10
+	addr := startHub(t, config)
+	alice := connectWith(t, addr, "alice", nil, nil)
+	waitState(t, alice, relay.PeerConnected)
+	_, bobReceived := mustRegister(t, addr, "bob")
+
+	// the default chunk size is larger than the frame size of the hub
+	payload := make([]byte, 200<<10)
+	_, _ = rand.Read(payload)
+	if err := alice.Write(&relay_pb.Message{Receiver: "bob", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, alice, relay.PeerDisconnected)
+	waitState(t, alice, relay.PeerConnected)
+	expectNothing(t, bobReceived)
+
+	chunked := relay.DefaultPeerConfig()
+	chunked.ChunkSize = 16 << 10
+	carol, err := relay.NewPeer("carol", "", addr, chunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	go func() {
+		_ = carol.DialAndServe(func(m *relay_pb.Message) {})
+	}()
+	if err := send(carol, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobReceived)
+	if err := carol.Write(&relay_pb.Message{Receiver: "bob", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, bobReceived); !bytes.Equal(m.Payload, payload) || m.Chunk != nil {
+		t.Fatalf("payload of %d bytes not reassembled", len(m.Payload))
+	}
+	expectNothing(t, bobReceived)
+}
+
+func TestPeerChunkLimits(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	mallory, _ := mustRegister(t, addr, "mallory")
+	config := relay.DefaultPeerConfig()
+	config.MaxMessageSize = 1 << 10
+	config.ChunkStreams = 2
+	bob := connectConfig(t, addr, "", "bob", config, nil)
+	if err := waitRegistered(t, bob); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(stream uint64, index uint32, count uint32, payload string) {
+		_ = mallory.Write(&relay_pb.Message{
+			Receiver: "bob",
+			Payload:  []byte(payload),
+			Chunk:    &relay_pb.Chunk{Stream: stream, Index: index, Count: count},
+		})
+	}
+
+	// a count no message of MaxMessageSize has
+	chunk(1, 0, 1<<30, "x")
+	chunk(2, 0, 3, string(make([]byte, 600)))
+	// a third message at once is dropped
+	chunk(3, 0, 2, "a")
+	chunk(4, 0, 2, "c")
+	chunk(5, 0, 2, "e")
+	chunk(5, 1, 2, "f")
+	expectNothing(t, bob.received)
+	chunk(3, 1, 2, "b")
+	if m := receive(t, bob.received); string(m.Payload) != "ab" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	chunk(4, 1, 2, "d")
+	if m := receive(t, bob.received); string(m.Payload) != "cd" {
+		t.Fatalf("unexpected message %v", m)
+	}
+}
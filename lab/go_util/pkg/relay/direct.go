@@ -0,0 +1,526 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrNoDirect = errors.New("no_direct")
+
+var errDatagramTooLarge = errors.New("datagram_too_large")
+
+const (
+	DEFAULT_DIRECT_TIMEOUT = 5 * time.Second
+	directRetry            = 100 * time.Millisecond
+	maxDatagram            = 1200 // fits the path MTU of most networks, larger messages are not worth fragments
+	datagramKeepalive      = 5 * time.Second
+	datagramTimeout        = 3 * datagramKeepalive
+)
+
+// direct connections: the hub is the rendezvous, each peer offers the endpoints it can be dialed at
+// and the hub adds the endpoint it observes, then both peers dial each other at the same time from
+// the port they listen on, so that NATs on both sides let the other one in (TCP simultaneous open)
+// both ends say hello with the token of the offer, the end with the smaller name selects one connection
+// when both peers offer at the same time, the offer of the smaller name is the one answered
+// only the address the hub observes is dialed, so that a peer cannot make others dial another host
+//
+// for NATs that do not let a TCP simultaneous open in, the peers also punch a UDP hole from the same port
+// (this assumes the NAT maps UDP from that port to the port it maps TCP to, as most do): both ends send
+// hellos to the endpoints of the other, a hello that gets through was sent from a mapping open to this peer,
+// so the path to where it came from is up, and the hello is answered with a select that tells the same
+// to the other end; a path is up until nothing came from the other end within datagramTimeout,
+// both ends send a select every datagramKeepalive to keep the NAT mapping open
+// a message goes in one datagram, so those larger than maxDatagram still go through the hub
+// a TCP connection carries messages of any size, so UDP hellos are only sent after a first round of TCP
+
+// datagramPath - where to send datagrams to a peer, seen is when the last one came from there
+type datagramPath struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+// punch - direct connection to a peer being set up, own if this peer made the offer
+type punch struct {
+	token []byte
+	own   bool
+	done  chan error
+}
+
+func (pu *punch) resolve(err error) {
+	select {
+	case pu.done <- err:
+	default:
+	}
+}
+
+// directable - whether m may skip the hub when there is a direct connection to its receiver
+func directable(m *relay_pb.Message) bool {
+	if m.Receiver == "" || m.Topic != "" || m.Broadcast {
+		return false
+	}
+	switch m.Kind {
+	case relay_pb.Kind_DATA, relay_pb.Kind_ACK, relay_pb.Kind_KEY, relay_pb.Kind_KEY_REQUEST:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialer - dial from the port of the direct listener so that a NAT maps the hub connection and direct ones to the same endpoint
+func (p *peer) dialer() net.Dialer {
+	switch {
+	case p.ln == nil:
+		return net.Dialer{LocalAddr: p.listen, Timeout: DEFAULT_HANDSHAKE_TIMEOUT}
+	case !reusePortSupported:
+		return net.Dialer{Timeout: DEFAULT_HANDSHAKE_TIMEOUT}
+	default:
+		return net.Dialer{LocalAddr: p.ln.Addr(), Timeout: DEFAULT_HANDSHAKE_TIMEOUT, Control: reusePort}
+	}
+}
+
+// endpointsLocked - where this peer can be dialed, as far as it knows
+func (p *peer) endpointsLocked() []string {
+	if p.conn == nil {
+		return []string{p.ln.Addr().String()}
+	}
+	host, _, _ := net.SplitHostPort(p.conn.LocalAddr().String())
+	_, port, _ := net.SplitHostPort(p.ln.Addr().String())
+	return []string{net.JoinHostPort(host, port)}
+}
+
+func (p *peer) Direct(ctx context.Context, name string) error {
+	if p.ln == nil {
+		return fmt.Errorf("%w: disabled", ErrNoDirect)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	pu := &punch{token: token, own: true, done: make(chan error, 1)}
+	p.mu.Lock()
+	if p.hasDirectLocked(name) {
+		p.mu.Unlock()
+		return nil
+	}
+	p.punches[name] = pu
+	endpoints := p.endpointsLocked()
+	p.mu.Unlock()
+	defer p.forget(name, pu)
+
+	if err := p.Write(&relay_pb.Message{
+		Kind:      relay_pb.Kind_DIRECT_OFFER,
+		Receiver:  name,
+		Payload:   token,
+		Endpoints: endpoints,
+	}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.DirectTimeout)
+	defer cancel()
+	select {
+	case err := <-pu.done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s: %w", ErrNoDirect, name, ctx.Err())
+	}
+}
+
+// forget - pu is over
+func (p *peer) forget(name string, pu *punch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.punches[name] == pu {
+		delete(p.punches, name)
+	}
+}
+
+// offered - answer the offer of another peer and start dialing it
+// an offer crossing one of this peer is only answered by the larger name, whose Direct then waits for it
+func (p *peer) offered(m *relay_pb.Message, serve func(*relay_pb.Message)) {
+	if p.ln == nil || len(m.Payload) == 0 {
+		_ = p.Write(&relay_pb.Message{Kind: relay_pb.Kind_DIRECT_ANSWER, Receiver: m.Sender})
+		return
+	}
+	pu := &punch{token: m.Payload, done: make(chan error, 1)}
+	p.mu.Lock()
+	if own, ok := p.punches[m.Sender]; ok && own.own {
+		if p.name < m.Sender {
+			p.mu.Unlock()
+			return
+		}
+		pu.done = own.done
+	}
+	p.punches[m.Sender] = pu
+	endpoints := p.endpointsLocked()
+	p.mu.Unlock()
+	if err := p.Write(&relay_pb.Message{
+		Kind:      relay_pb.Kind_DIRECT_ANSWER,
+		Receiver:  m.Sender,
+		Payload:   m.Payload,
+		Endpoints: endpoints,
+	}); err != nil {
+		p.forget(m.Sender, pu)
+		return
+	}
+	go func() {
+		defer p.forget(m.Sender, pu)
+		p.punch(m.Sender, pu, observed(m.Endpoints), serve)
+	}()
+}
+
+// answered - the other peer answered an offer of this peer
+func (p *peer) answered(m *relay_pb.Message, serve func(*relay_pb.Message)) {
+	p.mu.Lock()
+	pu, ok := p.punches[m.Sender]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if len(m.Payload) == 0 {
+		pu.resolve(fmt.Errorf("%w: refused by %s", ErrNoDirect, m.Sender))
+		return
+	}
+	if !bytes.Equal(pu.token, m.Payload) {
+		return
+	}
+	go p.punch(m.Sender, pu, observed(m.Endpoints), serve)
+}
+
+// observed - endpoints on the host the hub observes first, the others could be any host the sender wants dialed
+func observed(endpoints []string) []string {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(endpoints[0])
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	return slices.DeleteFunc(slices.Clone(endpoints), func(endpoint string) bool {
+		h, _, err := net.SplitHostPort(endpoint)
+		return err != nil || !ip.Equal(net.ParseIP(h))
+	})
+}
+
+// networks - whether a round of punching dials and sends hellos
+func (p *peer) networks(round int) (tcp bool, udp bool) {
+	switch p.config.DirectNetwork {
+	case "tcp":
+		return true, false
+	case "udp":
+		return false, true
+	default:
+		return true, round > 0
+	}
+}
+
+// punch - dial every endpoint of name and send it hellos until a direct connection is up or the time is over
+func (p *peer) punch(name string, pu *punch, endpoints []string, serve func(*relay_pb.Message)) {
+	ctx, cancel := context.WithTimeout(p.ctx, p.config.DirectTimeout)
+	defer cancel()
+	slices.Sort(endpoints)
+	endpoints = slices.Compact(endpoints)
+	for round := 0; ctx.Err() == nil; round++ {
+		tcp, udp := p.networks(round)
+		for _, endpoint := range endpoints {
+			if tcp {
+				go func(endpoint string) {
+					dialer := p.dialer()
+					c, err := dialer.DialContext(ctx, "tcp", endpoint)
+					if err != nil {
+						return
+					}
+					p.handshake(c.(*net.TCPConn), name, serve)
+				}(endpoint)
+			}
+			if udp {
+				if addr, err := net.ResolveUDPAddr("udp", endpoint); err == nil {
+					_ = p.writeDatagram(addr, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_HELLO, Sender: p.name, Payload: pu.token})
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(directRetry):
+		}
+		if p.hasDirect(name) {
+			return
+		}
+	}
+	pu.resolve(fmt.Errorf("%w: %s: %w", ErrNoDirect, name, ctx.Err()))
+}
+
+func (p *peer) hasDirect(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hasDirectLocked(name)
+}
+
+func (p *peer) hasDirectLocked(name string) bool {
+	_, tcp := p.directs[name]
+	_, udp := p.datagrams[name]
+	return tcp || udp
+}
+
+// acceptDirect - direct connections dialed by other peers
+func (p *peer) acceptDirect(serve func(*relay_pb.Message)) {
+	for {
+		conn, err := p.ln.AcceptTCP()
+		if err != nil {
+			return
+		}
+		if p.config.DirectNetwork == "udp" {
+			_ = conn.Close()
+			continue
+		}
+		go p.handshake(conn, "", serve)
+	}
+}
+
+// verify - whether hello comes from a peer this peer is punching to
+func (p *peer) verify(hello *relay_pb.Message) (*punch, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pu, ok := p.punches[hello.Sender]
+	return pu, ok && hello.Kind == relay_pb.Kind_DIRECT_HELLO && bytes.Equal(pu.token, hello.Payload)
+}
+
+// handshake - name is the dialed peer, empty for accepted connections which say hello first
+func (p *peer) handshake(conn *net.TCPConn, name string, serve func(*relay_pb.Message)) {
+	_ = conn.SetDeadline(time.Now().Add(p.config.DirectTimeout))
+	other, pu, err := func() (string, *punch, error) {
+		if name != "" {
+			p.mu.Lock()
+			pu, ok := p.punches[name]
+			p.mu.Unlock()
+			if !ok {
+				return "", nil, ErrNoDirect
+			}
+			if err := marshalAndWrite(conn, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_HELLO, Sender: p.name, Payload: pu.token}); err != nil {
+				return "", nil, err
+			}
+		}
+		_, hello, err := readAndUnmarshal(conn, p.config.MaxFrameSize)
+		if err != nil {
+			return "", nil, err
+		}
+		pu, ok := p.verify(hello)
+		if !ok || (name != "" && hello.Sender != name) {
+			return "", nil, ErrNoDirect
+		}
+		if name == "" {
+			err = marshalAndWrite(conn, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_HELLO, Sender: p.name, Payload: pu.token})
+		}
+		return hello.Sender, pu, err
+	}()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if !p.selectDirect(conn, other) {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	fmt.Printf("[peer_%s] direct connection to %s via %s\n", p.name, other, conn.RemoteAddr().String())
+	pu.resolve(nil)
+	p.serveDirect(conn, other, serve)
+}
+
+// selectDirect - the end with the smaller name keeps the first connection, the other end whatever it is told
+func (p *peer) selectDirect(conn *net.TCPConn, other string) bool {
+	if p.name < other {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.directs[other]; ok || p.state == PeerClosed {
+			return false
+		}
+		if err := marshalAndWrite(conn, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_SELECT, Sender: p.name}); err != nil {
+			return false
+		}
+		p.directs[other] = conn
+		return true
+	}
+	_, m, err := readAndUnmarshal(conn, p.config.MaxFrameSize)
+	if err != nil || m.Kind != relay_pb.Kind_DIRECT_SELECT {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == PeerClosed {
+		return false
+	}
+	if previous, ok := p.directs[other]; ok {
+		_ = previous.Close()
+	}
+	p.directs[other] = conn
+	return true
+}
+
+// serveDirect - read from other until the connection breaks, then messages go through the hub again
+func (p *peer) serveDirect(conn *net.TCPConn, other string, serve func(*relay_pb.Message)) {
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.directs[other] == conn {
+			delete(p.directs, other)
+		}
+		_ = conn.Close()
+	}()
+	for {
+		_, m, err := readAndUnmarshal(conn, p.config.MaxFrameSize)
+		if err != nil {
+			return
+		}
+		m.Sender = other // the other end can only send as itself
+		m.Via = nil
+		if !directable(m) || m.Receiver != p.name {
+			continue
+		}
+		p.handle(m, serve)
+	}
+}
+
+// writeDirectLocked - write m on the direct connection to its receiver if there is one, or else in a datagram if it fits
+func (p *peer) writeDirectLocked(m *relay_pb.Message) bool {
+	if !directable(m) {
+		return false
+	}
+	if conn, ok := p.directs[m.Receiver]; ok {
+		if err := marshalAndWrite(conn, m); err != nil {
+			fmt.Printf("[peer_%s] direct write error: %v, falling back to the hub\n", p.name, err)
+			_ = conn.Close()
+			delete(p.directs, m.Receiver)
+			return false
+		}
+		return true
+	}
+	path, ok := p.datagrams[m.Receiver]
+	if !ok {
+		return false
+	}
+	err := p.writeDatagram(path.addr, m)
+	if errors.Is(err, errDatagramTooLarge) {
+		return false
+	}
+	if err != nil {
+		fmt.Printf("[peer_%s] datagram write error: %v, falling back to the hub\n", p.name, err)
+		delete(p.datagrams, m.Receiver)
+		return false
+	}
+	return true
+}
+
+// writeDatagram - m in a single datagram to addr
+func (p *peer) writeDatagram(addr *net.UDPAddr, m *relay_pb.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxDatagram {
+		return errDatagramTooLarge
+	}
+	_, err = p.udp.WriteToUDP(b, addr)
+	return err
+}
+
+// readDatagrams - hellos and selects set up paths, other datagrams are messages from the peer with a path from there
+func (p *peer) readDatagrams(serve func(*relay_pb.Message)) {
+	buffer := make([]byte, maxDatagram+1)
+	for {
+		n, addr, err := p.udp.ReadFromUDP(buffer)
+		if err != nil {
+			if p.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		m := &relay_pb.Message{}
+		if n > maxDatagram || proto.Unmarshal(buffer[:n], m) != nil {
+			continue
+		}
+		switch m.Kind {
+		case relay_pb.Kind_DIRECT_HELLO:
+			if p.selectDatagrams(m, addr) {
+				_ = p.writeDatagram(addr, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_SELECT, Sender: p.name, Payload: m.Payload})
+			}
+		case relay_pb.Kind_DIRECT_SELECT:
+			p.selectDatagrams(m, addr)
+		default:
+			other, ok := p.touch(addr)
+			if !ok {
+				continue
+			}
+			m.Sender = other // the other end can only send as itself
+			m.Via = nil
+			if !directable(m) || m.Receiver != p.name {
+				continue
+			}
+			p.handle(m, serve)
+		}
+	}
+}
+
+// selectDatagrams - whether m is a hello or a select of a peer this peer is punching to, which then has a path from addr
+// a select without a token keeps the path from addr alive
+func (p *peer) selectDatagrams(m *relay_pb.Message, addr *net.UDPAddr) bool {
+	if _, ok := p.touch(addr); ok {
+		return len(m.Payload) > 0
+	}
+	p.mu.Lock()
+	pu, ok := p.punches[m.Sender]
+	if !ok || !bytes.Equal(pu.token, m.Payload) || p.state == PeerClosed {
+		p.mu.Unlock()
+		return false
+	}
+	p.datagrams[m.Sender] = &datagramPath{addr: addr, seen: time.Now()}
+	p.mu.Unlock()
+	fmt.Printf("[peer_%s] direct datagrams to %s via %s\n", p.name, m.Sender, addr.String())
+	pu.resolve(nil)
+	return true
+}
+
+// touch - the peer with a path from addr, which is then alive
+func (p *peer) touch(addr *net.UDPAddr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, path := range p.datagrams {
+		if path.addr.AddrPort() == addr.AddrPort() {
+			path.seen = time.Now()
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// keepDatagrams - keep the NAT mappings of paths open, and drop those the other end went silent on
+func (p *peer) keepDatagrams() {
+	ticker := time.NewTicker(datagramKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		for name, path := range p.datagrams {
+			if time.Since(path.seen) > datagramTimeout {
+				fmt.Printf("[peer_%s] no datagram from %s, falling back to the hub\n", p.name, name)
+				delete(p.datagrams, name)
+				continue
+			}
+			_ = p.writeDatagram(path.addr, &relay_pb.Message{Kind: relay_pb.Kind_DIRECT_SELECT, Sender: p.name})
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,225 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func connectDirect(t *testing.T, hubAddr string, name string, direct bool) *testPeer {
+	return connectDirectNetwork(t, hubAddr, name, direct, "")
+}
+
+// connectDirectNetwork - like connectDirect, the peer only punches holes on network if it is not empty
+func connectDirectNetwork(t *testing.T, hubAddr string, name string, direct bool, network string) *testPeer {
+	config := relay.DefaultPeerConfig()
+	config.Direct = direct
+	config.DirectTimeout = time.Second
+	config.DirectNetwork = network
+	tp := connectConfig(t, hubAddr, "127.0.0.1:0", name, config, nil)
+	waitState(t, tp, relay.PeerConnected)
+	return tp
+}
+
+func isConnected(h relay.Hub, name string) bool {
+	for _, info := range h.Peers() {
+		if info.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func messagesIn(h relay.Hub, name string) uint64 {
+	for _, info := range h.Peers() {
+		if info.Name == name {
+			return info.MessagesIn
+		}
+	}
+	return 0
+}
+
+func TestPeerDirect(t *testing.T) {
+	addr := freeAddr(t)
+	h := runHub(t, addr, relay.DefaultHubConfig())
+	alice := connectDirect(t, addr, "alice", true)
+	bob := connectDirect(t, addr, "bob", true)
+
+	ctx := context.Background()
+	if err := bob.Direct(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Direct(ctx, "bob"); err != nil {
+		t.Fatal(err) // already up
+	}
+
+	// acked on the direct connection, the hub sees nothing
+	before := messagesIn(h, "alice") + messagesIn(h, "bob")
+	for i := 0; i < 3; i++ {
+		if err := send(alice, "bob", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if m := receive(t, bob.received); m.Sender != "alice" {
+			t.Fatalf("unexpected message %v", m)
+		}
+		if err := send(bob, "alice", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, alice.received)
+	}
+	if after := messagesIn(h, "alice") + messagesIn(h, "bob"); after != before {
+		t.Fatalf("hub got %d messages", after-before)
+	}
+
+	// the direct connection survives the hub connection, messages to others still go through the hub
+	h.Disconnect("alice")
+	waitState(t, alice, relay.PeerDisconnected)
+	if err := send(bob, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, alice.received)
+	waitState(t, alice, relay.PeerConnected)
+	_ = bob.Write(&relay_pb.Message{Topic: "x"})
+	expectNothing(t, alice.received)
+}
+
+func TestPeerDirectDatagrams(t *testing.T) {
+	addr := freeAddr(t)
+	h := runHub(t, addr, relay.DefaultHubConfig())
+	alice := connectDirectNetwork(t, addr, "alice", true, "udp")
+	bob := connectDirect(t, addr, "bob", true)
+
+	// alice takes no TCP connection, datagrams get through
+	if err := alice.Direct(context.Background(), "bob"); err != nil {
+		t.Fatal(err)
+	}
+	before := messagesIn(h, "alice") + messagesIn(h, "bob")
+	for i := 0; i < 3; i++ {
+		if err := send(alice, "bob", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if m := receive(t, bob.received); m.Sender != "alice" {
+			t.Fatalf("unexpected message %v", m)
+		}
+		if err := send(bob, "alice", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, alice.received)
+	}
+	if after := messagesIn(h, "alice") + messagesIn(h, "bob"); after != before {
+		t.Fatalf("hub got %d messages", after-before)
+	}
+
+	// a message larger than a datagram goes through the hub
+	before = messagesIn(h, "alice")
+	if err := alice.Write(&relay_pb.Message{Receiver: "bob", Payload: make([]byte, 2000)}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, bob.received); len(m.Payload) != 2000 {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if messagesIn(h, "alice") == before {
+		t.Fatal("hub got no message")
+	}
+
+	// no hole both ends punch
+	carol := connectDirectNetwork(t, addr, "carol", true, "tcp")
+	if err := alice.Direct(context.Background(), "carol"); !errors.Is(err, relay.ErrNoDirect) {
+		t.Fatalf("expected no direct, got %v", err)
+	}
+	if err := send(carol, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, alice.received)
+}
+
+func TestPeerDirectFallback(t *testing.T) {
+	addr := freeAddr(t)
+	h := runHub(t, addr, relay.DefaultHubConfig())
+	alice := connectDirect(t, addr, "alice", true)
+	bob := connectDirect(t, addr, "bob", false)
+
+	if err := alice.Direct(context.Background(), "bob"); !errors.Is(err, relay.ErrNoDirect) {
+		t.Fatalf("expected no direct, got %v", err)
+	}
+	if err := bob.Direct(context.Background(), "alice"); !errors.Is(err, relay.ErrNoDirect) {
+		t.Fatalf("expected no direct, got %v", err)
+	}
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bob.received)
+
+	// a broken direct connection falls back to the hub
+	carol := connectDirect(t, addr, "carol", true)
+	if err := carol.Direct(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	_ = alice.Close()
+	for i := 0; i < 100 && isConnected(h, "alice"); i++ {
+		time.Sleep(10 * time.Millisecond) // until the hub lets the name go
+	}
+	alice = connectDirect(t, addr, "alice", true)
+	if err := send(carol, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, alice.received)
+}
+
+func TestPeerDirectCrossing(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice := connectDirect(t, addr, "alice", true)
+	bob := connectDirect(t, addr, "bob", true)
+
+	// both offer at the same time, the offer of alice is the one taken
+	errs := make(chan error, 2)
+	for _, c := range []struct {
+		from *testPeer
+		to   string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		go func() {
+			errs <- c.from.Direct(context.Background(), c.to)
+		}()
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPeerDirectEndpoints(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	connectDirect(t, addr, "alice", true)
+	mallory, _ := mustRegister(t, addr, "mallory")
+
+	// another host mallory would like alice to dial
+	target, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer target.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			_ = conn.Close()
+			dialed <- struct{}{}
+		}
+	}()
+	_ = mallory.Write(&relay_pb.Message{
+		Kind:      relay_pb.Kind_DIRECT_OFFER,
+		Receiver:  "alice",
+		Payload:   []byte("token"),
+		Endpoints: []string{target.Addr().String()},
+	})
+	select {
+	case <-dialed:
+		t.Fatal("alice dialed an endpoint that is not mallory")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,335 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+var (
+	ErrKeyMismatch = errors.New("key_mismatch")
+	ErrNoKey       = errors.New("no_key")
+	ErrDecrypt     = errors.New("decrypt")
+)
+
+const DEFAULT_KEY_TIMEOUT = 5 * time.Second
+
+// KeyStore - public keys of peers, Pin fails with ErrKeyMismatch if name is pinned to another key
+type KeyStore interface {
+	Get(name string) ([]byte, bool)
+	Pin(name string, key []byte) error
+}
+
+func NewMemoryKeyStore() KeyStore {
+	return &memoryKeyStore{keys: make(map[string][]byte)}
+}
+
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (s *memoryKeyStore) Get(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[name]
+	return key, ok
+}
+
+func (s *memoryKeyStore) Pin(name string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pinned, ok := s.keys[name]; ok {
+		if !bytes.Equal(pinned, key) {
+			return fmt.Errorf("%w: %s", ErrKeyMismatch, name)
+		}
+		return nil
+	}
+	s.keys[name] = bytes.Clone(key)
+	return nil
+}
+
+// NewFileKeyStore - keys pinned in a json file, so that a hub swapping keys is detected across restarts
+func NewFileKeyStore(path string) (KeyStore, error) {
+	s := &fileKeyStore{path: path, memoryKeyStore: memoryKeyStore{keys: make(map[string][]byte)}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type fileKeyStore struct {
+	memoryKeyStore
+	path string
+}
+
+func (s *fileKeyStore) Pin(name string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pinned, ok := s.keys[name]; ok {
+		if !bytes.Equal(pinned, key) {
+			return fmt.Errorf("%w: %s", ErrKeyMismatch, name)
+		}
+		return nil
+	}
+	s.keys[name] = bytes.Clone(key)
+	b, err := json.Marshal(s.keys)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// SecureConfig - Key is the X25519 key of the peer, Pins keeps the keys of other peers
+type SecureConfig struct {
+	Key        *ecdh.PrivateKey
+	Pins       KeyStore
+	KeyTimeout time.Duration // to wait for the key of a receiver
+}
+
+func DefaultSecureConfig(key *ecdh.PrivateKey) SecureConfig {
+	return SecureConfig{
+		Key:        key,
+		Pins:       NewMemoryKeyStore(),
+		KeyTimeout: DEFAULT_KEY_TIMEOUT,
+	}
+}
+
+// NewSecurePeer - payloads of messages to a single receiver are sealed so that hubs only see the routing headers
+// the key of a receiver is asked through the hub the first time and pinned
+// topic and broadcast payloads are not encrypted, direct messages that are not sealed are dropped
+// Write and Send wait for the key of a new receiver, so serve must not call them for one
+func NewSecurePeer(p Peer, config SecureConfig) Peer {
+	return &securePeer{
+		Peer:     p,
+		config:   config,
+		sessions: make(map[string]cipher.AEAD),
+		waiting:  make(map[string][]chan error),
+	}
+}
+
+type securePeer struct {
+	Peer
+	config   SecureConfig
+	mu       sync.Mutex
+	sessions map[string]cipher.AEAD // by name of the other peer
+	waiting  map[string][]chan error
+}
+
+// session - AES-GCM keyed by HKDF of the X25519 shared secret, bound to both public keys
+func (p *securePeer) session(name string, key []byte) (cipher.AEAD, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if aead, ok := p.sessions[name]; ok {
+		return aead, nil
+	}
+	public, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := p.config.Key.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	own := p.config.Key.PublicKey().Bytes()
+	salt := append(bytes.Clone(own), key...)
+	if bytes.Compare(own, key) > 0 {
+		salt = append(bytes.Clone(key), own...)
+	}
+	secret, err := hkdf.Key(sha256.New, shared, salt, "relay e2e", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	p.sessions[name] = aead
+	return aead, nil
+}
+
+// learn - pin the key of name and wake up whoever waits for it
+func (p *securePeer) learn(name string, key []byte) error {
+	err := p.config.Pins.Pin(name, key)
+	p.mu.Lock()
+	waiting := p.waiting[name]
+	delete(p.waiting, name)
+	p.mu.Unlock()
+	for _, done := range waiting {
+		done <- err
+	}
+	return err
+}
+
+// forget - stop waiting for the key of name on done
+func (p *securePeer) forget(name string, done chan error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	waiting := slices.DeleteFunc(p.waiting[name], func(c chan error) bool {
+		return c == done
+	})
+	if len(waiting) == 0 {
+		delete(p.waiting, name)
+	} else {
+		p.waiting[name] = waiting
+	}
+}
+
+// keyOf - pinned key of name, or ask name for its key
+func (p *securePeer) keyOf(ctx context.Context, name string) ([]byte, error) {
+	if key, ok := p.config.Pins.Get(name); ok {
+		return key, nil
+	}
+	done := make(chan error, 1)
+	p.mu.Lock()
+	p.waiting[name] = append(p.waiting[name], done)
+	p.mu.Unlock()
+	if err := p.Peer.Write(&relay_pb.Message{
+		Kind:     relay_pb.Kind_KEY_REQUEST,
+		Receiver: name,
+		Payload:  p.config.Key.PublicKey().Bytes(),
+	}); err != nil {
+		p.forget(name, done)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.KeyTimeout)
+	defer cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		p.forget(name, done)
+		return nil, fmt.Errorf("%w: %s: %w", ErrNoKey, name, ctx.Err())
+	}
+	key, _ := p.config.Pins.Get(name)
+	return key, nil
+}
+
+func additionalData(sender string, receiver string) []byte {
+	return []byte(sender + "\x00" + receiver)
+}
+
+// seal - encrypt the payload of m for its receiver, nonce first
+func (p *securePeer) seal(ctx context.Context, m *relay_pb.Message) error {
+	if m.Receiver == "" || m.Topic != "" || m.Broadcast {
+		return nil
+	}
+	key, err := p.keyOf(ctx, m.Receiver)
+	if err != nil {
+		return err
+	}
+	aead, err := p.session(m.Receiver, key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	m.Payload = aead.Seal(nonce, nonce, m.Payload, additionalData(p.Name(), m.Receiver))
+	m.Encrypted = true
+	return nil
+}
+
+func (p *securePeer) open(m *relay_pb.Message) error {
+	key, ok := p.config.Pins.Get(m.Sender)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoKey, m.Sender)
+	}
+	aead, err := p.session(m.Sender, key)
+	if err != nil {
+		return err
+	}
+	if len(m.Payload) < aead.NonceSize() {
+		return ErrDecrypt
+	}
+	nonce, sealed := m.Payload[:aead.NonceSize()], m.Payload[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, sealed, additionalData(m.Sender, p.Name()))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	m.Payload = payload
+	m.Encrypted = false
+	return nil
+}
+
+func (p *securePeer) Write(m *relay_pb.Message) error {
+	if err := p.seal(context.Background(), m); err != nil {
+		return err
+	}
+	return p.Peer.Write(m)
+}
+
+func (p *securePeer) Send(ctx context.Context, m *relay_pb.Message) error {
+	if err := p.seal(ctx, m); err != nil {
+		return err
+	}
+	return p.Peer.Send(ctx, m)
+}
+
+// DialAndServe - answer key requests and open sealed payloads before serve
+func (p *securePeer) DialAndServe(serve func(m *relay_pb.Message)) error {
+	return p.Peer.DialAndServe(func(m *relay_pb.Message) {
+		switch {
+		case m.Kind == relay_pb.Kind_KEY_REQUEST:
+			if err := p.learn(m.Sender, m.Payload); err != nil {
+				fmt.Printf("[peer_%s] key error: %v\n", p.Name(), err)
+				return
+			}
+			_ = p.Peer.Write(&relay_pb.Message{
+				Kind:     relay_pb.Kind_KEY,
+				Receiver: m.Sender,
+				Payload:  p.config.Key.PublicKey().Bytes(),
+			})
+		case m.Kind == relay_pb.Kind_KEY:
+			if err := p.learn(m.Sender, m.Payload); err != nil {
+				fmt.Printf("[peer_%s] key error: %v\n", p.Name(), err)
+			}
+		case m.Kind == relay_pb.Kind_PRESENCE:
+			serve(m)
+		case m.Kind != relay_pb.Kind_DATA:
+		case m.Encrypted:
+			if err := p.open(m); err != nil {
+				fmt.Printf("[peer_%s] message from %s dropped: %v\n", p.Name(), m.Sender, err)
+				return
+			}
+			serve(m)
+		case m.Topic != "" || m.Broadcast:
+			serve(m)
+		default:
+			fmt.Printf("[peer_%s] message from %s dropped: not sealed\n", p.Name(), m.Sender)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package relay_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func connectSecure(t *testing.T, hubAddr string, name string, config relay.SecureConfig) *testPeer {
+	config.KeyTimeout = 200 * time.Millisecond
+	tp := connectWith(t, hubAddr, name, nil, func(p relay.Peer) relay.Peer {
+		return relay.NewSecurePeer(p, config)
+	})
+	if err := waitRegistered(t, tp); err != nil {
+		t.Fatal(err)
+	}
+	return tp
+}
+
+func TestSecurePeer(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice := connectSecure(t, addr, "alice", relay.DefaultSecureConfig(newKey(t)))
+	bob := connectSecure(t, addr, "bob", relay.DefaultSecureConfig(newKey(t)))
+
+	m := &relay_pb.Message{Receiver: "bob", Payload: []byte("secret")}
+	if err := alice.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Encrypted || string(m.Payload) == "secret" {
+		t.Fatal("payload must be sealed before it leaves the peer")
+	}
+	if m := receive(t, bob.received); string(m.Payload) != "secret" || m.Sender != "alice" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if err := send(bob, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, alice.received); string(m.Payload) != "hi" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	// a plain direct message is dropped
+	plain := connect(t, addr, "mallory", nil)
+	if err := waitRegistered(t, plain); err != nil {
+		t.Fatal(err)
+	}
+	_ = plain.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte("plain")})
+	expectNothing(t, bob.received)
+}
+
+func TestHubKeyACL(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.ACL = relay.ACLFromMap(map[string][]string{"alice": {"bob"}})
+	addr := startHub(t, config)
+	_, aliceReceived := mustRegister(t, addr, "alice")
+	bob, _ := mustRegister(t, addr, "bob")
+	mallory, _ := mustRegister(t, addr, "mallory")
+
+	// only a peer the receiver may send to can answer with a key
+	_ = mallory.Write(&relay_pb.Message{Kind: relay_pb.Kind_KEY, Receiver: "alice", Payload: []byte("smuggled")})
+	expectNothing(t, aliceReceived)
+	_ = bob.Write(&relay_pb.Message{Kind: relay_pb.Kind_KEY, Receiver: "alice", Payload: []byte("key")})
+	if m := receive(t, aliceReceived); m.Kind != relay_pb.Kind_KEY || m.Sender != "bob" {
+		t.Fatalf("unexpected message %v", m)
+	}
+}
+
+func TestSecurePeerPinning(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	path := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := relay.NewFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := relay.DefaultSecureConfig(newKey(t))
+	config.Pins = pins
+	alice := connectSecure(t, addr, "alice", config)
+	bob := connectSecure(t, addr, "bob", relay.DefaultSecureConfig(newKey(t)))
+	if err := bob.Write(&relay_pb.Message{Receiver: "alice", Payload: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, alice.received)
+	_ = bob.Close()
+	waitState(t, bob, relay.PeerClosed)
+
+	// whoever gets the name bob next, with another key, is not trusted
+	impostor := connectSecure(t, addr, "bob", relay.DefaultSecureConfig(newKey(t)))
+	if err := impostor.Write(&relay_pb.Message{Receiver: "alice", Payload: []byte("hi")}); !errors.Is(err, relay.ErrNoKey) {
+		t.Fatalf("expected no key, got %v", err)
+	}
+	_ = alice.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte("secret")})
+	expectNothing(t, impostor.received)
+
+	// pins survive a restart
+	pins, err = relay.NewFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Pin("bob", newKey(t).PublicKey().Bytes()); !errors.Is(err, relay.ErrKeyMismatch) {
+		t.Fatalf("expected key mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,421 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrLinkRejected = errors.New("link_rejected")
+	ErrLinked       = errors.New("linked")
+)
+
+const (
+	DEFAULT_REDIAL_BACKOFF = time.Second
+	MAX_HOPS               = 16
+	floodMemory            = time.Minute
+)
+
+// FederationConfig - hubs linked to each other gossip which peer is connected where and forward messages between them
+type FederationConfig struct {
+	Name          string        // of this hub, unique among linked hubs
+	Links         []string      // addresses of hubs to dial
+	Auth          Authenticator // of hubs dialing in, nil refuses every hub
+	Credential    Credential    // answers the challenge of dialed hubs
+	RedialBackoff time.Duration
+}
+
+func (c FederationConfig) enabled() bool {
+	return c.Name != ""
+}
+
+// link - connection to a neighbour hub, writes never wait so that two hubs forwarding to each other cannot block both read loops
+// a forwarded message that does not fit is nacked, routes that do not fit reset the link, which exchanges every route again once redialed
+type link struct {
+	hub  string
+	conn *net.TCPConn
+	out  *outbox
+}
+
+func newLink(hub string, conn *net.TCPConn, config OutboundConfig) *link {
+	config.Policy = OverflowDrop
+	return &link{hub: hub, conn: conn, out: newOutbox(conn, config)}
+}
+
+func (l *link) write(m *relay_pb.Message) error {
+	return l.out.send(m)
+}
+
+// reset - close the link, its read loop withdraws what was learned from it
+func (l *link) reset() {
+	l.out.close()
+	_ = l.conn.Close()
+}
+
+// routeEntry - latest route of a peer on a hub, learned from link, nil link for peers of this hub
+type routeEntry struct {
+	route *relay_pb.Route
+	link  *link
+}
+
+// routeTable - routes by peer name then hub
+// versions start at the boot time in nanoseconds so that routes of a restarted hub are newer than those of its previous run
+type routeTable struct {
+	mu      sync.Mutex
+	version uint64
+	entries map[string]map[string]*routeEntry
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		version: uint64(time.Now().UnixNano()),
+		entries: make(map[string]map[string]*routeEntry),
+	}
+}
+
+func (t *routeTable) set(r *relay_pb.Route, l *link) {
+	if t.entries[r.Name] == nil {
+		t.entries[r.Name] = make(map[string]*routeEntry)
+	}
+	t.entries[r.Name][r.Hub] = &routeEntry{route: r, link: l}
+}
+
+// local - peer name connected to or disconnected from hub, return the route to gossip
+func (t *routeTable) local(hub string, name string, connected bool) *relay_pb.Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.version++
+	r := &relay_pb.Route{Name: name, Hub: hub, Connected: connected, Version: t.version}
+	t.set(r, nil)
+	return r
+}
+
+// learn - whether r is newer than what is known about its peer on its hub
+// a route withdrawn by the link it was learned from is newer than the route
+func (t *routeTable) learn(r *relay_pb.Route, l *link) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[r.Name][r.Hub]; ok {
+		withdrawn := e.route.Version == r.Version && e.route.Connected && !r.Connected && e.link == l
+		if e.link == nil || (e.route.Version >= r.Version && !withdrawn) {
+			return false
+		}
+	}
+	t.set(r, l)
+	return true
+}
+
+// connected - whether name is connected to hub as far as this hub knows
+func (t *routeTable) connected(hub string, name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[name][hub]
+	return ok && e.route.Connected
+}
+
+// next - link toward another hub where name is connected
+func (t *routeTable) next(name string) *link {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range t.entries[name] {
+		if e.route.Connected && e.link != nil {
+			return e.link
+		}
+	}
+	return nil
+}
+
+// forget - routes learned from l are no longer reachable, return them withdrawn to gossip
+func (t *routeTable) forget(l *link) []*relay_pb.Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var withdrawn []*relay_pb.Route
+	for _, hubs := range t.entries {
+		for hub, e := range hubs {
+			if e.link != l {
+				continue
+			}
+			delete(hubs, hub)
+			if e.route.Connected {
+				r := proto.Clone(e.route).(*relay_pb.Route)
+				r.Connected = false
+				withdrawn = append(withdrawn, r)
+			}
+		}
+	}
+	return withdrawn
+}
+
+func (t *routeTable) snapshot() []*relay_pb.Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var routes []*relay_pb.Route
+	for _, hubs := range t.entries {
+		for _, e := range hubs {
+			routes = append(routes, e.route)
+		}
+	}
+	return routes
+}
+
+// floodSet - topic and broadcast messages seen recently, by origin hub and flood number
+type floodSet struct {
+	mu   sync.Mutex
+	last uint64
+	seen map[string]time.Time
+}
+
+func newFloodSet() *floodSet {
+	return &floodSet{seen: make(map[string]time.Time)}
+}
+
+func (f *floodSet) next() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last++
+	return f.last
+}
+
+// see - whether the message is seen for the first time
+func (f *floodSet) see(origin string, flood uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	key := fmt.Sprintf("%s/%d", origin, flood)
+	if _, ok := f.seen[key]; ok {
+		return false
+	}
+	f.seen[key] = now
+	if len(f.seen) > 1024 {
+		for k, t := range f.seen {
+			if now.Sub(t) > floodMemory {
+				delete(f.seen, k)
+			}
+		}
+	}
+	return true
+}
+
+// gossip - send routes to every link but except
+func (h *hub) gossip(routes []*relay_pb.Route, except *link) {
+	if len(routes) == 0 {
+		return
+	}
+	h.links.Range(func(key, val any) bool {
+		if l := val.(*link); l != except {
+			if err := l.write(&relay_pb.Message{Kind: relay_pb.Kind_GOSSIP, Routes: routes}); errors.Is(err, ErrQueueFull) {
+				log.Printf("hub [%s|%s] routes dropped, resetting the link\n", l.hub, l.conn.RemoteAddr().String())
+				l.reset()
+			}
+		}
+		return true
+	})
+}
+
+// announce - tell linked hubs that name connected to or disconnected from this hub
+func (h *hub) announce(name string, connected bool) {
+	if !h.config.Federation.enabled() {
+		return
+	}
+	h.gossip([]*relay_pb.Route{h.routes.local(h.config.Federation.Name, name, connected)}, nil)
+}
+
+// forward - send m to the hub at the other end of l
+func (h *hub) forward(l *link, m *relay_pb.Message) error {
+	if slices.Contains(m.Via, l.hub) || len(m.Via) >= MAX_HOPS {
+		return ErrUnknownReceiver
+	}
+	f := proto.Clone(m).(*relay_pb.Message)
+	f.Via = append(f.Via, h.config.Federation.Name)
+	return l.write(f)
+}
+
+// flood - fan m out to local peers and forward it to every linked hub it has not been through
+func (h *hub) flood(m *relay_pb.Message, match func(s *session) bool) {
+	if h.config.Federation.enabled() {
+		if len(m.Via) == 0 {
+			m.Flood = h.floods.next()
+			h.floods.see(h.config.Federation.Name, m.Flood)
+		} else if !h.floods.see(m.Via[0], m.Flood) {
+			return
+		}
+		h.links.Range(func(key, val any) bool {
+			_ = h.forward(val.(*link), m)
+			return true
+		})
+	}
+	h.fanOut(m, match)
+}
+
+// dialLinks - keep a link to every configured hub until ctx is done
+func (h *hub) dialLinks(ctx context.Context) {
+	for _, addr := range h.config.Federation.Links {
+		go func(addr string) {
+			for ctx.Err() == nil {
+				if err := h.dialLink(ctx, addr); err != nil {
+					log.Printf("link [%s] error: %v\n", addr, err)
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(h.config.Federation.RedialBackoff):
+				}
+			}
+		}(addr)
+	}
+}
+
+func (h *hub) dialLink(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: h.config.HandshakeTimeout}
+	c, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn := c.(*net.TCPConn)
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(h.config.HandshakeTimeout))
+	_, m, err := readAndUnmarshal(conn, h.config.MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if m.Kind != relay_pb.Kind_CHALLENGE {
+		return fmt.Errorf("%w: unexpected %s", ErrLinkRejected, m.Kind)
+	}
+	var credential []byte
+	if h.config.Federation.Credential != nil {
+		credential = h.config.Federation.Credential(m.Payload)
+	}
+	if err := marshalAndWrite(conn, &relay_pb.Message{
+		Kind:    relay_pb.Kind_LINK,
+		Sender:  h.config.Federation.Name,
+		Payload: credential,
+	}); err != nil {
+		return err
+	}
+	_, m, err = readAndUnmarshal(conn, h.config.MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if m.Kind != relay_pb.Kind_ACCEPT {
+		return fmt.Errorf("%w: %s", ErrLinkRejected, string(m.Payload))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	l := newLink(m.Sender, conn, h.config.Outbound)
+	if _, loaded := h.links.LoadOrStore(l.hub, l); loaded {
+		l.out.close()
+		return ErrLinked
+	}
+	return h.serveLink(l)
+}
+
+// acceptLink - verify a hub dialing in
+func (h *hub) acceptLink(conn *net.TCPConn, challenge []byte, m *relay_pb.Message) (*link, error) {
+	auth := h.config.Federation.Auth
+	if !h.config.Federation.enabled() || auth == nil || !auth(m.Sender, challenge, m.Payload) {
+		return nil, ErrUnauthenticated
+	}
+	if m.Sender == h.config.Federation.Name {
+		return nil, ErrLinked
+	}
+	l := newLink(m.Sender, conn, h.config.Outbound)
+	if _, loaded := h.links.LoadOrStore(l.hub, l); loaded {
+		l.out.close()
+		return nil, ErrLinked
+	}
+	if err := l.write(&relay_pb.Message{
+		Kind:   relay_pb.Kind_ACCEPT,
+		Sender: h.config.Federation.Name,
+	}); err != nil {
+		l.out.close()
+		h.links.CompareAndDelete(l.hub, l)
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveLink - l is stored in links, exchange every known route then route messages from the neighbour hub
+func (h *hub) serveLink(l *link) error {
+	log.Printf("hub [%s|%s] has been linked\n", l.hub, l.conn.RemoteAddr().String())
+	defer func() {
+		l.out.close()
+		h.links.CompareAndDelete(l.hub, l)
+		withdrawn := h.routes.forget(l)
+		h.gossip(withdrawn, l)
+		for _, r := range withdrawn {
+			h.presence(r.Name, false)
+		}
+		log.Printf("hub [%s|%s] has been unlinked\n", l.hub, l.conn.RemoteAddr().String())
+	}()
+	if err := l.write(&relay_pb.Message{Kind: relay_pb.Kind_GOSSIP, Routes: h.routes.snapshot()}); err != nil {
+		return err
+	}
+	for {
+		_, m, err := readAndUnmarshal(l.conn, h.config.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(m.Via, h.config.Federation.Name) {
+			continue // loop
+		}
+		switch {
+		case m.Kind == relay_pb.Kind_GOSSIP:
+			h.learn(l, m.Routes)
+		case m.Kind == relay_pb.Kind_ACK || m.Kind == relay_pb.Kind_NACK,
+			m.Kind == relay_pb.Kind_KEY || m.Kind == relay_pb.Kind_KEY_REQUEST,
+			m.Kind == relay_pb.Kind_DIRECT_OFFER || m.Kind == relay_pb.Kind_DIRECT_ANSWER:
+			_ = h.deliver(m)
+		case m.Kind != relay_pb.Kind_DATA:
+			continue
+		case m.Broadcast:
+			h.flood(m, func(*session) bool {
+				return true
+			})
+		case m.Topic != "":
+			h.flood(m, func(s *session) bool {
+				return s.subscribed(m.Topic)
+			})
+		default:
+			if err := h.deliver(m); err != nil {
+				h.nack(m, err)
+			}
+		}
+	}
+}
+
+// learn - keep new routes, pass them on and forward what was queued for peers that became reachable
+// routes of this hub that are wrong, withdrawn by a link or left by a previous run, are corrected with a newer one
+func (h *hub) learn(l *link, routes []*relay_pb.Route) {
+	var learned, corrected []*relay_pb.Route
+	for _, r := range routes {
+		if r.Hub == h.config.Federation.Name {
+			if connected := h.routes.connected(r.Hub, r.Name); connected != r.Connected {
+				corrected = append(corrected, h.routes.local(r.Hub, r.Name, connected))
+			}
+			continue
+		}
+		if h.routes.learn(r, l) {
+			learned = append(learned, r)
+		}
+	}
+	h.gossip(corrected, nil)
+	h.gossip(learned, l)
+	for _, r := range learned {
+		h.presence(r.Name, r.Connected)
+		if r.Connected {
+			_ = h.flushQueue(r.Name, h.deliver)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package relay_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// startMesh - one hub per name, hub i dials the hubs links[i]
+func startMesh(t *testing.T, names []string, links map[string][]string) map[string]string {
+	addrs := make(map[string]string)
+	for _, name := range names {
+		addrs[name] = freeAddr(t)
+	}
+	for _, name := range names {
+		startHubAt(t, addrs[name], meshConfig(name, addrs, links[name]))
+	}
+	return addrs
+}
+
+// meshConfig - config of the hub name in a mesh, it dials the hubs links
+func meshConfig(name string, addrs map[string]string, links []string) relay.HubConfig {
+	config := relay.DefaultHubConfig()
+	config.Federation.Name = name
+	config.Federation.Auth = relay.SharedTokenAuth("secret")
+	config.Federation.Credential = relay.TokenCredential("secret")
+	config.Federation.RedialBackoff = 10 * time.Millisecond
+	for _, other := range links {
+		config.Federation.Links = append(config.Federation.Links, addrs[other])
+	}
+	return config
+}
+
+// registerEventually - register name at hubAddr once the mesh has noticed that it left another hub
+func registerEventually(t *testing.T, hubAddr string, name string) (*testPeer, error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		tp := connect(t, hubAddr, name, nil)
+		if err = waitRegistered(t, tp); err == nil {
+			return tp, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func TestFederationLine(t *testing.T) {
+	addrs := startMesh(t, []string{"a", "b", "c"}, map[string][]string{
+		"a": {"b"},
+		"c": {"b"},
+	})
+	alice, aliceReceived := mustRegister(t, addrs["a"], "alice")
+	carol, carolReceived := mustRegister(t, addrs["c"], "carol")
+
+	// queued on a until the route to carol is gossiped, then acked through b
+	if err := send(alice, "carol", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, carolReceived); m.Sender != "alice" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	if err := send(carol, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, aliceReceived)
+
+	_ = carol.Subscribe("news.>")
+	time.Sleep(50 * time.Millisecond)
+	_ = alice.Write(&relay_pb.Message{Topic: "news.sport", Payload: []byte("goal")})
+	if m := receive(t, carolReceived); m.Topic != "news.sport" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	// a name is owned mesh wide
+	thief := connect(t, addrs["b"], "alice", nil)
+	if err := waitRegistered(t, thief); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected name to be taken, got %v", err)
+	}
+}
+
+func TestFederationLoop(t *testing.T) {
+	addrs := startMesh(t, []string{"a", "b", "c"}, map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+	})
+	alice, aliceReceived := mustRegister(t, addrs["a"], "alice")
+	bob, bobReceived := mustRegister(t, addrs["b"], "bob")
+	carol, carolReceived := mustRegister(t, addrs["c"], "carol")
+	for _, p := range []relay.Peer{bob, carol} {
+		if err := send(p, "alice", 3*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, aliceReceived)
+	}
+
+	// every peer gets a broadcast once whatever the number of paths
+	_ = alice.Write(&relay_pb.Message{Broadcast: true, Payload: []byte("hello")})
+	receive(t, bobReceived)
+	receive(t, carolReceived)
+	expectNothing(t, bobReceived)
+	expectNothing(t, carolReceived)
+	expectNothing(t, aliceReceived)
+}
+
+func TestFederationAuth(t *testing.T) {
+	addr := freeAddr(t)
+	config := relay.DefaultHubConfig()
+	config.Federation.Name = "a"
+	config.Federation.Auth = relay.TokenAuth(map[string]string{"b": "secret"})
+	startHubAt(t, addr, config)
+
+	config = relay.DefaultHubConfig()
+	config.Federation.Name = "b"
+	config.Federation.Links = []string{addr}
+	config.Federation.Credential = relay.TokenCredential("guess")
+	other := startHub(t, config)
+
+	alice, _ := mustRegister(t, addr, "alice")
+	mustRegister(t, other, "bob")
+	if err := send(alice, "bob", 200*time.Millisecond); !errors.Is(err, relay.ErrNoAck) {
+		t.Fatalf("hubs must not be linked, got %v", err)
+	}
+}
+
+func TestFederationHubGone(t *testing.T) {
+	addrs := map[string]string{"a": freeAddr(t), "b": freeAddr(t), "c": freeAddr(t)}
+	links := map[string][]string{"a": {"b"}, "c": {"b"}}
+	a := runHub(t, addrs["a"], meshConfig("a", addrs, links["a"]))
+	startHubAt(t, addrs["b"], meshConfig("b", addrs, links["b"]))
+	startHubAt(t, addrs["c"], meshConfig("c", addrs, links["c"]))
+	alice := connect(t, addrs["a"], "alice", nil)
+	if err := waitRegistered(t, alice); err != nil {
+		t.Fatal(err)
+	}
+	carol, carolReceived := mustRegister(t, addrs["c"], "carol")
+	if err := send(carol, "alice", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// routes through a are withdrawn mesh wide once a goes away
+	_ = alice.Close()
+	_ = a.Close()
+	moved, err := registerEventually(t, addrs["c"], "alice")
+	if err != nil {
+		t.Fatalf("alice must be able to move to c, got %v", err)
+	}
+	if err := send(moved, "carol", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, carolReceived)
+	_ = moved.Close()
+
+	// the routes of a restarted a are newer than those it had before
+	startHubAt(t, addrs["a"], meshConfig("a", addrs, links["a"]))
+	back, err := registerEventually(t, addrs["a"], "alice")
+	if err != nil {
+		t.Fatalf("alice must be able to come back to a, got %v", err)
+	}
+	if err := send(carol, "alice", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, back.received); m.Sender != "carol" {
+		t.Fatalf("unexpected message %v", m)
+	}
+}
+
+func writeFrame(t *testing.T, conn net.Conn, m *relay_pb.Message) {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(b)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrame(t *testing.T, conn net.Conn) *relay_pb.Message {
+	size := make([]byte, 8)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, binary.LittleEndian.Uint64(size))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	m := &relay_pb.Message{}
+	if err := proto.Unmarshal(b, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestFederationStalledLink - a hub that stops reading its link never stalls the hub forwarding to it
+func TestFederationStalledLink(t *testing.T) {
+	config := meshConfig("a", nil, nil)
+	config.Outbound.Size = 4
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+	_, bobReceived := mustRegister(t, addr, "bob")
+
+	// a hub where zed is connected, it links to a and never reads again
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	challenge := readFrame(t, conn)
+	writeFrame(t, conn, &relay_pb.Message{Kind: relay_pb.Kind_LINK, Sender: "z", Payload: relay.TokenCredential("secret")(challenge.Payload)})
+	if m := readFrame(t, conn); m.Kind != relay_pb.Kind_ACCEPT {
+		t.Fatalf("link rejected: %v", m)
+	}
+	writeFrame(t, conn, &relay_pb.Message{Kind: relay_pb.Kind_GOSSIP, Routes: []*relay_pb.Route{{Name: "zed", Hub: "z", Connected: true, Version: 1}}})
+	time.Sleep(100 * time.Millisecond)
+
+	payload := make([]byte, 64<<10)
+	for i := 0; i < 400; i++ {
+		if err := alice.Write(&relay_pb.Message{Receiver: "zed", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := send(alice, "zed", 5*time.Second); !errors.Is(err, relay.ErrQueueFull) {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobReceived)
+}
@@ -1,80 +1,490 @@
 package relay
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+var (
+	ErrNameTaken        = errors.New("name_taken")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrNotRegistered    = errors.New("not_registered")
+	ErrRegisterRejected = errors.New("register_rejected")
 )
 
+const DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Hub - Peers lists the peers connected to this hub, Disconnect closes the connection of a peer
 type Hub interface {
 	ListenAndServe() error
 	Close() error
+	Peers() []PeerInfo
+	Disconnect(name string) bool
+}
+
+// HubConfig - Auth decides who owns a name, ACL decides who may send to whom
+// Queue keeps messages for receivers that are not connected, Federation links hubs with each other
+// Outbound bounds what is waiting to be written to each connection, a peer sending a frame larger than MaxFrameSize is disconnected
+// a zero field takes the value of DefaultHubConfig, but for Queue.Storage and Federation where zero means disabled
+type HubConfig struct {
+	Auth             Authenticator
+	ACL              ACL
+	HandshakeTimeout time.Duration
+	Queue            QueueConfig
+	Federation       FederationConfig
+	Outbound         OutboundConfig
+	MaxFrameSize     int
+}
+
+// DefaultHubConfig - names are first come first served and everyone may send to everyone
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		Auth:             AllowAll,
+		ACL:              AllowAllACL,
+		HandshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+		Queue:            DefaultQueueConfig(),
+		Federation: FederationConfig{
+			RedialBackoff: DEFAULT_REDIAL_BACKOFF,
+		},
+		Outbound:     DefaultOutboundConfig(),
+		MaxFrameSize: DEFAULT_MAX_FRAME_SIZE,
+	}
 }
 
-func NewHub(listenAddr string) (Hub, error) {
+// withDefaults - zero fields set from DefaultHubConfig
+func (c HubConfig) withDefaults() HubConfig {
+	d := DefaultHubConfig()
+	if c.Auth == nil {
+		c.Auth = d.Auth
+	}
+	if c.ACL == nil {
+		c.ACL = d.ACL
+	}
+	setDefault(&c.HandshakeTimeout, d.HandshakeTimeout)
+	setDefault(&c.Queue.TTL, d.Queue.TTL)
+	setDefault(&c.Queue.MaxMessages, d.Queue.MaxMessages)
+	setDefault(&c.Queue.MaxBytes, d.Queue.MaxBytes)
+	setDefault(&c.Queue.MaxQueues, d.Queue.MaxQueues)
+	setDefault(&c.Queue.TotalBytes, d.Queue.TotalBytes)
+	setDefault(&c.Federation.RedialBackoff, d.Federation.RedialBackoff)
+	setDefault(&c.Outbound.Size, d.Outbound.Size)
+	setDefault(&c.MaxFrameSize, d.MaxFrameSize)
+	return c
+}
+
+func NewHub(listenAddr string, config HubConfig) (Hub, error) {
+	config = config.withDefaults()
 	listen, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		return nil, err
 	}
+	var store *queueStore
+	if config.Queue.Storage != nil {
+		store = newQueueStore(config.Queue)
+	}
 	return &hub{
+		config:  config,
 		listen:  listen,
 		ln:      nil,
 		connMap: sync.Map{},
+		store:   store,
+		links:   sync.Map{},
+		routes:  newRouteTable(),
+		floods:  newFloodSet(),
 	}, nil
 }
 
 type hub struct {
+	config  HubConfig
 	listen  *net.TCPAddr
-	ln      *net.TCPListener
-	connMap sync.Map // map[name]*net.TCPAddr
+	mu      sync.Mutex
+	ln      *net.TCPListener   // protected by mu
+	cancel  context.CancelFunc // protected by mu, stops what the current ListenAndServe started
+	connMap sync.Map           // map[name]*session
+	store   *queueStore        // nil if store-and-forward is disabled
+	links   sync.Map           // map[hub name]*link
+	routes  *routeTable
+	floods  *floodSet
 }
 
-func (h *hub) ListenAndServe() (err error) {
-	h.ln, err = net.ListenTCP("tcp", h.listen)
+// session - registered connection, writes go through its outbox in order
+type session struct {
+	name          string
+	conn          *net.TCPConn
+	out           *outbox
+	connectedAt   time.Time
+	received      atomic.Uint64
+	receivedBytes atomic.Uint64
+	mu            sync.Mutex
+	subMu         sync.Mutex
+	patterns      map[string]struct{} // protected by subMu
+}
+
+func (s *session) subscribe(pattern string, subscribe bool) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if subscribe {
+		s.patterns[pattern] = struct{}{}
+	} else {
+		delete(s.patterns, pattern)
+	}
+}
+
+func (s *session) subscribed(topic string) bool {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for pattern := range s.patterns {
+		if MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) info() PeerInfo {
+	return PeerInfo{
+		Name:        s.name,
+		Addr:        s.conn.RemoteAddr().String(),
+		ConnectedAt: s.connectedAt,
+		MessagesIn:  s.received.Load(),
+		BytesIn:     s.receivedBytes.Load(),
+		MessagesOut: s.out.sent.Load(),
+		BytesOut:    s.out.sentBytes.Load(),
+		Dropped:     s.out.dropped.Load(),
+	}
+}
+
+func (s *session) write(m *relay_pb.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.send(m)
+}
+
+// push - write m whatever the overflow policy, for messages that were already accepted by the hub
+func (s *session) push(m *relay_pb.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.push(m)
+}
+
+// ListenAndServe - the hub can serve again after Close
+func (h *hub) ListenAndServe() error {
+	ln, err := net.ListenTCP("tcp", h.listen)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.mu.Lock()
+	h.ln, h.cancel = ln, cancel
+	h.mu.Unlock()
 
-	log.Printf("listenning to %s\n", h.listen.String())
+	if h.store != nil {
+		go h.store.run(ctx)
+	}
+	if h.config.Federation.enabled() {
+		h.dialLinks(ctx)
+	}
+	log.Printf("listenning to %s\n", ln.Addr().String())
 	for {
-		conn, err := h.ln.AcceptTCP()
+		conn, err := ln.AcceptTCP()
 		if err != nil {
 			return err
 		}
-		go h.handle(conn)
+		go h.handle(ctx, conn)
 	}
 }
+
+// Close - stop listening and close every connection
 func (h *hub) Close() error {
-	return h.ln.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ln == nil {
+		return nil
+	}
+	h.cancel()
+	ln := h.ln
+	h.ln = nil
+	return ln.Close()
 }
 
-func (h *hub) handle(conn *net.TCPConn) {
-	var name string = ""
-	defer func() {
+func (h *hub) Peers() []PeerInfo {
+	var peers []PeerInfo
+	h.connMap.Range(func(key, val any) bool {
+		peers = append(peers, val.(*session).info())
+		return true
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+func (h *hub) Disconnect(name string) bool {
+	val, ok := h.connMap.Load(name)
+	if !ok {
+		return false
+	}
+	log.Printf("peer [%s] is being disconnected\n", name)
+	_ = val.(*session).conn.Close() // servePeer cleans up
+	return true
+}
+
+// challenge - send a nonce and read the answer of a peer or a hub
+func (h *hub) challenge(conn *net.TCPConn) ([]byte, *relay_pb.Message, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, nil, err
+	}
+	if err := marshalAndWrite(conn, &relay_pb.Message{
+		Kind:    relay_pb.Kind_CHALLENGE,
+		Payload: challenge,
+	}); err != nil {
+		return nil, nil, err
+	}
+	_, m, err := readAndUnmarshal(conn, h.config.MaxFrameSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return challenge, m, nil
+}
+
+func reject(conn *net.TCPConn, err error) error {
+	_ = marshalAndWrite(conn, &relay_pb.Message{
+		Kind:    relay_pb.Kind_REJECT,
+		Payload: []byte(err.Error()),
+	})
+	return err
+}
+
+// register - verify the credential of the peer and claim its name
+func (h *hub) register(conn *net.TCPConn, challenge []byte, m *relay_pb.Message) (*session, error) {
+	if m.Sender == "" {
+		return nil, ErrNotRegistered
+	}
+	if !h.config.Auth(m.Sender, challenge, m.Payload) {
+		return nil, ErrUnauthenticated
+	}
+	if h.routes.next(m.Sender) != nil {
+		return nil, ErrNameTaken // connected to another hub
+	}
+	s := &session{name: m.Sender, conn: conn, connectedAt: time.Now(), patterns: make(map[string]struct{})}
+	// hold the session until queued messages are in its outbox so that they come before new ones
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, loaded := h.connMap.LoadOrStore(s.name, s); loaded {
+		return nil, ErrNameTaken
+	}
+	s.out = newOutbox(conn, h.config.Outbound)
+	if err := s.out.push(&relay_pb.Message{Kind: relay_pb.Kind_ACCEPT}); err != nil {
+		s.out.close()
+		h.connMap.CompareAndDelete(s.name, s)
+		return nil, err
+	}
+	if err := h.flushQueue(s.name, s.out.push); err != nil {
+		s.out.close()
+		h.connMap.CompareAndDelete(s.name, s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// flushQueue - write the messages queued for receiver
+func (h *hub) flushQueue(receiver string, write func(m *relay_pb.Message) error) error {
+	if h.store == nil {
+		return nil
+	}
+	messages, err := h.store.take(receiver)
+	for _, m := range messages {
+		if err := write(m); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// fanOut - write m to every other connected peer the sender may send to and match accepts
+// topic and broadcast messages are not queued for peers that are not connected
+func (h *hub) fanOut(m *relay_pb.Message, match func(s *session) bool) {
+	h.connMap.Range(func(key, val any) bool {
+		s := val.(*session)
+		if s.name != m.Sender && h.config.ACL(m.Sender, s.name) && match(s) {
+			_ = s.write(m)
+		}
+		return true
+	})
+}
+
+// presence - tell the peers subscribed to presence topics that name joined or left, if they may send to it
+func (h *hub) presence(name string, joined bool) {
+	topic := PresenceLeave
+	if joined {
+		topic = PresenceJoin
+	}
+	m := &relay_pb.Message{Kind: relay_pb.Kind_PRESENCE, Sender: name, Topic: topic}
+	h.connMap.Range(func(key, val any) bool {
+		s := val.(*session)
+		if s.name != name && h.config.ACL(s.name, name) && s.subscribed(topic) {
+			_ = s.write(m)
+		}
+		return true
+	})
+}
+
+// deliver - write m to its receiver, forward it to the hub of its receiver
+// or queue it if the receiver is not connected, acks and nacks are not queued
+func (h *hub) deliver(m *relay_pb.Message) error {
+	if val, loaded := h.connMap.Load(m.Receiver); loaded {
+		err := val.(*session).write(m)
+		if errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWriteFailed, err)
+		}
+		return nil
+	}
+	if l := h.routes.next(m.Receiver); l != nil {
+		return h.forward(l, m)
+	}
+	if h.store == nil || m.Kind != relay_pb.Kind_DATA {
+		return ErrUnknownReceiver // only data is queued
+	}
+	if err := h.store.push(m); err != nil {
+		if !errors.Is(err, ErrUnknownReceiver) {
+			log.Printf("message [%s->%s] has been dropped: %v\n", m.Sender, m.Receiver, err)
+		}
+		return err
+	}
+	// the receiver may have registered and flushed its queue in the meantime
+	if val, loaded := h.connMap.Load(m.Receiver); loaded {
+		_ = h.flushQueue(m.Receiver, val.(*session).push)
+	}
+	return nil
+}
+
+// nack - tell the sender that m was not delivered, if it gave m an id
+func (h *hub) nack(m *relay_pb.Message, err error) {
+	if m.Id == 0 {
+		return
+	}
+	_ = h.deliver(&relay_pb.Message{
+		Kind:     relay_pb.Kind_NACK,
+		Receiver: m.Sender,
+		Id:       m.Id,
+		Reason:   reasonOf(err),
+		Payload:  []byte(err.Error()),
+	})
+}
+
+func (h *hub) handle(ctx context.Context, conn *net.TCPConn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
 		_ = conn.Close()
-		if name != "" {
-			h.connMap.Delete(name)
-			log.Printf("peer [%s|%s] has been removed\n", name, conn.RemoteAddr().String())
+	})
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(h.config.HandshakeTimeout))
+	challenge, m, err := h.challenge(conn)
+	if err != nil {
+		return
+	}
+	switch m.Kind {
+	case relay_pb.Kind_REGISTER:
+		s, err := h.register(conn, challenge, m)
+		if err != nil {
+			log.Printf("peer [%s] registration failed: %v\n", conn.RemoteAddr().String(), reject(conn, err))
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		h.servePeer(s)
+	case relay_pb.Kind_LINK:
+		l, err := h.acceptLink(conn, challenge, m)
+		if err != nil {
+			log.Printf("hub [%s] link failed: %v\n", conn.RemoteAddr().String(), reject(conn, err))
+			return
 		}
+		_ = conn.SetDeadline(time.Time{})
+		_ = h.serveLink(l)
+	default:
+		_ = reject(conn, ErrNotRegistered)
+	}
+}
+
+func (h *hub) servePeer(s *session) {
+	conn := s.conn
+	log.Printf("peer [%s|%s] has been registered\n", s.name, conn.RemoteAddr().String())
+	h.announce(s.name, true)
+	h.presence(s.name, true)
+	defer func() {
+		s.out.close()
+		h.connMap.CompareAndDelete(s.name, s)
+		h.announce(s.name, false)
+		h.presence(s.name, false)
+		log.Printf("peer [%s|%s] has been removed\n", s.name, conn.RemoteAddr().String())
 	}()
+
 	for {
-		buffer, m, err := readAndUnmarshal(conn)
+		b, m, err := readAndUnmarshal(conn, h.config.MaxFrameSize)
 		if err != nil {
 			return
 		}
-		if name != m.Sender {
-			if name != "" {
-				h.connMap.Delete(name)
-				log.Printf("peer [%s|%s] has been removed\n", name, conn.RemoteAddr().String())
+		s.received.Add(1)
+		s.receivedBytes.Add(uint64(len(b)))
+		m.Sender = s.name // a peer can only send as itself
+		m.Via = nil
+		switch {
+		case m.Kind == relay_pb.Kind_SUBSCRIBE || m.Kind == relay_pb.Kind_UNSUBSCRIBE:
+			if err := ValidatePattern(m.Topic); err != nil {
+				log.Printf("peer [%s|%s] subscription %q: %v\n", s.name, conn.RemoteAddr().String(), m.Topic, err)
+				continue
+			}
+			s.subscribe(m.Topic, m.Kind == relay_pb.Kind_SUBSCRIBE)
+		case m.Kind == relay_pb.Kind_ACK:
+			// the sender only waits while it is connected, an ack carries nothing but the id
+			_ = h.deliver(&relay_pb.Message{Kind: m.Kind, Sender: m.Sender, Receiver: m.Receiver, Id: m.Id})
+		case m.Kind == relay_pb.Kind_KEY:
+			if h.config.ACL(m.Receiver, m.Sender) { // an answer to a key request of the receiver
+				_ = h.deliver(&relay_pb.Message{Kind: m.Kind, Sender: m.Sender, Receiver: m.Receiver, Payload: m.Payload})
+			}
+		case m.Kind == relay_pb.Kind_KEY_REQUEST:
+			if h.config.ACL(m.Sender, m.Receiver) {
+				_ = h.deliver(m)
+			}
+		case m.Kind == relay_pb.Kind_DIRECT_OFFER || m.Kind == relay_pb.Kind_DIRECT_ANSWER:
+			if h.config.ACL(m.Sender, m.Receiver) {
+				m.Endpoints = append([]string{conn.RemoteAddr().String()}, m.Endpoints...) // as seen through NATs
+				_ = h.deliver(m)
+			}
+		case m.Kind != relay_pb.Kind_DATA:
+			continue
+		case m.Broadcast:
+			h.flood(m, func(*session) bool {
+				return true
+			})
+		case m.Topic != "":
+			if ValidateTopic(m.Topic) != nil || reserved(m.Topic) {
+				continue
+			}
+			h.flood(m, func(s *session) bool {
+				return s.subscribed(m.Topic)
+			})
+		case !h.config.ACL(m.Sender, m.Receiver):
+			h.nack(m, ErrUnauthorized)
+		default:
+			if err := h.deliver(m); err != nil {
+				h.nack(m, err)
 			}
-			name = m.Sender
-			h.connMap.Store(name, conn)
-			log.Printf("peer [%s|%s] has been registered\n", name, conn.RemoteAddr().String())
-		}
-		receiver := m.Receiver
-		if val, loaded := h.connMap.Load(receiver); loaded {
-			receiverConn := val.(*net.TCPConn)
-			_, _ = receiverConn.Write(buffer)
 		}
 	}
 }
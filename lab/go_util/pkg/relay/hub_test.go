@@ -0,0 +1,253 @@
+package relay_test
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func startHub(t *testing.T, config relay.HubConfig) string {
+	return startHubAt(t, freeAddr(t), config)
+}
+
+func startHubAt(t *testing.T, addr string, config relay.HubConfig) string {
+	runHub(t, addr, config)
+	return addr
+}
+
+// runHub - serve a hub at addr until the test ends
+func runHub(t *testing.T, addr string, config relay.HubConfig) relay.Hub {
+	h, err := relay.NewHub(addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = h.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return h
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("hub did not start")
+	return nil
+}
+
+func TestHubServeAfterClose(t *testing.T) {
+	addr := freeAddr(t)
+	h := runHub(t, addr, relay.DefaultHubConfig())
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = h.ListenAndServe()
+	}()
+	alice, _ := mustRegister(t, addr, "alice")
+	_, bobReceived := mustRegister(t, addr, "bob")
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobReceived)
+}
+
+// testPeer - a peer served in the background, received gets its messages, done the error DialAndServe returned with
+type testPeer struct {
+	relay.Peer
+	received chan *relay_pb.Message
+	states   chan relay.PeerState
+	done     chan error
+}
+
+func connect(t *testing.T, hubAddr string, name string, credential relay.Credential) *testPeer {
+	return connectWith(t, hubAddr, name, credential, nil)
+}
+
+// connectWith - like connect, wrap decorates the peer before it is served
+func connectWith(t *testing.T, hubAddr string, name string, credential relay.Credential, wrap func(relay.Peer) relay.Peer) *testPeer {
+	config := relay.DefaultPeerConfig()
+	config.Credential = credential
+	return connectConfig(t, hubAddr, "", name, config, wrap)
+}
+
+// connectConfig - like connectWith, the peer dials from listenAddr with config
+func connectConfig(t *testing.T, hubAddr string, listenAddr string, name string, config relay.PeerConfig, wrap func(relay.Peer) relay.Peer) *testPeer {
+	tp := &testPeer{
+		received: make(chan *relay_pb.Message, 64),
+		states:   make(chan relay.PeerState, 64),
+		done:     make(chan error, 1),
+	}
+	config.BaseBackoff = 10 * time.Millisecond
+	config.OnState = func(state relay.PeerState) {
+		tp.states <- state
+	}
+	p, err := relay.NewPeer(name, listenAddr, hubAddr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		p = wrap(p)
+	}
+	tp.Peer = p
+	go func() {
+		tp.done <- p.DialAndServe(func(m *relay_pb.Message) {
+			tp.received <- m
+		})
+	}()
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+	return tp
+}
+
+// waitRegistered - registration either succeeds or DialAndServe returns
+func waitRegistered(t *testing.T, tp *testPeer) error {
+	for {
+		select {
+		case state := <-tp.states:
+			if state == relay.PeerConnected {
+				return nil
+			}
+		case err := <-tp.done:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("peer did not register")
+			return nil
+		}
+	}
+}
+
+func receive(t *testing.T, received chan *relay_pb.Message) *relay_pb.Message {
+	select {
+	case m := <-received:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+		return nil
+	}
+}
+
+func TestHubZeroConfig(t *testing.T) {
+	addr := startHub(t, relay.HubConfig{})
+	alice, _ := mustRegister(t, addr, "alice")
+	_, bobReceived := mustRegister(t, addr, "bob")
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobReceived)
+}
+
+func TestHubTokenAuth(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Auth = relay.TokenAuth(map[string]string{"alice": "secret"})
+	addr := startHub(t, config)
+
+	alice := connect(t, addr, "alice", relay.TokenCredential("secret"))
+	if err := waitRegistered(t, alice); err != nil {
+		t.Fatal(err)
+	}
+	thief := connect(t, addr, "alice", relay.TokenCredential("guess"))
+	if err := waitRegistered(t, thief); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected wrong token to be rejected, got %v", err)
+	}
+	twin := connect(t, addr, "alice", relay.TokenCredential("secret"))
+	if err := waitRegistered(t, twin); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected duplicate name to be rejected, got %v", err)
+	}
+	stranger := connect(t, addr, "bob", nil)
+	if err := waitRegistered(t, stranger); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected unknown name to be rejected, got %v", err)
+	}
+}
+
+func TestHubSharedTokenAuth(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Auth = relay.SharedTokenAuth("")
+	addr := startHub(t, config)
+
+	// an empty token is not a credential
+	alice := connect(t, addr, "alice", relay.TokenCredential(""))
+	if err := waitRegistered(t, alice); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected empty token to be rejected, got %v", err)
+	}
+	bob := connect(t, addr, "bob", nil)
+	if err := waitRegistered(t, bob); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected missing token to be rejected, got %v", err)
+	}
+}
+
+func TestHubEd25519Auth(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	config := relay.DefaultHubConfig()
+	config.Auth = relay.Ed25519Auth(map[string]ed25519.PublicKey{"alice": public})
+	addr := startHub(t, config)
+
+	thief := connect(t, addr, "alice", relay.Ed25519Credential(other))
+	if err := waitRegistered(t, thief); !errors.Is(err, relay.ErrRegisterRejected) {
+		t.Fatalf("expected wrong key to be rejected, got %v", err)
+	}
+	alice := connect(t, addr, "alice", relay.Ed25519Credential(private))
+	if err := waitRegistered(t, alice); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHubACL(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.ACL = relay.ACLFromMap(map[string][]string{
+		"alice": {"bob"},
+		"*":     {"carol"},
+	})
+	addr := startHub(t, config)
+
+	alice := connect(t, addr, "alice", nil)
+	if err := waitRegistered(t, alice); err != nil {
+		t.Fatal(err)
+	}
+	bob := connect(t, addr, "bob", nil)
+	if err := waitRegistered(t, bob); err != nil {
+		t.Fatal(err)
+	}
+	carol := connect(t, addr, "carol", nil)
+	if err := waitRegistered(t, carol); err != nil {
+		t.Fatal(err)
+	}
+
+	// denied, then allowed by "*"
+	_ = bob.Write(&relay_pb.Message{Receiver: "alice", Payload: []byte("denied")})
+	_ = bob.Write(&relay_pb.Message{Receiver: "carol", Payload: []byte("hi carol")})
+	if m := receive(t, carol.received); m.Sender != "bob" || string(m.Payload) != "hi carol" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	// sender is the registered name
+	_ = alice.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte("hi bob")})
+	m := receive(t, bob.received)
+	if m.Sender != "alice" || string(m.Payload) != "hi bob" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	select {
+	case m := <-alice.received:
+		t.Fatalf("acl must drop %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
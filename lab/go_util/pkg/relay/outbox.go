@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const DEFAULT_OUTBOUND_SIZE = 256
+
+type OverflowPolicy int
+
+const (
+	OverflowDrop  OverflowPolicy = iota // a message to a full outbox is nacked with ErrQueueFull
+	OverflowBlock                       // the sender waits until the receiver catches up
+)
+
+// OutboundConfig - every connection of the hub has its own queue of Size messages written by its own goroutine
+// so that a slow receiver only stalls senders under OverflowBlock
+type OutboundConfig struct {
+	Size   int
+	Policy OverflowPolicy
+}
+
+func DefaultOutboundConfig() OutboundConfig {
+	return OutboundConfig{
+		Size:   DEFAULT_OUTBOUND_SIZE,
+		Policy: OverflowDrop,
+	}
+}
+
+// outbox - bounded queue of messages to a connection, the connection is closed if a write fails
+type outbox struct {
+	conn   *net.TCPConn
+	policy OverflowPolicy
+	queue  chan *relay_pb.Message
+	done   chan struct{}
+	once   sync.Once
+
+	sent      atomic.Uint64
+	sentBytes atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func newOutbox(conn *net.TCPConn, config OutboundConfig) *outbox {
+	o := &outbox{
+		conn:   conn,
+		policy: config.Policy,
+		queue:  make(chan *relay_pb.Message, max(config.Size, 1)),
+		done:   make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+func (o *outbox) run() {
+	for {
+		select {
+		case <-o.done:
+			return
+		case m := <-o.queue:
+			if err := marshalAndWrite(o.conn, m); err != nil {
+				o.close()
+				_ = o.conn.Close() // the read loop ends the session
+				return
+			}
+			o.sent.Add(1)
+			o.sentBytes.Add(uint64(8 + proto.Size(m)))
+		}
+	}
+}
+
+// send - queue m according to the policy of the outbox
+func (o *outbox) send(m *relay_pb.Message) error {
+	if o.policy == OverflowBlock {
+		return o.push(m)
+	}
+	select {
+	case <-o.done:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case o.queue <- m:
+		return nil
+	default:
+		o.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// push - queue m, wait if the outbox is full
+func (o *outbox) push(m *relay_pb.Message) error {
+	select {
+	case <-o.done:
+		return net.ErrClosed
+	case o.queue <- m:
+		return nil
+	}
+}
+
+// close - messages still queued are dropped
+func (o *outbox) close() {
+	o.once.Do(func() {
+		close(o.done)
+	})
+}
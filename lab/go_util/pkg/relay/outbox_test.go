@@ -0,0 +1,77 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func TestHubSlowReceiver(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Outbound.Size = 4
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+	_, bobReceived := mustRegister(t, addr, "bob")
+	mustRegister(t, addr, "slow") // never read
+
+	// fill the socket and then the outbox of slow until the hub drops
+	payload := bytes.Repeat([]byte("x"), 128<<10)
+	full := false
+	for i := 0; i < 100 && !full; i++ {
+		for j := 0; j < 16; j++ {
+			if err := alice.Write(&relay_pb.Message{Receiver: "slow", Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := alice.Send(ctx, &relay_pb.Message{Receiver: "slow", Payload: payload})
+		cancel()
+		full = errors.Is(err, relay.ErrQueueFull)
+	}
+	if !full {
+		t.Fatal("expected the outbox of slow to be full")
+	}
+
+	// slow does not stall the delivery to bob
+	if err := send(alice, "bob", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobReceived)
+}
+
+func TestHubBlockBothWays(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Outbound.Size = 4
+	config.Outbound.Policy = relay.OverflowBlock
+	addr := startHub(t, config)
+	alice, aliceReceived := mustRegister(t, addr, "alice")
+	bob, bobReceived := mustRegister(t, addr, "bob")
+
+	// both write faster than the other reads while acking what they read
+	const n = 200
+	payload := bytes.Repeat([]byte("x"), 128<<10)
+	for _, w := range []struct {
+		from relay.Peer
+		to   string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		go func() {
+			for i := 0; i < n; i++ {
+				_ = w.from.Write(&relay_pb.Message{Receiver: w.to, Id: 1, WantAck: true, Payload: payload})
+			}
+		}()
+	}
+	for _, received := range []chan *relay_pb.Message{aliceReceived, bobReceived} {
+		for i := 0; i < n; i++ {
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("stuck after %d messages", i)
+			}
+		}
+	}
+}
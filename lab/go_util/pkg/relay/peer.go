@@ -1,24 +1,127 @@
 package relay
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
 )
 
 var (
-	ErrNotInit = errors.New("not_init")
+	ErrNotInit     = errors.New("not_init")
+	ErrBufferFull  = errors.New("buffer_full")
+	ErrPeerClosed  = errors.New("peer_closed")
+	errNotAccepted = errors.New("not_accepted")
 )
 
+const (
+	DEFAULT_PEER_BASE_BACKOFF = 100 * time.Millisecond
+	DEFAULT_PEER_MAX_BACKOFF  = 10 * time.Second
+	DEFAULT_PEER_BUFFER_SIZE  = 1024
+)
+
+type PeerState int
+
+const (
+	PeerDisconnected PeerState = iota
+	PeerConnecting
+	PeerConnected
+	PeerClosed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// Peer - Write sends to m.Receiver, or to subscribers of m.Topic, or to every peer if m.Broadcast
+// Send writes m to m.Receiver and waits until it is acked or ctx is done
+// DialAndServe reconnects until Close or until the hub rejects the registration, serve gets data, key exchanges
+// and presence of peers joining or leaving once subscribed to PresenceJoin or PresenceLeave
+// Direct sets up a connection to name that skips the hub, messages to name go through the hub again if it fails or breaks
+// messages written while it is set up may overtake each other, serve may be called concurrently once it is up
 type Peer interface {
+	Name() string
 	Write(m *relay_pb.Message) error
+	Send(ctx context.Context, m *relay_pb.Message) error
+	Subscribe(pattern string) error
+	Unsubscribe(pattern string) error
+	Direct(ctx context.Context, name string) error
 	DialAndServe(serve func(m *relay_pb.Message)) error
 	Close() error
 }
 
-func NewPeer(name string, listenAddr string, relayAddr string) (Peer, error) {
+// PeerConfig - Credential answers the challenge of the hub, nil sends an empty credential
+// Write keeps up to BufferSize messages while disconnected, OnState is called on every state change
+// payloads larger than ChunkSize are written in chunks and put back together by the receiver
+// up to MaxMessageSize, chunks of a message not complete within ChunkTimeout are dropped
+// a sender has up to ChunkStreams messages being put back together, holding up to ChunkBuffer bytes with those of other senders
+// Direct listens at the listen address of the peer for direct connections of other peers
+// DirectNetwork is "tcp" or "udp" to punch only one kind of hole, empty tries both
+// a zero field takes the value of DefaultPeerConfig, but for BufferSize and ChunkSize where zero means none
+type PeerConfig struct {
+	Credential     Credential
+	BaseBackoff    time.Duration
+	MaxBackoff     time.Duration
+	BufferSize     int
+	OnState        func(state PeerState)
+	ChunkSize      int // 0 never splits payloads
+	MaxFrameSize   int
+	MaxMessageSize int
+	ChunkTimeout   time.Duration
+	ChunkStreams   int
+	ChunkBuffer    int
+	Direct         bool
+	DirectTimeout  time.Duration
+	DirectNetwork  string
+}
+
+func DefaultPeerConfig() PeerConfig {
+	return PeerConfig{
+		BaseBackoff:    DEFAULT_PEER_BASE_BACKOFF,
+		MaxBackoff:     DEFAULT_PEER_MAX_BACKOFF,
+		BufferSize:     DEFAULT_PEER_BUFFER_SIZE,
+		ChunkSize:      DEFAULT_CHUNK_SIZE,
+		MaxFrameSize:   DEFAULT_MAX_FRAME_SIZE,
+		MaxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+		ChunkTimeout:   DEFAULT_CHUNK_TIMEOUT,
+		ChunkStreams:   DEFAULT_CHUNK_STREAMS,
+		ChunkBuffer:    DEFAULT_CHUNK_BUFFER,
+		DirectTimeout:  DEFAULT_DIRECT_TIMEOUT,
+	}
+}
+
+// withDefaults - zero fields set from DefaultPeerConfig
+func (c PeerConfig) withDefaults() PeerConfig {
+	d := DefaultPeerConfig()
+	setDefault(&c.BaseBackoff, d.BaseBackoff)
+	setDefault(&c.MaxBackoff, d.MaxBackoff)
+	setDefault(&c.MaxFrameSize, d.MaxFrameSize)
+	setDefault(&c.MaxMessageSize, d.MaxMessageSize)
+	setDefault(&c.ChunkTimeout, d.ChunkTimeout)
+	setDefault(&c.ChunkStreams, d.ChunkStreams)
+	setDefault(&c.ChunkBuffer, d.ChunkBuffer)
+	setDefault(&c.DirectTimeout, d.DirectTimeout)
+	return c
+}
+
+func NewPeer(name string, listenAddr string, relayAddr string, config PeerConfig) (Peer, error) {
+	config = config.withDefaults()
 	listen, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		return nil, err
@@ -27,64 +130,381 @@ func NewPeer(name string, listenAddr string, relayAddr string) (Peer, error) {
 	if err != nil {
 		return nil, err
 	}
+	var ln *net.TCPListener
+	var udp *net.UDPConn
+	if config.Direct {
+		switch config.DirectNetwork {
+		case "", "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("%w: unknown network %s", ErrNoDirect, config.DirectNetwork)
+		}
+		lc := net.ListenConfig{Control: reusePort}
+		l, err := lc.Listen(context.Background(), "tcp", listen.String())
+		if err != nil {
+			return nil, err
+		}
+		ln = l.(*net.TCPListener)
+		if config.DirectNetwork != "tcp" {
+			udp, err = net.ListenUDP("udp", &net.UDPAddr{IP: listen.IP, Port: ln.Addr().(*net.TCPAddr).Port})
+			if err != nil {
+				_ = ln.Close()
+				return nil, err
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &peer{
-		name:   name,
-		listen: listen,
-		relay:  relay,
-		conn:   nil,
+		name:      name,
+		config:    config,
+		listen:    listen,
+		relay:     relay,
+		ctx:       ctx,
+		cancel:    cancel,
+		conn:      nil,
+		state:     PeerDisconnected,
+		patterns:  make(map[string]struct{}),
+		acker:     newAcker(),
+		acks:      make(chan *relay_pb.Message, DEFAULT_PEER_BUFFER_SIZE),
+		chunks:    newAssembler(config.MaxMessageSize, config.ChunkStreams, config.ChunkBuffer, config.ChunkTimeout),
+		ln:        ln,
+		udp:       udp,
+		directs:   make(map[string]*net.TCPConn),
+		datagrams: make(map[string]*datagramPath),
+		punches:   make(map[string]*punch),
 	}, nil
 }
 
 type peer struct {
 	name   string
+	config PeerConfig
 	listen *net.TCPAddr
 	relay  *net.TCPAddr
-	conn   *net.TCPConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex // serialize writes
+	conn     *net.TCPConn
+	state    PeerState
+	buffer   []*relay_pb.Message // protected by mu, written once connected
+	patterns map[string]struct{} // protected by mu, subscribed again once connected
+	stream   uint64              // protected by mu, last chunked message
+
+	acker  *acker
+	acks   chan *relay_pb.Message // written by writeAcks, reading never waits for a write
+	chunks *assembler
+
+	ln        *net.TCPListener         // nil if direct connections are disabled
+	udp       *net.UDPConn             // on the port of ln, nil if direct connections are disabled or only on tcp
+	directs   map[string]*net.TCPConn  // protected by mu, by name of the other peer
+	datagrams map[string]*datagramPath // protected by mu, by name of the other peer, used if there is no entry in directs
+	punches   map[string]*punch        // protected by mu, direct connections being set up
 }
 
+func (p *peer) setState(state PeerState) {
+	p.mu.Lock()
+	changed := p.state != state && p.state != PeerClosed
+	if changed {
+		p.state = state
+	}
+	p.mu.Unlock()
+	if changed && p.config.OnState != nil {
+		p.config.OnState(state)
+	}
+}
+
+// writeLocked - write to the direct connection to the receiver, or to the hub, or buffer m if there is none
+func (p *peer) writeLocked(m *relay_pb.Message) error {
+	if p.state == PeerClosed {
+		return ErrPeerClosed
+	}
+	if p.writeDirectLocked(m) {
+		return nil
+	}
+	if p.conn != nil {
+		err := marshalAndWrite(p.conn, m)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("[peer_%s] write error: %v\n", p.name, err)
+		_ = p.conn.Close() // the serve loop reconnects
+		p.conn = nil
+	}
+	if p.config.BufferSize == 0 {
+		return ErrNotInit
+	}
+	if len(p.buffer) >= p.config.BufferSize {
+		return ErrBufferFull
+	}
+	p.buffer = append(p.buffer, m)
+	return nil
+}
+
+func (p *peer) Name() string {
+	return p.name
+}
+
+// Write - chunks of a large payload are written one after the other
 func (p *peer) Write(m *relay_pb.Message) error {
 	m.Sender = p.name
-	if p.conn == nil {
-		err := ErrNotInit
-		fmt.Printf("[peer_%s] write error: %v\n", p.name, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config.ChunkSize > 0 && len(m.Payload) > p.config.ChunkSize {
+		p.stream++
+	}
+	for _, c := range split(m, p.stream, p.config.ChunkSize) {
+		if err := p.writeLocked(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *peer) Send(ctx context.Context, m *relay_pb.Message) error {
+	if m.Receiver == "" || m.Topic != "" || m.Broadcast {
+		return ErrNotDirect
+	}
+	id, done := p.acker.wait(m.Receiver)
+	defer p.acker.cancel(id)
+	m.Id = id
+	m.WantAck = true
+	if err := p.Write(m); err != nil {
 		return err
 	}
-	err := marshalAndWrite(p.conn, m)
-	if err != nil {
-		fmt.Printf("[peer_%s] write error: %v\n", p.name, err)
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrNoAck, ctx.Err())
 	}
-	return err
 }
 
-func (p *peer) DialAndServe(serve func(*relay_pb.Message)) (err error) {
-	fmt.Printf("[peer_%s] dialing %s\n", p.name, p.relay.String())
-	p.conn, err = net.DialTCP("tcp", p.listen, p.relay)
+// subscribe - remember the subscription and tell the hub if connected
+func (p *peer) subscribe(pattern string, subscribe bool) error {
+	if err := ValidatePattern(pattern); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kind := relay_pb.Kind_SUBSCRIBE
+	if subscribe {
+		p.patterns[pattern] = struct{}{}
+	} else {
+		delete(p.patterns, pattern)
+		kind = relay_pb.Kind_UNSUBSCRIBE
+	}
+	if p.conn == nil {
+		return nil
+	}
+	return marshalAndWrite(p.conn, &relay_pb.Message{Kind: kind, Sender: p.name, Topic: pattern})
+}
+
+func (p *peer) Subscribe(pattern string) error {
+	return p.subscribe(pattern, true)
+}
+
+func (p *peer) Unsubscribe(pattern string) error {
+	return p.subscribe(pattern, false)
+}
+
+// register - answer the challenge of the hub with the credential of the peer
+func (p *peer) register(conn *net.TCPConn) error {
+	_, m, err := readAndUnmarshal(conn, p.config.MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if m.Kind != relay_pb.Kind_CHALLENGE {
+		return fmt.Errorf("%w: unexpected %s", errNotAccepted, m.Kind)
+	}
+	var credential []byte
+	if p.config.Credential != nil {
+		credential = p.config.Credential(m.Payload)
+	}
+	err = marshalAndWrite(conn, &relay_pb.Message{
+		Kind:    relay_pb.Kind_REGISTER,
+		Sender:  p.name,
+		Payload: credential,
+	})
 	if err != nil {
-		fmt.Printf("[peer_%s] dial error: %v\n", p.name, err)
 		return err
 	}
-	defer p.conn.Close()
-	fmt.Printf("[peer_%s] connected to relay %s\n", p.name, p.relay.String())
-	err = p.Write(&relay_pb.Message{})
+	_, m, err = readAndUnmarshal(conn, p.config.MaxFrameSize)
 	if err != nil {
 		return err
 	}
+	switch m.Kind {
+	case relay_pb.Kind_ACCEPT:
+		return nil
+	case relay_pb.Kind_REJECT:
+		return fmt.Errorf("%w: %s", ErrRegisterRejected, string(m.Payload))
+	default:
+		return fmt.Errorf("%w: unexpected %s", errNotAccepted, m.Kind)
+	}
+}
+
+// connect - dial and register, then subscribe again and write what was buffered before anything else
+func (p *peer) connect() (*net.TCPConn, error) {
+	fmt.Printf("[peer_%s] dialing %s\n", p.name, p.relay.String())
+	dialer := p.dialer()
+	c, err := dialer.DialContext(p.ctx, "tcp", p.relay.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.TCPConn)
+	_ = conn.SetDeadline(time.Now().Add(DEFAULT_HANDSHAKE_TIMEOUT))
+	if err := p.register(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == PeerClosed {
+		_ = conn.Close()
+		return nil, ErrPeerClosed
+	}
+	for pattern := range p.patterns {
+		if err := marshalAndWrite(conn, &relay_pb.Message{Kind: relay_pb.Kind_SUBSCRIBE, Sender: p.name, Topic: pattern}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	for len(p.buffer) > 0 {
+		if err := marshalAndWrite(conn, p.buffer[0]); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		p.buffer = p.buffer[1:]
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+// serve - read until the connection breaks
+func (p *peer) serve(conn *net.TCPConn, serve func(*relay_pb.Message)) error {
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.conn == conn {
+			p.conn = nil
+		}
+		_ = conn.Close()
+	}()
 	for {
-		_, m, err := readAndUnmarshal(p.conn)
+		_, m, err := readAndUnmarshal(conn, p.config.MaxFrameSize)
 		if err != nil {
-			fmt.Printf("[peer_%s] read error: %v\n", p.name, err)
 			return err
 		}
+		p.handle(m, serve)
+	}
+}
+
+// handle - a message from the hub or from a direct connection
+func (p *peer) handle(m *relay_pb.Message, serve func(*relay_pb.Message)) {
+	switch m.Kind {
+	case relay_pb.Kind_ACK, relay_pb.Kind_NACK:
+		p.acker.resolve(m)
+	case relay_pb.Kind_KEY_REQUEST, relay_pb.Kind_KEY, relay_pb.Kind_PRESENCE:
 		serve(m)
+	case relay_pb.Kind_DIRECT_OFFER:
+		p.offered(m, serve)
+	case relay_pb.Kind_DIRECT_ANSWER:
+		p.answered(m, serve)
+	case relay_pb.Kind_DATA:
+		whole, err := p.chunks.add(m)
+		if err != nil {
+			fmt.Printf("[peer_%s] message from %s dropped: %v\n", p.name, m.Sender, err)
+		}
+		if whole == nil {
+			return
+		}
+		serve(whole)
+		if whole.WantAck && whole.Topic == "" && !whole.Broadcast {
+			select {
+			case p.acks <- &relay_pb.Message{
+				Kind:     relay_pb.Kind_ACK,
+				Receiver: whole.Sender,
+				Id:       whole.Id,
+			}:
+			default: // the sender times out
+			}
+		}
+	}
+}
+
+// writeAcks - a write blocked on a hub that waits for this peer to read must not stop the read loop
+func (p *peer) writeAcks() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case m := <-p.acks:
+			_ = p.Write(m)
+		}
+	}
+}
+
+func (p *peer) DialAndServe(serve func(*relay_pb.Message)) error {
+	go p.writeAcks()
+	if p.ln != nil {
+		go p.acceptDirect(serve)
+	}
+	if p.udp != nil {
+		go p.readDatagrams(serve)
+		go p.keepDatagrams()
+	}
+	backoff := p.config.BaseBackoff
+	for {
+		if p.ctx.Err() != nil {
+			return ErrPeerClosed
+		}
+		p.setState(PeerConnecting)
+		conn, err := p.connect()
+		if errors.Is(err, ErrRegisterRejected) {
+			fmt.Printf("[peer_%s] register error: %v\n", p.name, err)
+			p.setState(PeerDisconnected)
+			return err
+		}
+		if err == nil {
+			fmt.Printf("[peer_%s] registered to relay %s\n", p.name, p.relay.String())
+			backoff = p.config.BaseBackoff
+			p.setState(PeerConnected)
+			err = p.serve(conn, serve)
+		}
+		if p.ctx.Err() != nil {
+			return ErrPeerClosed
+		}
+		p.setState(PeerDisconnected)
+		wait := backoff/2 + rand.N(backoff/2+1)
+		fmt.Printf("[peer_%s] error: %v, reconnecting in %v\n", p.name, err, wait)
+		select {
+		case <-p.ctx.Done():
+			return ErrPeerClosed
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, p.config.MaxBackoff)
 	}
 }
 
 func (p *peer) Close() error {
-	if p.conn == nil {
-		err := ErrNotInit
-		fmt.Printf("[agent_%s] close error: %v\n", p.name, err)
-		return err
+	p.cancel()
+	p.setState(PeerClosed)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+	if p.ln != nil {
+		_ = p.ln.Close()
+	}
+	if p.udp != nil {
+		_ = p.udp.Close()
+	}
+	for name, conn := range p.directs {
+		_ = conn.Close()
+		delete(p.directs, name)
 	}
-	return p.conn.Close()
+	clear(p.datagrams)
+	return nil
 }
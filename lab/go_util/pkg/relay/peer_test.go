@@ -0,0 +1,109 @@
+package relay_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func waitState(t *testing.T, tp *testPeer, expected relay.PeerState) {
+	for {
+		select {
+		case state := <-tp.states:
+			if state == expected {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("peer did not become %s", expected)
+		}
+	}
+}
+
+func TestPeerReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	h, err := relay.NewHub(addr, relay.DefaultHubConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = h.ListenAndServe()
+	}()
+	alice := connect(t, addr, "alice", nil)
+	bob := connect(t, addr, "bob", nil)
+	waitState(t, alice, relay.PeerConnected)
+	waitState(t, bob, relay.PeerConnected)
+	if err := bob.Subscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = h.Close()
+	waitState(t, alice, relay.PeerDisconnected)
+	waitState(t, bob, relay.PeerDisconnected)
+	// buffered until alice is connected again
+	for i := 0; i < 3; i++ {
+		if err := alice.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	startHubAt(t, addr, relay.DefaultHubConfig())
+	waitState(t, alice, relay.PeerConnected)
+	waitState(t, bob, relay.PeerConnected)
+	expectInOrder(t, bob.received, 3)
+
+	// bob subscribed again after reconnecting
+	_ = alice.Write(&relay_pb.Message{Topic: "news", Payload: []byte("hello")})
+	if m := receive(t, bob.received); m.Topic != "news" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	_ = alice.Close()
+	waitState(t, alice, relay.PeerClosed)
+	if err := <-alice.done; err != relay.ErrPeerClosed {
+		t.Fatalf("expected closed, got %v", err)
+	}
+	if err := alice.Write(&relay_pb.Message{Receiver: "bob"}); err != relay.ErrPeerClosed {
+		t.Fatalf("expected closed, got %v", err)
+	}
+}
+
+func TestPeerConcurrentWrite(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice, _ := mustRegister(t, addr, "alice")
+	_, bobReceived := mustRegister(t, addr, "bob")
+
+	const n = 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = alice.Write(&relay_pb.Message{Receiver: "bob", Payload: []byte(fmt.Sprint(i))})
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		seen[string(receive(t, bobReceived).Payload)] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d distinct messages, got %d", n, len(seen))
+	}
+}
+
+func TestPeerZeroConfig(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice := connectConfig(t, addr, "", "alice", relay.PeerConfig{}, nil)
+	if err := waitRegistered(t, alice); err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := mustRegister(t, addr, "bob")
+	if err := send(bob, "alice", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, alice.received)
+}
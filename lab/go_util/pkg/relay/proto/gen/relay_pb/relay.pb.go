@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.26.0
+// 	protoc-gen-go v1.36.6
 // 	protoc        v3.19.3
 // source: relay.proto
 
@@ -11,6 +11,7 @@ import (
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	reflect "reflect"
 	sync "sync"
+	unsafe "unsafe"
 )
 
 const (
@@ -20,23 +21,373 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
-type Message struct {
-	state         protoimpl.MessageState
+type Kind int32
+
+const (
+	Kind_DATA          Kind = 0
+	Kind_CHALLENGE     Kind = 1  // hub -> peer, payload is a nonce to prove identity against
+	Kind_REGISTER      Kind = 2  // peer -> hub, sender is the claimed name, payload is the credential
+	Kind_ACCEPT        Kind = 3  // hub -> peer, registration succeeded
+	Kind_REJECT        Kind = 4  // hub -> peer, registration failed, payload is the reason
+	Kind_SUBSCRIBE     Kind = 5  // peer -> hub, topic is a pattern
+	Kind_UNSUBSCRIBE   Kind = 6  // peer -> hub, topic is a pattern
+	Kind_ACK           Kind = 7  // receiver -> sender, id of the data delivered
+	Kind_NACK          Kind = 8  // hub -> sender, id of the data not delivered and the reason
+	Kind_LINK          Kind = 9  // hub -> hub, sender is the hub name, payload is the credential
+	Kind_GOSSIP        Kind = 10 // hub -> hub, routes that changed
+	Kind_KEY_REQUEST   Kind = 11 // peer -> peer, payload is the public key of the sender
+	Kind_KEY           Kind = 12 // peer -> peer, payload is the public key of the sender
+	Kind_PRESENCE      Kind = 13 // hub -> peer, sender joined or left, topic is $presence.join or $presence.leave
+	Kind_DIRECT_OFFER  Kind = 14 // peer -> peer through the hub, payload is a token, endpoints where the sender can be dialed
+	Kind_DIRECT_ANSWER Kind = 15 // peer -> peer through the hub, payload is the token of the offer, empty if refused
+	Kind_DIRECT_HELLO  Kind = 16 // peer -> peer on a direct connection, payload is the token
+	Kind_DIRECT_SELECT Kind = 17 // peer -> peer on a direct connection, the connection is used
+)
+
+// Enum value maps for Kind.
+var (
+	Kind_name = map[int32]string{
+		0:  "DATA",
+		1:  "CHALLENGE",
+		2:  "REGISTER",
+		3:  "ACCEPT",
+		4:  "REJECT",
+		5:  "SUBSCRIBE",
+		6:  "UNSUBSCRIBE",
+		7:  "ACK",
+		8:  "NACK",
+		9:  "LINK",
+		10: "GOSSIP",
+		11: "KEY_REQUEST",
+		12: "KEY",
+		13: "PRESENCE",
+		14: "DIRECT_OFFER",
+		15: "DIRECT_ANSWER",
+		16: "DIRECT_HELLO",
+		17: "DIRECT_SELECT",
+	}
+	Kind_value = map[string]int32{
+		"DATA":          0,
+		"CHALLENGE":     1,
+		"REGISTER":      2,
+		"ACCEPT":        3,
+		"REJECT":        4,
+		"SUBSCRIBE":     5,
+		"UNSUBSCRIBE":   6,
+		"ACK":           7,
+		"NACK":          8,
+		"LINK":          9,
+		"GOSSIP":        10,
+		"KEY_REQUEST":   11,
+		"KEY":           12,
+		"PRESENCE":      13,
+		"DIRECT_OFFER":  14,
+		"DIRECT_ANSWER": 15,
+		"DIRECT_HELLO":  16,
+		"DIRECT_SELECT": 17,
+	}
+)
+
+func (x Kind) Enum() *Kind {
+	p := new(Kind)
+	*p = x
+	return p
+}
+
+func (x Kind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Kind) Descriptor() protoreflect.EnumDescriptor {
+	return file_relay_proto_enumTypes[0].Descriptor()
+}
+
+func (Kind) Type() protoreflect.EnumType {
+	return &file_relay_proto_enumTypes[0]
+}
+
+func (x Kind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Kind.Descriptor instead.
+func (Kind) EnumDescriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{0}
+}
+
+type Reason int32
+
+const (
+	Reason_NONE             Reason = 0
+	Reason_UNKNOWN_RECEIVER Reason = 1
+	Reason_QUEUE_FULL       Reason = 2
+	Reason_UNAUTHORIZED     Reason = 3
+	Reason_WRITE_FAILED     Reason = 4
+)
+
+// Enum value maps for Reason.
+var (
+	Reason_name = map[int32]string{
+		0: "NONE",
+		1: "UNKNOWN_RECEIVER",
+		2: "QUEUE_FULL",
+		3: "UNAUTHORIZED",
+		4: "WRITE_FAILED",
+	}
+	Reason_value = map[string]int32{
+		"NONE":             0,
+		"UNKNOWN_RECEIVER": 1,
+		"QUEUE_FULL":       2,
+		"UNAUTHORIZED":     3,
+		"WRITE_FAILED":     4,
+	}
+)
+
+func (x Reason) Enum() *Reason {
+	p := new(Reason)
+	*p = x
+	return p
+}
+
+func (x Reason) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Reason) Descriptor() protoreflect.EnumDescriptor {
+	return file_relay_proto_enumTypes[1].Descriptor()
+}
+
+func (Reason) Type() protoreflect.EnumType {
+	return &file_relay_proto_enumTypes[1]
+}
+
+func (x Reason) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Reason.Descriptor instead.
+func (Reason) EnumDescriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{1}
+}
+
+// Route - whether peer name is connected to hub, version is chosen by hub and only grows
+type Route struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Hub           string                 `protobuf:"bytes,2,opt,name=hub,proto3" json:"hub,omitempty"`
+	Connected     bool                   `protobuf:"varint,3,opt,name=connected,proto3" json:"connected,omitempty"`
+	Version       uint64                 `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Route) Reset() {
+	*x = Route{}
+	mi := &file_relay_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Route) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Route) ProtoMessage() {}
+
+func (x *Route) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Route.ProtoReflect.Descriptor instead.
+func (*Route) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Route) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Route) GetHub() string {
+	if x != nil {
+		return x.Hub
+	}
+	return ""
+}
+
+func (x *Route) GetConnected() bool {
+	if x != nil {
+		return x.Connected
+	}
+	return false
+}
+
+func (x *Route) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+// Chunk - the payload of a large message is split into count messages with the same stream
+type Chunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stream        uint64                 `protobuf:"varint,1,opt,name=stream,proto3" json:"stream,omitempty"` // chosen by the sender
+	Index         uint32                 `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	Count         uint32                 `protobuf:"varint,3,opt,name=count,proto3" json:"count,omitempty"`
 	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
 
-	Sender   string `protobuf:"bytes,1,opt,name=sender,proto3" json:"sender,omitempty"`
-	Receiver string `protobuf:"bytes,2,opt,name=receiver,proto3" json:"receiver,omitempty"`
-	Payload  []byte `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_relay_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
-func (x *Message) Reset() {
-	*x = Message{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_relay_proto_msgTypes[0]
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Chunk) GetStream() uint64 {
+	if x != nil {
+		return x.Stream
+	}
+	return 0
+}
+
+func (x *Chunk) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *Chunk) GetCount() uint32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+// Call - data carrying an rpc request or the response to the request with the same id
+type Call struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"` // chosen by the caller
+	Response      bool                   `protobuf:"varint,2,opt,name=response,proto3" json:"response,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"` // set if the request failed
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Call) Reset() {
+	*x = Call{}
+	mi := &file_relay_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Call) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Call) ProtoMessage() {}
+
+func (x *Call) ProtoReflect() protoreflect.Message {
+	mi := &file_relay_proto_msgTypes[2]
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Call.ProtoReflect.Descriptor instead.
+func (*Call) Descriptor() ([]byte, []int) {
+	return file_relay_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Call) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Call) GetResponse() bool {
+	if x != nil {
+		return x.Response
+	}
+	return false
+}
+
+func (x *Call) GetError() string {
+	if x != nil {
+		return x.Error
 	}
+	return ""
+}
+
+type Message struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Sender        string                 `protobuf:"bytes,1,opt,name=sender,proto3" json:"sender,omitempty"`
+	Receiver      string                 `protobuf:"bytes,2,opt,name=receiver,proto3" json:"receiver,omitempty"`
+	Payload       []byte                 `protobuf:"bytes,3,opt,name=payload,proto3" json:"payload,omitempty"`
+	Kind          Kind                   `protobuf:"varint,4,opt,name=kind,proto3,enum=relay.Kind" json:"kind,omitempty"`
+	Topic         string                 `protobuf:"bytes,5,opt,name=topic,proto3" json:"topic,omitempty"`                      // if set, data goes to every peer subscribed to a matching pattern instead of receiver
+	Broadcast     bool                   `protobuf:"varint,6,opt,name=broadcast,proto3" json:"broadcast,omitempty"`             // if set, data goes to every connected peer instead of receiver
+	Id            uint64                 `protobuf:"varint,7,opt,name=id,proto3" json:"id,omitempty"`                           // chosen by the sender, non zero if the sender wants to hear about failures
+	WantAck       bool                   `protobuf:"varint,8,opt,name=want_ack,json=wantAck,proto3" json:"want_ack,omitempty"`  // the receiver acks once the data is served
+	Reason        Reason                 `protobuf:"varint,9,opt,name=reason,proto3,enum=relay.Reason" json:"reason,omitempty"` // of a nack
+	Routes        []*Route               `protobuf:"bytes,10,rep,name=routes,proto3" json:"routes,omitempty"`                   // of a gossip
+	Via           []string               `protobuf:"bytes,11,rep,name=via,proto3" json:"via,omitempty"`                         // hubs that forwarded the message, the first is the origin
+	Flood         uint64                 `protobuf:"varint,12,opt,name=flood,proto3" json:"flood,omitempty"`                    // chosen by the origin hub of a topic or broadcast message
+	Encrypted     bool                   `protobuf:"varint,13,opt,name=encrypted,proto3" json:"encrypted,omitempty"`            // payload is sealed for the receiver
+	Chunk         *Chunk                 `protobuf:"bytes,14,opt,name=chunk,proto3" json:"chunk,omitempty"`                     // set if payload is a part of a larger payload
+	Call          *Call                  `protobuf:"bytes,15,opt,name=call,proto3" json:"call,omitempty"`                       // set if payload is an rpc request or response
+	Endpoints     []string               `protobuf:"bytes,16,rep,name=endpoints,proto3" json:"endpoints,omitempty"`             // of a direct offer or answer, the hub puts the observed one first
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_relay_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *Message) String() string {
@@ -46,8 +397,8 @@ func (x *Message) String() string {
 func (*Message) ProtoMessage() {}
 
 func (x *Message) ProtoReflect() protoreflect.Message {
-	mi := &file_relay_proto_msgTypes[0]
-	if protoimpl.UnsafeEnabled && x != nil {
+	mi := &file_relay_proto_msgTypes[3]
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -59,7 +410,7 @@ func (x *Message) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Message.ProtoReflect.Descriptor instead.
 func (*Message) Descriptor() ([]byte, []int) {
-	return file_relay_proto_rawDescGZIP(), []int{0}
+	return file_relay_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *Message) GetSender() string {
@@ -83,42 +434,197 @@ func (x *Message) GetPayload() []byte {
 	return nil
 }
 
-var File_relay_proto protoreflect.FileDescriptor
+func (x *Message) GetKind() Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return Kind_DATA
+}
 
-var file_relay_proto_rawDesc = []byte{
-	0x0a, 0x0b, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x72,
-	0x65, 0x6c, 0x61, 0x79, 0x22, 0x57, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12,
-	0x16, 0x0a, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x63, 0x65, 0x69,
-	0x76, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x72, 0x65, 0x63, 0x65, 0x69,
-	0x76, 0x65, 0x72, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x42, 0x0e, 0x5a,
-	0x0c, 0x67, 0x65, 0x6e, 0x2f, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x70, 0x62, 0x62, 0x06, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x33,
+func (x *Message) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *Message) GetBroadcast() bool {
+	if x != nil {
+		return x.Broadcast
+	}
+	return false
+}
+
+func (x *Message) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Message) GetWantAck() bool {
+	if x != nil {
+		return x.WantAck
+	}
+	return false
+}
+
+func (x *Message) GetReason() Reason {
+	if x != nil {
+		return x.Reason
+	}
+	return Reason_NONE
+}
+
+func (x *Message) GetRoutes() []*Route {
+	if x != nil {
+		return x.Routes
+	}
+	return nil
 }
 
+func (x *Message) GetVia() []string {
+	if x != nil {
+		return x.Via
+	}
+	return nil
+}
+
+func (x *Message) GetFlood() uint64 {
+	if x != nil {
+		return x.Flood
+	}
+	return 0
+}
+
+func (x *Message) GetEncrypted() bool {
+	if x != nil {
+		return x.Encrypted
+	}
+	return false
+}
+
+func (x *Message) GetChunk() *Chunk {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+func (x *Message) GetCall() *Call {
+	if x != nil {
+		return x.Call
+	}
+	return nil
+}
+
+func (x *Message) GetEndpoints() []string {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+var File_relay_proto protoreflect.FileDescriptor
+
+const file_relay_proto_rawDesc = "" +
+	"\n" +
+	"\vrelay.proto\x12\x05relay\"e\n" +
+	"\x05Route\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x10\n" +
+	"\x03hub\x18\x02 \x01(\tR\x03hub\x12\x1c\n" +
+	"\tconnected\x18\x03 \x01(\bR\tconnected\x12\x18\n" +
+	"\aversion\x18\x04 \x01(\x04R\aversion\"K\n" +
+	"\x05Chunk\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\x04R\x06stream\x12\x14\n" +
+	"\x05index\x18\x02 \x01(\rR\x05index\x12\x14\n" +
+	"\x05count\x18\x03 \x01(\rR\x05count\"H\n" +
+	"\x04Call\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x1a\n" +
+	"\bresponse\x18\x02 \x01(\bR\bresponse\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"\xcd\x03\n" +
+	"\aMessage\x12\x16\n" +
+	"\x06sender\x18\x01 \x01(\tR\x06sender\x12\x1a\n" +
+	"\breceiver\x18\x02 \x01(\tR\breceiver\x12\x18\n" +
+	"\apayload\x18\x03 \x01(\fR\apayload\x12\x1f\n" +
+	"\x04kind\x18\x04 \x01(\x0e2\v.relay.KindR\x04kind\x12\x14\n" +
+	"\x05topic\x18\x05 \x01(\tR\x05topic\x12\x1c\n" +
+	"\tbroadcast\x18\x06 \x01(\bR\tbroadcast\x12\x0e\n" +
+	"\x02id\x18\a \x01(\x04R\x02id\x12\x19\n" +
+	"\bwant_ack\x18\b \x01(\bR\awantAck\x12%\n" +
+	"\x06reason\x18\t \x01(\x0e2\r.relay.ReasonR\x06reason\x12$\n" +
+	"\x06routes\x18\n" +
+	" \x03(\v2\f.relay.RouteR\x06routes\x12\x10\n" +
+	"\x03via\x18\v \x03(\tR\x03via\x12\x14\n" +
+	"\x05flood\x18\f \x01(\x04R\x05flood\x12\x1c\n" +
+	"\tencrypted\x18\r \x01(\bR\tencrypted\x12\"\n" +
+	"\x05chunk\x18\x0e \x01(\v2\f.relay.ChunkR\x05chunk\x12\x1f\n" +
+	"\x04call\x18\x0f \x01(\v2\v.relay.CallR\x04call\x12\x1c\n" +
+	"\tendpoints\x18\x10 \x03(\tR\tendpoints*\x80\x02\n" +
+	"\x04Kind\x12\b\n" +
+	"\x04DATA\x10\x00\x12\r\n" +
+	"\tCHALLENGE\x10\x01\x12\f\n" +
+	"\bREGISTER\x10\x02\x12\n" +
+	"\n" +
+	"\x06ACCEPT\x10\x03\x12\n" +
+	"\n" +
+	"\x06REJECT\x10\x04\x12\r\n" +
+	"\tSUBSCRIBE\x10\x05\x12\x0f\n" +
+	"\vUNSUBSCRIBE\x10\x06\x12\a\n" +
+	"\x03ACK\x10\a\x12\b\n" +
+	"\x04NACK\x10\b\x12\b\n" +
+	"\x04LINK\x10\t\x12\n" +
+	"\n" +
+	"\x06GOSSIP\x10\n" +
+	"\x12\x0f\n" +
+	"\vKEY_REQUEST\x10\v\x12\a\n" +
+	"\x03KEY\x10\f\x12\f\n" +
+	"\bPRESENCE\x10\r\x12\x10\n" +
+	"\fDIRECT_OFFER\x10\x0e\x12\x11\n" +
+	"\rDIRECT_ANSWER\x10\x0f\x12\x10\n" +
+	"\fDIRECT_HELLO\x10\x10\x12\x11\n" +
+	"\rDIRECT_SELECT\x10\x11*\\\n" +
+	"\x06Reason\x12\b\n" +
+	"\x04NONE\x10\x00\x12\x14\n" +
+	"\x10UNKNOWN_RECEIVER\x10\x01\x12\x0e\n" +
+	"\n" +
+	"QUEUE_FULL\x10\x02\x12\x10\n" +
+	"\fUNAUTHORIZED\x10\x03\x12\x10\n" +
+	"\fWRITE_FAILED\x10\x04B\x0eZ\fgen/relay_pbb\x06proto3"
+
 var (
 	file_relay_proto_rawDescOnce sync.Once
-	file_relay_proto_rawDescData = file_relay_proto_rawDesc
+	file_relay_proto_rawDescData []byte
 )
 
 func file_relay_proto_rawDescGZIP() []byte {
 	file_relay_proto_rawDescOnce.Do(func() {
-		file_relay_proto_rawDescData = protoimpl.X.CompressGZIP(file_relay_proto_rawDescData)
+		file_relay_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_relay_proto_rawDesc), len(file_relay_proto_rawDesc)))
 	})
 	return file_relay_proto_rawDescData
 }
 
-var file_relay_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
-var file_relay_proto_goTypes = []interface{}{
-	(*Message)(nil), // 0: relay.Message
+var file_relay_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_relay_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_relay_proto_goTypes = []any{
+	(Kind)(0),       // 0: relay.Kind
+	(Reason)(0),     // 1: relay.Reason
+	(*Route)(nil),   // 2: relay.Route
+	(*Chunk)(nil),   // 3: relay.Chunk
+	(*Call)(nil),    // 4: relay.Call
+	(*Message)(nil), // 5: relay.Message
 }
 var file_relay_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0, // 0: relay.Message.kind:type_name -> relay.Kind
+	1, // 1: relay.Message.reason:type_name -> relay.Reason
+	2, // 2: relay.Message.routes:type_name -> relay.Route
+	3, // 3: relay.Message.chunk:type_name -> relay.Chunk
+	4, // 4: relay.Message.call:type_name -> relay.Call
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_relay_proto_init() }
@@ -126,36 +632,22 @@ func file_relay_proto_init() {
 	if File_relay_proto != nil {
 		return
 	}
-	if !protoimpl.UnsafeEnabled {
-		file_relay_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Message); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
-			RawDescriptor: file_relay_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   1,
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_relay_proto_rawDesc), len(file_relay_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_relay_proto_goTypes,
 		DependencyIndexes: file_relay_proto_depIdxs,
+		EnumInfos:         file_relay_proto_enumTypes,
 		MessageInfos:      file_relay_proto_msgTypes,
 	}.Build()
 	File_relay_proto = out.File
-	file_relay_proto_rawDesc = nil
 	file_relay_proto_goTypes = nil
 	file_relay_proto_depIdxs = nil
 }
@@ -0,0 +1,299 @@
+package relay
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/line_slice"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/time_queue"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrQueueFull = errors.New("queue_full")
+)
+
+const (
+	DEFAULT_QUEUE_TTL          = time.Minute
+	DEFAULT_QUEUE_MAX_MESSAGES = 1024
+	DEFAULT_QUEUE_MAX_BYTES    = 16 << 20
+	DEFAULT_QUEUE_MAX_QUEUES   = 1024
+	DEFAULT_QUEUE_TOTAL_BYTES  = 256 << 20
+)
+
+// queued - message waiting for its receiver to register
+type queued struct {
+	Expire time.Time `json:"expire"`
+	Data   []byte    `json:"data"` // marshalled relay_pb.Message
+}
+
+// QueueStorage - where messages queued for a receiver are kept
+type QueueStorage interface {
+	Open(receiver string) (line_slice.LineSlice[queued], error)
+	Remove(receiver string) error
+}
+
+// MemoryStorage - queued messages are lost when the hub stops
+func MemoryStorage() QueueStorage {
+	return &memoryStorage{}
+}
+
+type memoryStorage struct{}
+
+func (memoryStorage) Open(receiver string) (line_slice.LineSlice[queued], error) {
+	return &memorySlice[queued]{}, nil
+}
+
+func (memoryStorage) Remove(receiver string) error {
+	return nil
+}
+
+type memorySlice[T any] struct {
+	values []T
+}
+
+func (s *memorySlice[T]) Get(i int) (T, error) {
+	return s.values[i], nil
+}
+
+func (s *memorySlice[T]) Push(v T) error {
+	s.values = append(s.values, v)
+	return nil
+}
+
+func (s *memorySlice[T]) Len() int {
+	return len(s.values)
+}
+
+func (s *memorySlice[T]) Close() error {
+	return nil
+}
+
+// DiskStorage - one jsonl file per receiver in dir, queued messages survive a restart of the hub
+// a file is removed once its messages are delivered, messages of a crashed delivery may be delivered twice
+func DiskStorage(dir string) (QueueStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskStorage{dir: dir}, nil
+}
+
+type diskStorage struct {
+	dir string
+}
+
+func (s *diskStorage) path(receiver string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(receiver))+".jsonl")
+}
+
+func (s *diskStorage) Open(receiver string) (line_slice.LineSlice[queued], error) {
+	return line_slice.NewLineSlice[queued](
+		s.path(receiver),
+		func(b []byte) (queued, error) {
+			var q queued
+			err := json.Unmarshal(b, &q)
+			return q, err
+		},
+		func(q queued) ([]byte, error) {
+			return json.Marshal(q)
+		},
+		'\n',
+	)
+}
+
+func (s *diskStorage) Remove(receiver string) error {
+	err := os.Remove(s.path(receiver))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// QueueConfig - store-and-forward for receivers that are not connected, nil Storage drops their messages
+// once MaxQueues receivers have messages queued, a receiver with none is an unknown receiver
+type QueueConfig struct {
+	Storage     QueueStorage
+	TTL         time.Duration
+	MaxMessages int // per receiver
+	MaxBytes    int // per receiver
+	MaxQueues   int // receivers with messages queued
+	TotalBytes  int // over all receivers
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Storage:     MemoryStorage(),
+		TTL:         DEFAULT_QUEUE_TTL,
+		MaxMessages: DEFAULT_QUEUE_MAX_MESSAGES,
+		MaxBytes:    DEFAULT_QUEUE_MAX_BYTES,
+		MaxQueues:   DEFAULT_QUEUE_MAX_QUEUES,
+		TotalBytes:  DEFAULT_QUEUE_TOTAL_BYTES,
+	}
+}
+
+// expiryKey - the index-th message of a queue, gen tells a queue apart from a removed queue of the same receiver
+type expiryKey struct {
+	receiver string
+	gen      uint64
+	index    int
+}
+
+type pending struct {
+	expire time.Time
+	size   int
+}
+
+// queue - messages [head, slice.Len()) are not yet delivered nor expired
+type queue struct {
+	gen     uint64
+	slice   line_slice.LineSlice[queued]
+	head    int
+	pending []pending
+	bytes   int
+}
+
+type queueStore struct {
+	config QueueConfig
+	mu     sync.Mutex
+	gen    uint64
+	queues map[string]*queue
+	bytes  int // over all queues
+	expiry *time_queue.Queue[expiryKey]
+}
+
+func newQueueStore(config QueueConfig) *queueStore {
+	return &queueStore{
+		config: config,
+		queues: make(map[string]*queue),
+		expiry: time_queue.New[expiryKey](),
+	}
+}
+
+// open - not thread-safe, reload messages left by a previous hub
+func (s *queueStore) open(receiver string) (*queue, error) {
+	if q, ok := s.queues[receiver]; ok {
+		return q, nil
+	}
+	slice, err := s.config.Storage.Open(receiver)
+	if err != nil {
+		return nil, err
+	}
+	s.gen++
+	q := &queue{gen: s.gen, slice: slice}
+	for i := 0; i < slice.Len(); i++ {
+		v, err := slice.Get(i)
+		if err != nil {
+			_ = slice.Close()
+			return nil, err
+		}
+		q.pending = append(q.pending, pending{expire: v.Expire, size: len(v.Data)})
+		q.bytes += len(v.Data)
+		s.expiry.Schedule(time_queue.Item[expiryKey]{
+			Time:  v.Expire,
+			Value: expiryKey{receiver: receiver, gen: q.gen, index: i},
+		})
+	}
+	s.queues[receiver] = q
+	s.bytes += q.bytes
+	return q, nil
+}
+
+// push - queue m for its receiver, ErrQueueFull if the receiver or the store is over its limits
+// made-up receivers cannot take more than MaxQueues queues and TotalBytes
+func (s *queueStore) push(m *relay_pb.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[m.Receiver]; !ok && len(s.queues) >= s.config.MaxQueues {
+		return ErrUnknownReceiver
+	}
+	if s.bytes+len(data) > s.config.TotalBytes {
+		return ErrQueueFull
+	}
+	q, err := s.open(m.Receiver)
+	if err != nil {
+		return err
+	}
+	if len(q.pending)+1 > s.config.MaxMessages || q.bytes+len(data) > s.config.MaxBytes {
+		return ErrQueueFull
+	}
+	expire := time.Now().Add(s.config.TTL)
+	if err := q.slice.Push(queued{Expire: expire, Data: data}); err != nil {
+		return err
+	}
+	q.pending = append(q.pending, pending{expire: expire, size: len(data)})
+	q.bytes += len(data)
+	s.bytes += len(data)
+	s.expiry.Schedule(time_queue.Item[expiryKey]{
+		Time:  expire,
+		Value: expiryKey{receiver: m.Receiver, gen: q.gen, index: q.slice.Len() - 1},
+	})
+	return nil
+}
+
+// take - remove and return the unexpired messages queued for receiver, oldest first
+func (s *queueStore) take(receiver string) ([]*relay_pb.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.open(receiver)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var messages []*relay_pb.Message
+	for i := q.head; i < q.slice.Len(); i++ {
+		v, err := q.slice.Get(i)
+		if err != nil {
+			return nil, err
+		}
+		if v.Expire.Before(now) {
+			continue
+		}
+		m := &relay_pb.Message{}
+		if err := proto.Unmarshal(v.Data, m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	delete(s.queues, receiver)
+	s.bytes -= q.bytes
+	_ = q.slice.Close()
+	return messages, s.config.Storage.Remove(receiver)
+}
+
+// expire - drop messages up to key.index, messages of a receiver expire in the order they are queued
+func (s *queueStore) expire(key expiryKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[key.receiver]
+	if !ok || q.gen != key.gen {
+		return
+	}
+	for q.head <= key.index && len(q.pending) > 0 {
+		q.bytes -= q.pending[0].size
+		s.bytes -= q.pending[0].size
+		q.pending = q.pending[1:]
+		q.head++
+	}
+	if len(q.pending) == 0 {
+		delete(s.queues, key.receiver)
+		_ = q.slice.Close()
+		_ = s.config.Storage.Remove(key.receiver)
+	}
+}
+
+func (s *queueStore) run(ctx context.Context) {
+	for item := range s.expiry.Dispatch(ctx) {
+		s.expire(item.Value)
+	}
+}
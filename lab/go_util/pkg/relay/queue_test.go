@@ -0,0 +1,109 @@
+package relay_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func mustRegister(t *testing.T, hubAddr string, name string) (relay.Peer, chan *relay_pb.Message) {
+	tp := connect(t, hubAddr, name, nil)
+	if err := waitRegistered(t, tp); err != nil {
+		t.Fatal(err)
+	}
+	return tp, tp.received
+}
+
+func sendN(t *testing.T, p relay.Peer, receiver string, n int) {
+	for i := 0; i < n; i++ {
+		if err := p.Write(&relay_pb.Message{Receiver: receiver, Payload: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectInOrder(t *testing.T, received chan *relay_pb.Message, n int) {
+	for i := 0; i < n; i++ {
+		if m := receive(t, received); string(m.Payload) != fmt.Sprint(i) {
+			t.Fatalf("expected %d, got %s", i, m.Payload)
+		}
+	}
+	expectNothing(t, received)
+}
+
+func TestHubQueueOffline(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.MaxMessages = 5
+	addr := startHub(t, config)
+
+	alice, _ := mustRegister(t, addr, "alice")
+	sendN(t, alice, "bob", 8) // the last 3 are over the limit
+	time.Sleep(50 * time.Millisecond)
+
+	_, bobReceived := mustRegister(t, addr, "bob")
+	expectInOrder(t, bobReceived, 5)
+}
+
+func TestHubQueueTTL(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.TTL = 50 * time.Millisecond
+	addr := startHub(t, config)
+
+	alice, _ := mustRegister(t, addr, "alice")
+	sendN(t, alice, "bob", 3)
+	time.Sleep(100 * time.Millisecond)
+
+	_, bobReceived := mustRegister(t, addr, "bob")
+	expectInOrder(t, bobReceived, 0)
+}
+
+func TestHubQueueDisk(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := relay.DiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := relay.DefaultHubConfig()
+	config.Queue.Storage = storage
+
+	// messages queued by a hub are delivered by the next hub on the same dir
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+	sendN(t, alice, "bob", 3)
+	time.Sleep(50 * time.Millisecond)
+
+	addr = startHub(t, config)
+	_, bobReceived := mustRegister(t, addr, "bob")
+	expectInOrder(t, bobReceived, 3)
+}
+
+func TestHubQueueLimits(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.MaxQueues = 2
+	config.Queue.TotalBytes = 40
+	addr := startHub(t, config)
+	alice, _ := mustRegister(t, addr, "alice")
+
+	// both limits are shared by every receiver
+	if err := send(alice, "bob", 50*time.Millisecond); !errors.Is(err, relay.ErrNoAck) {
+		t.Fatalf("expected no ack, got %v", err)
+	}
+	if err := send(alice, "carol", time.Second); !errors.Is(err, relay.ErrQueueFull) {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+	config.Queue.TotalBytes = relay.DEFAULT_QUEUE_TOTAL_BYTES
+	addr = startHub(t, config)
+	alice, _ = mustRegister(t, addr, "alice")
+	for _, name := range []string{"bob", "carol"} {
+		if err := send(alice, name, 50*time.Millisecond); !errors.Is(err, relay.ErrNoAck) {
+			t.Fatalf("expected no ack, got %v", err)
+		}
+	}
+	if err := send(alice, "mallory", time.Second); !errors.Is(err, relay.ErrUnknownReceiver) {
+		t.Fatalf("expected unknown receiver, got %v", err)
+	}
+}
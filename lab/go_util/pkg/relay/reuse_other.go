@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package relay
+
+import (
+	"syscall"
+)
+
+// connections are dialed from a random port, direct connections then only work without NAT
+const reusePortSupported = false
+
+func reusePort(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/dispatcher"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+var (
+	ErrCallTimeout  = errors.New("call_timeout")
+	ErrCallFailed   = errors.New("call_failed")
+	ErrNoDispatcher = errors.New("no_dispatcher")
+	ErrBusy         = errors.New("busy")
+)
+
+const (
+	DEFAULT_CALL_TIMEOUT     = 10 * time.Second
+	DEFAULT_RPC_CONCURRENCY  = 16
+	DEFAULT_RPC_QUEUE_LENGTH = 64
+)
+
+// RPCPeer - Transport calls the dispatcher served by another peer, requests of other peers are handled by the dispatcher of this peer
+type RPCPeer interface {
+	Peer
+	Transport(ctx context.Context, receiver string) rpc.TransportFunc
+}
+
+// RPCConfig - Dispatcher handles requests of other peers, nil answers them with ErrNoDispatcher
+// Handlers runs the requests, nil runs them one after another, those it rejects are answered with ErrBusy
+// Timeout applies to calls whose ctx has no deadline
+type RPCConfig struct {
+	Dispatcher rpc.Dispatcher
+	Handlers   dispatcher.Dispatcher
+	Timeout    time.Duration
+}
+
+func DefaultRPCConfig(d rpc.Dispatcher) RPCConfig {
+	return RPCConfig{
+		Dispatcher: d,
+		Handlers:   dispatcher.NewQueueDispatcher(DEFAULT_RPC_QUEUE_LENGTH, DEFAULT_RPC_CONCURRENCY),
+		Timeout:    DEFAULT_CALL_TIMEOUT,
+	}
+}
+
+// NewRPCPeer - requests and responses are data to a single receiver, so they are acked, chunked and sealed like any other
+// serve of DialAndServe does not see them
+func NewRPCPeer(p Peer, config RPCConfig) RPCPeer {
+	return &rpcPeer{
+		Peer:    p,
+		config:  config,
+		waiting: make(map[uint64]pendingCall),
+		busy:    make(chan *relay_pb.Message, DEFAULT_PEER_BUFFER_SIZE),
+	}
+}
+
+// pendingCall - only receiver can answer the call
+type pendingCall struct {
+	receiver string
+	done     chan *relay_pb.Message
+}
+
+type rpcPeer struct {
+	Peer
+	config  RPCConfig
+	mu      sync.Mutex
+	lastId  uint64
+	waiting map[uint64]pendingCall // by call id
+	busy    chan *relay_pb.Message // answers to rejected requests, written by writeBusy
+}
+
+func (p *rpcPeer) wait(receiver string) (uint64, chan *relay_pb.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastId++
+	done := make(chan *relay_pb.Message, 1)
+	p.waiting[p.lastId] = pendingCall{receiver: receiver, done: done}
+	return p.lastId, done
+}
+
+func (p *rpcPeer) cancel(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, id)
+}
+
+func (p *rpcPeer) resolve(m *relay_pb.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.waiting[m.Call.Id]; ok && c.receiver == m.Sender {
+		delete(p.waiting, m.Call.Id)
+		c.done <- m
+	}
+}
+
+// Transport - the request is acked by receiver before its response is awaited, so an unknown receiver fails fast
+func (p *rpcPeer) Transport(ctx context.Context, receiver string) rpc.TransportFunc {
+	return func(b []byte) ([]byte, error) {
+		ctx := ctx
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.config.Timeout)
+			defer cancel()
+		}
+		id, done := p.wait(receiver)
+		defer p.cancel(id)
+		err := p.Send(ctx, &relay_pb.Message{
+			Receiver: receiver,
+			Payload:  b,
+			Call:     &relay_pb.Call{Id: id},
+		})
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case m := <-done:
+			if m.Call.Error != "" {
+				return nil, fmt.Errorf("%w: %s", ErrCallFailed, m.Call.Error)
+			}
+			return m.Payload, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %w", ErrCallTimeout, receiver, ctx.Err())
+		}
+	}
+}
+
+func response(m *relay_pb.Message, out []byte, err error) *relay_pb.Message {
+	r := &relay_pb.Message{
+		Receiver: m.Sender,
+		Payload:  out,
+		Call:     &relay_pb.Call{Id: m.Call.Id, Response: true},
+	}
+	if err != nil {
+		r.Call.Error = err.Error()
+	}
+	return r
+}
+
+// handle - answer a request of another peer
+func (p *rpcPeer) handle(m *relay_pb.Message) {
+	var out []byte
+	err := ErrNoDispatcher
+	if p.config.Dispatcher != nil {
+		out, err = p.config.Dispatcher.Handle(m.Payload)
+	}
+	if err := p.Write(response(m, out, err)); err != nil {
+		fmt.Printf("[peer_%s] response to %s dropped: %v\n", p.Name(), m.Sender, err)
+	}
+}
+
+// writeBusy - rejected requests are answered apart from the read loop until done is closed
+func (p *rpcPeer) writeBusy(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case r := <-p.busy:
+			_ = p.Write(r)
+		}
+	}
+}
+
+// DialAndServe - requests are handled through Handlers so that a slow handler does not hold up other messages
+func (p *rpcPeer) DialAndServe(serve func(m *relay_pb.Message)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go p.writeBusy(done)
+	return p.Peer.DialAndServe(func(m *relay_pb.Message) {
+		switch {
+		case m.Kind != relay_pb.Kind_DATA || m.Call == nil:
+			serve(m)
+		case m.Call.Response:
+			p.resolve(m)
+		case p.config.Handlers == nil:
+			p.handle(m)
+		case !p.config.Handlers.Dispatch(func() { p.handle(m) }):
+			select {
+			case p.busy <- response(m, nil, ErrBusy):
+			default: // the caller times out
+			}
+		}
+	})
+}
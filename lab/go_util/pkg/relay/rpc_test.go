@@ -0,0 +1,112 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/dispatcher"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+type echoReq struct {
+	Text string
+}
+
+func rpcPeer(t *testing.T, addr string, name string, dispatcher rpc.Dispatcher) relay.RPCPeer {
+	return rpcPeerConfig(t, addr, name, relay.DefaultRPCConfig(dispatcher))
+}
+
+func rpcPeerConfig(t *testing.T, addr string, name string, config relay.RPCConfig) relay.RPCPeer {
+	var p relay.RPCPeer
+	tp := connectWith(t, addr, name, nil, func(peer relay.Peer) relay.Peer {
+		p = relay.NewRPCPeer(peer, config)
+		return p
+	})
+	waitState(t, tp, relay.PeerConnected)
+	return p
+}
+
+func TestRPCOverRelay(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.Storage = nil
+	addr := startHub(t, config)
+	d := rpc.NewDispatcher().Register("Echo", func(req *echoReq) *echoReq {
+		if req.Text == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return req
+	})
+	rpcPeer(t, addr, "server", d)
+	client := rpcPeer(t, addr, "client", nil)
+
+	ctx := context.Background()
+	res, err := rpc.RPC[echoReq, echoReq](client.Transport(ctx, "server"), "Echo", &echoReq{Text: "hi"})
+	if err != nil || res.Text != "hi" {
+		t.Fatalf("unexpected response %v %v", res, err)
+	}
+	if _, err := rpc.RPC[echoReq, echoReq](client.Transport(ctx, "server"), "Missing", &echoReq{}); !errors.Is(err, relay.ErrCallFailed) {
+		t.Fatalf("expected call failed, got %v", err)
+	}
+	// client does not serve a dispatcher
+	if _, err := rpc.RPC[echoReq, echoReq](client.Transport(ctx, "client"), "Echo", &echoReq{}); !errors.Is(err, relay.ErrCallFailed) {
+		t.Fatalf("expected call failed, got %v", err)
+	}
+	if _, err := rpc.RPC[echoReq, echoReq](client.Transport(ctx, "nobody"), "Echo", &echoReq{}); !errors.Is(err, relay.ErrUnknownReceiver) {
+		t.Fatalf("expected unknown receiver, got %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := rpc.RPC[echoReq, echoReq](client.Transport(timeout, "server"), "Echo", &echoReq{Text: "slow"}); !errors.Is(err, relay.ErrCallTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestRPCOverRelayBusy(t *testing.T) {
+	config := relay.DefaultHubConfig()
+	config.Queue.Storage = nil
+	addr := startHub(t, config)
+	release := make(chan struct{})
+	d := rpc.NewDispatcher().Register("Echo", func(req *echoReq) *echoReq {
+		<-release
+		return req
+	})
+	serverConfig := relay.DefaultRPCConfig(d)
+	serverConfig.Handlers = dispatcher.NewQueueDispatcher(1, 1)
+	rpcPeerConfig(t, addr, "server", serverConfig)
+	client := rpcPeer(t, addr, "client", nil)
+
+	// beyond the one running and the one queued, requests are rejected
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := rpc.RPC[echoReq, echoReq](client.Transport(context.Background(), "server"), "Echo", &echoReq{Text: "hi"})
+			errs <- err
+		}()
+	}
+	isBusy := func(err error) bool {
+		return errors.Is(err, relay.ErrCallFailed) && strings.Contains(err.Error(), relay.ErrBusy.Error())
+	}
+	if err := <-errs; !isBusy(err) {
+		t.Fatalf("expected busy, got %v", err)
+	}
+	close(release)
+	handled := 0
+	for i := 1; i < n; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			handled++
+		case !isBusy(err):
+			t.Fatal(err)
+		}
+	}
+	if handled == 0 {
+		t.Fatal("expected accepted requests to be handled")
+	}
+}
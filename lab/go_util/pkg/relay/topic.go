@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidTopic = errors.New("invalid_topic")
+)
+
+// topics are tokens separated by ".", in a pattern "*" matches one token and a trailing ">" matches one or more tokens
+// topics starting with "$" are published by the hub and only matched by patterns starting with the same token
+
+const (
+	PresenceJoin  = "$presence.join"
+	PresenceLeave = "$presence.leave"
+)
+
+func reserved(topic string) bool {
+	return strings.HasPrefix(topic, "$")
+}
+
+// ValidatePattern - no empty token, ">" only as the last token
+func ValidatePattern(pattern string) error {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "" || (token == ">" && i != len(tokens)-1) {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// ValidateTopic - no empty token, no wildcard
+func ValidateTopic(topic string) error {
+	for _, token := range strings.Split(topic, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// MatchTopic - whether topic matches pattern
+func MatchTopic(pattern string, topic string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+	if reserved(topic) && (patternTokens[0] == "*" || patternTokens[0] == ">") {
+		return false
+	}
+	for i, p := range patternTokens {
+		if p == ">" {
+			return len(topicTokens) > i
+		}
+		if i >= len(topicTokens) || (p != "*" && p != topicTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(topicTokens)
+}
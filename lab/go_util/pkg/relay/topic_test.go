@@ -0,0 +1,94 @@
+package relay_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/relay/proto/gen/relay_pb"
+)
+
+func TestMatchTopic(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"*.b.*", "a.b.c", true},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{">", "a.b", true},
+		{">", relay.PresenceJoin, false},
+		{"*.join", relay.PresenceJoin, false},
+		{"$presence.>", relay.PresenceJoin, true},
+	} {
+		if relay.MatchTopic(c.pattern, c.topic) != c.match {
+			t.Fatalf("MatchTopic(%q, %q) must be %v", c.pattern, c.topic, c.match)
+		}
+	}
+	for _, pattern := range []string{"", "a..b", "a.>.b"} {
+		if relay.ValidatePattern(pattern) == nil {
+			t.Fatalf("pattern %q must be invalid", pattern)
+		}
+	}
+	if relay.ValidateTopic("a.*") == nil {
+		t.Fatal("topic must not contain wildcards")
+	}
+}
+
+func expectNothing(t *testing.T, received chan *relay_pb.Message) {
+	select {
+	case m := <-received:
+		t.Fatalf("unexpected message %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubTopics(t *testing.T) {
+	addr := startHub(t, relay.DefaultHubConfig())
+	alice, aliceReceived := mustRegister(t, addr, "alice")
+	bob, bobReceived := mustRegister(t, addr, "bob")
+	carol, carolReceived := mustRegister(t, addr, "carol")
+
+	for _, sub := range []struct {
+		p       relay.Peer
+		pattern string
+	}{
+		{alice, "news.>"},
+		{bob, "news.*"},
+		{carol, "weather"},
+	} {
+		if err := sub.p.Subscribe(sub.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the publisher does not receive its own message
+	_ = alice.Write(&relay_pb.Message{Topic: "news.sport", Payload: []byte("goal")})
+	if m := receive(t, bobReceived); m.Sender != "alice" || m.Topic != "news.sport" {
+		t.Fatalf("unexpected message %v", m)
+	}
+	expectNothing(t, aliceReceived)
+	expectNothing(t, carolReceived)
+
+	_ = carol.Write(&relay_pb.Message{Topic: "news.sport.football", Payload: []byte("goal")})
+	receive(t, aliceReceived)
+	expectNothing(t, bobReceived)
+
+	_ = bob.Unsubscribe("news.*")
+	time.Sleep(50 * time.Millisecond)
+	_ = carol.Write(&relay_pb.Message{Topic: "news.sport", Payload: []byte("goal")})
+	receive(t, aliceReceived)
+	expectNothing(t, bobReceived)
+
+	_ = bob.Write(&relay_pb.Message{Broadcast: true, Payload: []byte("hello")})
+	receive(t, aliceReceived)
+	receive(t, carolReceived)
+	expectNothing(t, bobReceived)
+}
@@ -11,18 +11,33 @@ import (
 
 var sizeError = errors.New("size")
 
+var ErrFrameTooLarge = errors.New("frame_too_large")
+
+const DEFAULT_MAX_FRAME_SIZE = 1 << 20
+
+// setDefault - v is d if it is zero
+func setDefault[T comparable](v *T, d T) {
+	var zero T
+	if *v == zero {
+		*v = d
+	}
+}
+
 func readExact(reader io.Reader, size int) ([]byte, error) {
 	buffer := make([]byte, size)
 	n, err := io.ReadFull(reader, buffer)
 	return buffer[:n], err
 }
 
-// readAndUnmarshal : not thread-safe
-func readAndUnmarshal(reader io.Reader) ([]byte, *relay_pb.Message, error) {
+// readAndUnmarshal : not thread-safe, frames larger than maxSize are not read
+func readAndUnmarshal(reader io.Reader, maxSize int) ([]byte, *relay_pb.Message, error) {
 	sizeBuffer, err := readExact(reader, 8)
 	if err != nil {
 		return nil, nil, err
 	}
+	if binary.LittleEndian.Uint64(sizeBuffer) > uint64(maxSize) {
+		return nil, nil, ErrFrameTooLarge
+	}
 	size := int(binary.LittleEndian.Uint64(sizeBuffer))
 	dataBuffer, err := readExact(reader, size)
 	if err != nil {
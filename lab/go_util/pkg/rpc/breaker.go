@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker - circuit breaker, opens after threshold consecutive failures,
+// after cooldown lets a single trial call through (half open), closes again if the trial succeeds
+type breaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a trial call is in flight, only in half open
+}
+
+// allow - whether a call can go through, changed reports a transition to half open
+func (b *breaker) allow(now time.Time, cooldown time.Duration) (ok bool, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false, false
+		}
+		b.state, b.trial = breakerHalfOpen, true
+		return true, true
+	case breakerHalfOpen:
+		if b.trial {
+			return false, false
+		}
+		b.trial = true
+		return true, false
+	default:
+		return true, false
+	}
+}
+
+// report - record the result of a call, changed reports a transition to the returned state
+func (b *breaker) report(now time.Time, failed bool, threshold int) (state breakerState, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := b.state
+	b.trial = false
+	switch {
+	case !failed:
+		b.state, b.failures = breakerClosed, 0
+	case b.state == breakerHalfOpen:
+		b.state, b.openedAt = breakerOpen, now
+	default:
+		b.failures++
+		if threshold > 0 && b.failures >= threshold {
+			b.state, b.openedAt = breakerOpen, now
+		}
+	}
+	return b.state, b.state != old
+}
@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/logger"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
+type Balancer int
+
+const (
+	RoundRobin Balancer = iota
+	LeastLoaded
+)
+
+type EventKind string
+
+const (
+	EventSuccess         EventKind = "success"
+	EventFailure         EventKind = "failure"
+	EventRetry           EventKind = "retry"
+	EventBreakerOpen     EventKind = "breaker_open"
+	EventBreakerHalfOpen EventKind = "breaker_half_open"
+	EventBreakerClose    EventKind = "breaker_close"
+)
+
+// Event - something happened to a call or an endpoint
+type Event struct {
+	Kind     EventKind
+	Endpoint string
+	Cmd      string
+	Attempt  int
+	Elapsed  time.Duration // duration of the attempt, or backoff before the next attempt for EventRetry
+	Err      error
+}
+
+type ClientConfig struct {
+	Balancer         Balancer
+	Timeout          time.Duration         // deadline of a call if ctx has none, including retries, 0 - no deadline
+	MaxAttempts      int                   // attempts per call
+	BaseBackoff      time.Duration         // backoff after the first failed attempt, doubled after each attempt
+	MaxBackoff       time.Duration         // upper bound of backoff
+	Idempotent       func(cmd string) bool // commands that are safe to send twice, nil - none
+	BreakerThreshold int                   // consecutive failures to dial, write or read before an endpoint is skipped, 0 - never
+	BreakerCooldown  time.Duration         // time before a skipped endpoint is tried again
+	Dial             func(ctx context.Context, addr string) TransportFunc
+	OnEvent          func(Event) // nil - ignore events
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Balancer:         RoundRobin,
+		Timeout:          DEFAULT_TCP_TIMEOUT,
+		MaxAttempts:      3,
+		BaseBackoff:      50 * time.Millisecond,
+		MaxBackoff:       2 * time.Second,
+		Idempotent:       nil,
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Second,
+		Dial: func(ctx context.Context, addr string) TransportFunc {
+			return TCPTransport(ctx, addr, NewMessageIO())
+		},
+		OnEvent: nil,
+	}
+}
+
+// IdempotentCmds - Idempotent for a fixed list of commands
+func IdempotentCmds(cmds ...string) func(cmd string) bool {
+	return func(cmd string) bool {
+		return slices.Contains(cmds, cmd)
+	}
+}
+
+// LogEvents - OnEvent that writes events to l
+func LogEvents(l logger.Logger) func(Event) {
+	return func(e Event) {
+		ctx := l.Now().WithField("endpoint", e.Endpoint).WithField("cmd", e.Cmd).WithField("attempt", e.Attempt).WithField("elapsed", e.Elapsed.String())
+		switch e.Kind {
+		case EventSuccess, EventBreakerClose:
+			ctx.Info("rpc client %s", e.Kind)
+		default:
+			ctx.Error("rpc client %s: %v", e.Kind, e.Err)
+		}
+	}
+}
+
+// Client - spread calls over several endpoints serving the same dispatcher
+type Client struct {
+	config    ClientConfig
+	endpoints []*endpoint
+	next      uint64
+}
+
+type endpoint struct {
+	addr     string
+	inflight int64
+	breaker  breaker
+}
+
+func NewClient(addrs []string, config ClientConfig) *Client {
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		endpoints = append(endpoints, &endpoint{addr: addr})
+	}
+	return &Client{
+		config:    config,
+		endpoints: endpoints,
+		next:      0,
+	}
+}
+
+// Transport - transport for calls made under ctx
+func (c *Client) Transport(ctx context.Context) TransportFunc {
+	return func(b []byte) ([]byte, error) {
+		callCtx := ctx
+		if _, ok := ctx.Deadline(); !ok && c.config.Timeout > 0 {
+			var cancel func()
+			callCtx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+			defer cancel()
+		}
+		msg := message{}
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return nil, err
+		}
+		idempotent := c.config.Idempotent != nil && c.config.Idempotent(msg.Cmd)
+
+		var lastErr error
+		for attempt := 1; ; attempt++ {
+			e := c.pick()
+			if e == nil {
+				if lastErr != nil {
+					return nil, lastErr
+				}
+				return nil, ErrNoEndpoint
+			}
+			start := time.Now()
+			out, err := c.attempt(callCtx, e, b)
+			c.report(e, msg.Cmd, attempt, time.Since(start), err)
+			// an error of the server would be the same on another attempt
+			if err == nil || isRemoteError(err) {
+				return out, err
+			}
+			lastErr = err
+
+			// a request that failed to dial was never sent, so it is safe to retry
+			if attempt >= c.config.MaxAttempts || !(idempotent || isDialError(err)) {
+				return nil, lastErr
+			}
+			backoff := c.backoff(attempt)
+			c.emit(Event{Kind: EventRetry, Endpoint: e.addr, Cmd: msg.Cmd, Attempt: attempt, Elapsed: backoff, Err: err})
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-callCtx.Done():
+				timer.Stop()
+				return nil, lastErr
+			}
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, e *endpoint, b []byte) ([]byte, error) {
+	atomic.AddInt64(&e.inflight, 1)
+	defer atomic.AddInt64(&e.inflight, -1)
+	return c.config.Dial(ctx, e.addr)(b)
+}
+
+// pick - next endpoint whose breaker allows a call, nil if none
+func (c *Client) pick() *endpoint {
+	n := len(c.endpoints)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&c.next, 1) % uint64(n))
+	candidates := make([]*endpoint, 0, n)
+	for i := 0; i < n; i++ {
+		candidates = append(candidates, c.endpoints[(start+i)%n])
+	}
+	if c.config.Balancer == LeastLoaded {
+		slices.SortStableFunc(candidates, func(a, b *endpoint) int {
+			return int(atomic.LoadInt64(&a.inflight) - atomic.LoadInt64(&b.inflight))
+		})
+	}
+	now := time.Now()
+	for _, e := range candidates {
+		ok, changed := e.breaker.allow(now, c.config.BreakerCooldown)
+		if changed {
+			c.emit(Event{Kind: EventBreakerHalfOpen, Endpoint: e.addr})
+		}
+		if ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Client) report(e *endpoint, cmd string, attempt int, elapsed time.Duration, err error) {
+	if err == nil {
+		c.emit(Event{Kind: EventSuccess, Endpoint: e.addr, Cmd: cmd, Attempt: attempt, Elapsed: elapsed})
+	} else {
+		c.emit(Event{Kind: EventFailure, Endpoint: e.addr, Cmd: cmd, Attempt: attempt, Elapsed: elapsed, Err: err})
+	}
+	// the endpoint answered if the error came from the server
+	failed := err != nil && !isRemoteError(err)
+	state, changed := e.breaker.report(time.Now(), failed, c.config.BreakerThreshold)
+	if !changed {
+		return
+	}
+	switch state {
+	case breakerOpen:
+		c.emit(Event{Kind: EventBreakerOpen, Endpoint: e.addr, Err: err})
+	case breakerClosed:
+		c.emit(Event{Kind: EventBreakerClose, Endpoint: e.addr})
+	}
+}
+
+// backoff - exponential backoff with jitter in [d/2, d]
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.config.BaseBackoff
+	for i := 1; i < attempt && d < c.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, c.config.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func (c *Client) emit(e Event) {
+	if c.config.OnEvent != nil {
+		c.config.OnEvent(e)
+	}
+}
+
+func isDialError(err error) bool {
+	opErr := &net.OpError{}
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
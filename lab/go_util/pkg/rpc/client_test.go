@@ -0,0 +1,201 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+// fakeEndpoints - Dial for tests, endpoints in down fail, the others are served by d
+type fakeEndpoints struct {
+	mu    sync.Mutex
+	d     rpc.Dispatcher
+	down  map[string]bool
+	calls map[string]int
+}
+
+func newFakeEndpoints(down ...string) *fakeEndpoints {
+	f := &fakeEndpoints{
+		d:     newAddDispatcher(),
+		down:  make(map[string]bool),
+		calls: make(map[string]int),
+	}
+	for _, addr := range down {
+		f.down[addr] = true
+	}
+	return f
+}
+
+func (f *fakeEndpoints) dial(ctx context.Context, addr string) rpc.TransportFunc {
+	return func(b []byte) ([]byte, error) {
+		f.mu.Lock()
+		f.calls[addr]++
+		down := f.down[addr]
+		f.mu.Unlock()
+		if down {
+			return nil, errors.New("connection reset")
+		}
+		return f.d.Handle(b)
+	}
+}
+
+func (f *fakeEndpoints) count(addr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[addr]
+}
+
+func testClientConfig(f *fakeEndpoints, events *[]rpc.Event) rpc.ClientConfig {
+	config := rpc.DefaultClientConfig()
+	config.BaseBackoff = time.Millisecond
+	config.MaxBackoff = 4 * time.Millisecond
+	config.Dial = f.dial
+	config.OnEvent = func(e rpc.Event) {
+		*events = append(*events, e)
+	}
+	return config
+}
+
+func countEvents(events []rpc.Event, kind rpc.EventKind) int {
+	n := 0
+	for _, e := range events {
+		if e.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func TestClientRoundRobin(t *testing.T) {
+	f := newFakeEndpoints()
+	var events []rpc.Event
+	c := rpc.NewClient([]string{"a", "b", "c"}, testClientConfig(f, &events))
+	for i := 0; i < 6; i++ {
+		checkAdd(t, c.Transport(context.Background()))
+	}
+	for _, addr := range []string{"a", "b", "c"} {
+		if f.count(addr) != 2 {
+			t.Fatalf("expected 2 calls to %s, got %d", addr, f.count(addr))
+		}
+	}
+}
+
+func TestClientRetryIdempotent(t *testing.T) {
+	f := newFakeEndpoints("a", "b")
+	var events []rpc.Event
+	config := testClientConfig(f, &events)
+	config.Idempotent = rpc.IdempotentCmds("add")
+	c := rpc.NewClient([]string{"a", "b", "c"}, config)
+
+	checkAdd(t, c.Transport(context.Background()))
+	if countEvents(events, rpc.EventSuccess) != 1 || countEvents(events, rpc.EventRetry) == 0 {
+		t.Fatalf("expected retries then success, got %v", events)
+	}
+
+	config.Idempotent = nil
+	events = nil
+	c = rpc.NewClient([]string{"a"}, config)
+	if _, err := rpc.RPC[addReq, addRes](c.Transport(context.Background()), "add", &addReq{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if countEvents(events, rpc.EventRetry) != 0 {
+		t.Fatal("non idempotent command must not be retried")
+	}
+}
+
+func TestClientRetryDialError(t *testing.T) {
+	// a port nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := listener.Addr().String()
+	_ = listener.Close()
+
+	running := int64(0)
+	addr, _, _ := startServer(t, rpc.DefaultServerConfig(), newSleepDispatcher(&running))
+
+	config := rpc.DefaultClientConfig()
+	config.BaseBackoff = time.Millisecond
+	c := rpc.NewClient([]string{deadAddr, addr}, config)
+	for i := 0; i < 2; i++ {
+		checkAdd(t, c.Transport(context.Background()))
+	}
+}
+
+func TestClientBreaker(t *testing.T) {
+	f := newFakeEndpoints("a")
+	var events []rpc.Event
+	config := testClientConfig(f, &events)
+	config.Idempotent = rpc.IdempotentCmds("add")
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = 50 * time.Millisecond
+	c := rpc.NewClient([]string{"a", "b"}, config)
+
+	for i := 0; i < 10; i++ {
+		checkAdd(t, c.Transport(context.Background()))
+	}
+	if f.count("a") != 2 || countEvents(events, rpc.EventBreakerOpen) != 1 {
+		t.Fatalf("expected breaker to open after 2 failures, got %d calls %v", f.count("a"), events)
+	}
+
+	f.mu.Lock()
+	f.down["a"] = false
+	f.mu.Unlock()
+	time.Sleep(config.BreakerCooldown)
+	for i := 0; i < 4; i++ {
+		checkAdd(t, c.Transport(context.Background()))
+	}
+	if countEvents(events, rpc.EventBreakerHalfOpen) != 1 || countEvents(events, rpc.EventBreakerClose) != 1 {
+		t.Fatalf("expected breaker to close after cooldown, got %v", events)
+	}
+}
+
+func TestClientRemoteError(t *testing.T) {
+	addr, _, _ := startServer(t, rpc.DefaultServerConfig(), newAddDispatcher())
+	var events []rpc.Event
+	config := rpc.DefaultClientConfig()
+	config.Idempotent = rpc.IdempotentCmds("missing")
+	config.BreakerThreshold = 2
+	config.OnEvent = func(e rpc.Event) {
+		events = append(events, e)
+	}
+	c := rpc.NewClient([]string{addr}, config)
+
+	// the server answered, so it is neither retried nor held against the endpoint
+	for i := 0; i < 4; i++ {
+		if _, err := rpc.RPC[addReq, addRes](c.Transport(context.Background()), "missing", &addReq{}); !errors.Is(err, rpc.ErrCommandNotFound) {
+			t.Fatalf("expected command not found, got %v", err)
+		}
+	}
+	if countEvents(events, rpc.EventRetry) != 0 || countEvents(events, rpc.EventBreakerOpen) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	checkAdd(t, c.Transport(context.Background()))
+}
+
+func TestClientDeadline(t *testing.T) {
+	f := newFakeEndpoints("a")
+	var events []rpc.Event
+	config := testClientConfig(f, &events)
+	config.Idempotent = rpc.IdempotentCmds("add")
+	config.MaxAttempts = 1000
+	config.BaseBackoff = 10 * time.Millisecond
+	config.MaxBackoff = 10 * time.Millisecond
+	c := rpc.NewClient([]string{"a"}, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := rpc.RPC[addReq, addRes](c.Transport(ctx), "add", &addReq{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("call must stop at deadline")
+	}
+}
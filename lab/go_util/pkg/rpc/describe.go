@@ -0,0 +1,43 @@
+package rpc
+
+import (
+	"slices"
+	"strings"
+)
+
+// DescribeCmd - built-in command of every dispatcher listing the registered commands
+const DescribeCmd = "rpc.describe"
+
+type DescribeRequest struct{}
+
+type DescribeResponse struct {
+	Commands []CommandDescription `json:"commands"`
+}
+
+type CommandDescription struct {
+	Name     string  `json:"name"`
+	Request  *Schema `json:"request"`
+	Response *Schema `json:"response"`
+}
+
+func (d *dispatcher) describe(req *DescribeRequest) *DescribeResponse {
+	res := &DescribeResponse{
+		Commands: make([]CommandDescription, 0, len(d.handlerMap)),
+	}
+	for cmd, h := range d.handlerMap {
+		res.Commands = append(res.Commands, CommandDescription{
+			Name:     cmd,
+			Request:  SchemaOf(h.argType),
+			Response: SchemaOf(h.retType),
+		})
+	}
+	slices.SortFunc(res.Commands, func(a, b CommandDescription) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+// Describe - list the commands served through transport
+func Describe(transport TransportFunc, interceptors ...Interceptor) (*DescribeResponse, error) {
+	return RPC[DescribeRequest, DescribeResponse](transport, DescribeCmd, &DescribeRequest{}, interceptors...)
+}
@@ -0,0 +1,90 @@
+package rpc_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+type inner struct {
+	Tags map[string]string `json:"tags"`
+}
+
+type schemaReq struct {
+	inner
+	Name    string    `json:"name,required"`
+	Count   int       `json:"count,omitempty"`
+	Ratio   float64   `json:"ratio"`
+	Data    []byte    `json:"data,omitempty"`
+	When    time.Time `json:"when,omitempty"`
+	Next    *schemaReq
+	Ignored string `json:"-"`
+	private int
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := rpc.SchemaOf(reflect.TypeOf(&schemaReq{}))
+	b, _ := json.Marshal(s)
+	expected := `{"type":"object","properties":{` +
+		`"Next":{},` +
+		`"count":{"type":"integer"},` +
+		`"data":{"type":"string","format":"byte"},` +
+		`"name":{"type":"string"},` +
+		`"ratio":{"type":"number"},` +
+		`"tags":{"type":"object","additionalProperties":{"type":"string"}},` +
+		`"when":{"type":"string","format":"date-time"}` +
+		`},"required":["name"]}`
+	if string(b) != expected {
+		t.Fatalf("unexpected schema\n%s\n%s", b, expected)
+	}
+
+	for input, valid := range map[string]bool{
+		`{"tags": {}, "name": "a", "ratio": 1.5, "Next": null}`:             true,
+		`{"TAGS": null, "Name": "a", "ratio": 1, "next": {"anything": 1}}`:  true,
+		`{"tags": {}, "name": "a", "ratio": 1.5}`:                           true,
+		`{"tags": {}, "ratio": 1.5}`:                                        false,
+		`{"tags": {"a": 1}, "name": "a", "ratio": 1.5, "Next": null}`:       false,
+		`{"tags": {}, "name": "a", "ratio": 1, "count": 1.5, "Next": null}`: false,
+		`[]`: false,
+	} {
+		var v any
+		if err := json.Unmarshal([]byte(input), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Validate(v); (err == nil) != valid {
+			t.Fatalf("%s: expected valid=%v, got %v", input, valid, err)
+		}
+	}
+}
+
+type selfEmbedding struct {
+	*selfEmbedding
+	Value int
+}
+
+func TestSchemaOfEmbeddedRecursion(t *testing.T) {
+	s := rpc.SchemaOf(reflect.TypeOf(selfEmbedding{}))
+	if s.Properties["Value"].Type != "integer" || len(s.Required) != 0 {
+		t.Fatalf("unexpected schema %+v", s)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	desc, err := rpc.Describe(newAddDispatcher().Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, c := range desc.Commands {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"add", "panic", rpc.DescribeCmd}) {
+		t.Fatalf("unexpected commands %v", names)
+	}
+	if desc.Commands[0].Request.Properties["Values"].Items.Type != "integer" {
+		t.Fatalf("unexpected schema %+v", desc.Commands[0].Request)
+	}
+}
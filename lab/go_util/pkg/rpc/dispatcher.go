@@ -2,26 +2,43 @@ package rpc
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"time"
+)
+
+var (
+	ErrCommandNotFound = errors.New("command not found")
+	ErrInvalidParams   = errors.New("invalid params")
 )
 
 type Dispatcher interface {
 	Register(cmd string, h any) Dispatcher
+	Use(interceptors ...Interceptor) Dispatcher
 	Handle(input []byte) (output []byte, err error)
 }
 
 func NewDispatcher() Dispatcher {
-	return dispatcher(make(map[string]handler))
+	d := &dispatcher{
+		handlerMap:   make(map[string]handler),
+		interceptors: nil,
+	}
+	return d.Register(DescribeCmd, d.describe)
 }
 
 type handler struct {
 	handlerFunc reflect.Value
 	argType     reflect.Type
+	retType     reflect.Type
+}
+
+type dispatcher struct {
+	handlerMap   map[string]handler
+	interceptors []Interceptor
 }
-type dispatcher map[string]handler
 
-func (d dispatcher) Register(cmd string, h any) Dispatcher {
+func (d *dispatcher) Register(cmd string, h any) Dispatcher {
 	handlerFunc := reflect.ValueOf(h)
 	handlerFuncType := handlerFunc.Type()
 	if handlerFuncType.Kind() != reflect.Func || handlerFuncType.NumIn() != 1 || handlerFuncType.NumOut() != 1 {
@@ -32,41 +49,71 @@ func (d dispatcher) Register(cmd string, h any) Dispatcher {
 	if argType.Kind() != reflect.Ptr || retType.Kind() != reflect.Ptr {
 		panic("handler arguments and return type must be pointers")
 	}
-	d[cmd] = handler{
+	d.handlerMap[cmd] = handler{
 		handlerFunc: handlerFunc,
 		argType:     argType,
+		retType:     retType,
 	}
 	return d
 }
 
+// Use - append interceptors, they wrap every handler registered before or after
+func (d *dispatcher) Use(interceptors ...Interceptor) Dispatcher {
+	d.interceptors = append(d.interceptors, interceptors...)
+	return d
+}
+
 type message struct {
-	Cmd  string `json:"cmd"`
-	Body []byte `json:"body"`
+	Cmd  string            `json:"cmd"`
+	Meta map[string]string `json:"meta,omitempty"`
+	Body []byte            `json:"body"`
 }
 
-func (d dispatcher) Handle(input []byte) (output []byte, err error) {
-	msg := message{}
-	if err = json.Unmarshal(input, &msg); err != nil {
+// Handle - decode and dispatch input, the interceptors see calls that fail to decode too
+func (d *dispatcher) Handle(input []byte) (output []byte, err error) {
+	call, invoke := d.decode(input)
+	out, err := chainInvoker(d.interceptors, invoke)(call)
+	if err != nil {
 		return nil, err
 	}
 
-	h, ok := d[msg.Cmd]
-	if !ok {
-		return nil, fmt.Errorf("command not found")
+	output, err = json.Marshal(out)
+	if err != nil {
+		return nil, err
 	}
+	return output, nil
+}
 
-	argPtr := reflect.New(h.argType.Elem()).Interface()
-	if err = json.Unmarshal(msg.Body, argPtr); err != nil {
-		return nil, err
+// decode - the call in input and the handler to invoke, which returns the decoding error if any
+func (d *dispatcher) decode(input []byte) (*Call, Invoker) {
+	call := &Call{
+		Start: time.Now(),
+	}
+	fail := func(err error) Invoker {
+		return func(call *Call) (any, error) {
+			return nil, err
+		}
+	}
+
+	msg := message{}
+	if err := json.Unmarshal(input, &msg); err != nil {
+		return call, fail(err)
 	}
+	call.Cmd, call.Meta = msg.Cmd, msg.Meta
 
-	out := h.handlerFunc.Call([]reflect.Value{reflect.ValueOf(argPtr)})[0].Interface()
+	h, ok := d.handlerMap[msg.Cmd]
+	if !ok {
+		return call, fail(ErrCommandNotFound)
+	}
 
-	output, err = json.Marshal(out)
-	if err != nil {
-		return nil, err
+	argPtr := reflect.New(h.argType.Elem()).Interface()
+	if err := json.Unmarshal(msg.Body, argPtr); err != nil {
+		return call, fail(fmt.Errorf("%w: %v", ErrInvalidParams, err))
+	}
+	call.Request = argPtr
+	return call, func(call *Call) (any, error) {
+		return h.handlerFunc.Call([]reflect.Value{reflect.ValueOf(call.Request)})[0].Interface(), nil
 	}
-	return output, nil
 }
 
 type TransportFunc func([]byte) ([]byte, error)
@@ -76,27 +123,45 @@ func zeroPtr[T any]() *T {
 	return &v
 }
 
-func RPC[Req any, Res any](transport TransportFunc, cmd string, req *Req) (res *Res, err error) {
-	body, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-	msg := message{
-		Cmd:  cmd,
-		Body: body,
-	}
-	b, err := json.Marshal(msg)
-	if err != nil {
-		return nil, err
+// RPC - call cmd through transport, interceptors wrap the call on the client side
+func RPC[Req any, Res any](transport TransportFunc, cmd string, req *Req, interceptors ...Interceptor) (res *Res, err error) {
+	call := &Call{
+		Cmd:     cmd,
+		Meta:    nil,
+		Request: req,
+		Start:   time.Now(),
 	}
-	b, err = transport(b)
+	out, err := chainInvoker(interceptors, func(call *Call) (any, error) {
+		body, err := json.Marshal(call.Request)
+		if err != nil {
+			return nil, err
+		}
+		msg := message{
+			Cmd:  call.Cmd,
+			Meta: call.Meta,
+			Body: body,
+		}
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		b, err = transport(b)
+		if err != nil {
+			return nil, err
+		}
+
+		res := zeroPtr[Res]()
+		if err = json.Unmarshal(b, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	})(call)
 	if err != nil {
 		return nil, err
 	}
-
-	res = zeroPtr[Res]()
-	if err = json.Unmarshal(b, res); err != nil {
-		return nil, err
+	res, ok := out.(*Res)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response type %T", out)
 	}
 	return res, nil
 }
@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/logger"
+)
+
+var (
+	ErrPanic        = errors.New("panic")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate_limited")
+)
+
+const (
+	tokenMetaKey = "token"
+)
+
+// Call - one rpc call as seen by interceptors
+// on the server, Request is the decoded request pointer
+// on the client, Request is the request pointer passed to RPC
+type Call struct {
+	Cmd     string
+	Meta    map[string]string
+	Request any
+	Start   time.Time
+}
+
+// Invoker - continue processing the call, returns the response pointer
+type Invoker func(call *Call) (res any, err error)
+
+// Interceptor - wrap a call, the same interceptor can be used on both server and client
+type Interceptor func(call *Call, next Invoker) (res any, err error)
+
+// Chain - compose interceptors, the first interceptor is the outermost
+func Chain(interceptors ...Interceptor) Interceptor {
+	return func(call *Call, next Invoker) (any, error) {
+		return chainInvoker(interceptors, next)(call)
+	}
+}
+
+func chainInvoker(interceptors []Interceptor, last Invoker) Invoker {
+	invoker := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(call *Call) (any, error) {
+			return interceptor(call, next)
+		}
+	}
+	return invoker
+}
+
+// Recover - turn a panic in the next invoker into ErrPanic
+func Recover() Interceptor {
+	return func(call *Call, next Invoker) (res any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				res, err = nil, fmt.Errorf("%w: %s: %v", ErrPanic, call.Cmd, r)
+			}
+		}()
+		return next(call)
+	}
+}
+
+// Logging - log command, latency and error of every call
+func Logging(l logger.Logger) Interceptor {
+	return func(call *Call, next Invoker) (any, error) {
+		res, err := next(call)
+		ctx := l.Now().WithField("cmd", call.Cmd).WithField("elapsed", time.Since(call.Start).String())
+		if err != nil {
+			ctx.Error("rpc error: %v", err)
+		} else {
+			ctx.Info("rpc ok")
+		}
+		return res, err
+	}
+}
+
+// Observe - report latency of every call, e.g. to collect metrics
+func Observe(observe func(call *Call, elapsed time.Duration, err error)) Interceptor {
+	return func(call *Call, next Invoker) (any, error) {
+		res, err := next(call)
+		observe(call, time.Since(call.Start), err)
+		return res, err
+	}
+}
+
+// AttachToken - client side, attach token to every call
+func AttachToken(token string) Interceptor {
+	return func(call *Call, next Invoker) (any, error) {
+		if call.Meta == nil {
+			call.Meta = make(map[string]string)
+		}
+		call.Meta[tokenMetaKey] = token
+		return next(call)
+	}
+}
+
+// RequireToken - server side, reject calls whose token is not valid
+func RequireToken(valid func(token string) bool) Interceptor {
+	return func(call *Call, next Invoker) (any, error) {
+		if !valid(call.Meta[tokenMetaKey]) {
+			return nil, fmt.Errorf("%w: %s", ErrUnauthorized, call.Cmd)
+		}
+		return next(call)
+	}
+}
+
+// RateLimit - token bucket shared by all commands, refilled at ratePerSecond up to burst
+func RateLimit(ratePerSecond float64, burst int) Interceptor {
+	b := &bucket{
+		rate:   ratePerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+	return func(call *Call, next Invoker) (any, error) {
+		if !b.take(call.Start) {
+			return nil, fmt.Errorf("%w: %s", ErrRateLimited, call.Cmd)
+		}
+		return next(call)
+	}
+}
+
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
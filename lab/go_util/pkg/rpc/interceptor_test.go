@@ -0,0 +1,119 @@
+package rpc_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/logger"
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+type addReq struct {
+	Values []int
+}
+
+type addRes struct {
+	Sum int
+}
+
+func newAddDispatcher() rpc.Dispatcher {
+	return rpc.NewDispatcher().Register("add", func(req *addReq) *addRes {
+		sum := 0
+		for _, v := range req.Values {
+			sum += v
+		}
+		return &addRes{Sum: sum}
+	}).Register("panic", func(req *addReq) *addRes {
+		panic("boom")
+	})
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	var trace []string
+	tag := func(name string) rpc.Interceptor {
+		return func(call *rpc.Call, next rpc.Invoker) (any, error) {
+			trace = append(trace, name+":"+call.Cmd)
+			return next(call)
+		}
+	}
+	d := newAddDispatcher().Use(tag("s1"), tag("s2"))
+
+	res, err := rpc.RPC[addReq, addRes](d.Handle, "add", &addReq{Values: []int{1, 2, 3}}, tag("c1"), tag("c2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sum != 6 {
+		t.Fatalf("expected 6, got %d", res.Sum)
+	}
+	if strings.Join(trace, ",") != "c1:add,c2:add,s1:add,s2:add" {
+		t.Fatalf("wrong order %v", trace)
+	}
+}
+
+func TestInterceptorRecover(t *testing.T) {
+	d := newAddDispatcher().Use(rpc.Recover())
+	_, err := rpc.RPC[addReq, addRes](d.Handle, "panic", &addReq{})
+	if !errors.Is(err, rpc.ErrPanic) {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+}
+
+func TestInterceptorToken(t *testing.T) {
+	d := newAddDispatcher().Use(rpc.RequireToken(func(token string) bool {
+		return token == "secret"
+	}))
+	if _, err := rpc.RPC[addReq, addRes](d.Handle, "add", &addReq{}); !errors.Is(err, rpc.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	if _, err := rpc.RPC[addReq, addRes](d.Handle, "add", &addReq{}, rpc.AttachToken("secret")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterceptorRateLimitAndObserve(t *testing.T) {
+	var logged strings.Builder
+	l := logger.NewLogger(func(msg string) { logged.WriteString(msg) }, func(msg string) { logged.WriteString(msg) })
+	count := 0
+	d := newAddDispatcher().Use(
+		rpc.Logging(l),
+		rpc.Observe(func(call *rpc.Call, elapsed time.Duration, err error) {
+			count++
+		}),
+		rpc.RateLimit(0, 2),
+	)
+	for i := 0; i < 2; i++ {
+		if _, err := rpc.RPC[addReq, addRes](d.Handle, "add", &addReq{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rpc.RPC[addReq, addRes](d.Handle, "add", &addReq{}); !errors.Is(err, rpc.ErrRateLimited) {
+		t.Fatalf("expected rate limited, got %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 observations, got %d", count)
+	}
+	if !strings.Contains(logged.String(), `cmd="add"`) {
+		t.Fatalf("missing log line %q", logged.String())
+	}
+}
+
+func TestInterceptorSeesDecodeErrors(t *testing.T) {
+	var errs []error
+	d := newAddDispatcher().Use(rpc.Observe(func(call *rpc.Call, elapsed time.Duration, err error) {
+		errs = append(errs, err)
+	}))
+	if _, err := rpc.RPC[addReq, addRes](d.Handle, "missing", &addReq{}); !errors.Is(err, rpc.ErrCommandNotFound) {
+		t.Fatalf("expected command not found, got %v", err)
+	}
+	if _, err := d.Handle([]byte(`{"cmd":"add","body":"bm90IGpzb24="}`)); !errors.Is(err, rpc.ErrInvalidParams) {
+		t.Fatalf("expected invalid params, got %v", err)
+	}
+	if _, err := d.Handle([]byte(`not json`)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(errs) != 3 || !errors.Is(errs[0], rpc.ErrCommandNotFound) || !errors.Is(errs[1], rpc.ErrInvalidParams) || errs[2] == nil {
+		t.Fatalf("observed %v", errs)
+	}
+}
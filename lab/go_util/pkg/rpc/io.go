@@ -3,9 +3,18 @@ package rpc
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
+const (
+	DEFAULT_MAX_MESSAGE_SIZE = 16 << 20
+)
+
+var ErrMessageTooLarge = errors.New("message too large")
+
 // MessageIO - breaking stream of bytes into messages, possibly include encryption-decryption
 type MessageIO interface {
 	Write(ctx context.Context, w io.Writer, b []byte) (err error)
@@ -13,6 +22,11 @@ type MessageIO interface {
 }
 
 func NewMessageIO() MessageIO {
+	return NewMessageIOWithLimit(DEFAULT_MAX_MESSAGE_SIZE)
+}
+
+// NewMessageIOWithLimit - messages larger than maxSize bytes are rejected on both Read and Write
+func NewMessageIOWithLimit(maxSize uint64) MessageIO {
 	return lengthPrefixMessageIO{
 		putUint: func(b []byte, v uint64) {
 			binary.BigEndian.PutUint32(b, uint32(v))
@@ -21,6 +35,7 @@ func NewMessageIO() MessageIO {
 			return uint64(binary.BigEndian.Uint32(b))
 		},
 		uintSize: 4,
+		maxSize:  min(maxSize, math.MaxUint32),
 	}
 }
 
@@ -28,9 +43,13 @@ type lengthPrefixMessageIO struct {
 	putUint  func(b []byte, v uint64)
 	getUint  func(b []byte) (v uint64)
 	uintSize int
+	maxSize  uint64
 }
 
 func (msgIO lengthPrefixMessageIO) Write(ctx context.Context, w io.Writer, b []byte) error {
+	if uint64(len(b)) > msgIO.maxSize {
+		return fmt.Errorf("%w: writing %d bytes, limit %d", ErrMessageTooLarge, len(b), msgIO.maxSize)
+	}
 	sizeBuf := make([]byte, msgIO.uintSize)
 	msgIO.putUint(sizeBuf, uint64(len(b)))
 
@@ -47,6 +66,9 @@ func (msgIO lengthPrefixMessageIO) Read(ctx context.Context, r io.Reader) (b []b
 	}
 
 	size := msgIO.getUint(sizeBuf)
+	if size > msgIO.maxSize {
+		return nil, fmt.Errorf("%w: reading %d bytes, limit %d", ErrMessageTooLarge, size, msgIO.maxSize)
+	}
 	b = make([]byte, size)
 	return b, readFull(ctx, r, b)
 }
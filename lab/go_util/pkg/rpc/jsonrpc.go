@@ -0,0 +1,245 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// JSON-RPC 2.0 over HTTP - https://www.jsonrpc.org/specification
+// meta is carried in http headers with metaHeaderPrefix
+
+const (
+	jsonrpcVersion   = "2.0"
+	metaHeaderPrefix = "X-Rpc-Meta-"
+)
+
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	JSONRPCServerError    = -32000
+)
+
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // nil for notification
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, err error) *jsonrpcResponse {
+	if id == nil {
+		id = nullID
+	}
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		Error: &JSONRPCError{
+			Code:    code,
+			Message: err.Error(),
+		},
+		ID: id,
+	}
+}
+
+// NewJSONRPCHandler - serve dispatcher as JSON-RPC 2.0 over HTTP POST, batch and notification included
+func NewJSONRPCHandler(dispatcher Dispatcher) http.Handler {
+	return NewJSONRPCHandlerWithLimit(dispatcher, DEFAULT_MAX_MESSAGE_SIZE)
+}
+
+// NewJSONRPCHandlerWithLimit - request bodies larger than maxSize bytes are rejected with 413
+func NewJSONRPCHandlerWithLimit(dispatcher Dispatcher, maxSize int64) http.Handler {
+	return &jsonrpcHandler{dispatcher: dispatcher, maxSize: maxSize}
+}
+
+type jsonrpcHandler struct {
+	dispatcher Dispatcher
+	maxSize    int64
+}
+
+func (h *jsonrpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxSize))
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("%v: limit %d", ErrMessageTooLarge, maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta := make(map[string]string)
+	for key, vals := range r.Header {
+		if strings.HasPrefix(key, metaHeaderPrefix) && len(vals) > 0 {
+			meta[strings.ToLower(strings.TrimPrefix(key, metaHeaderPrefix))] = vals[0]
+		}
+	}
+
+	out := h.handleBody(body, meta)
+	if out == nil { // notifications only
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// handleBody - return a single response, a list of responses, or nil if there is nothing to respond
+func (h *jsonrpcHandler) handleBody(body []byte, meta map[string]string) any {
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return newJSONRPCErrorResponse(nil, JSONRPCParseError, errors.New("parse error"))
+	}
+	if body[0] != '[' {
+		res := h.handleOne(body, meta)
+		if res == nil {
+			return nil
+		}
+		return res
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return newJSONRPCErrorResponse(nil, JSONRPCParseError, err)
+	}
+	if len(batch) == 0 {
+		return newJSONRPCErrorResponse(nil, JSONRPCInvalidRequest, errors.New("empty batch"))
+	}
+	resList := make([]*jsonrpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		if res := h.handleOne(raw, meta); res != nil {
+			resList = append(resList, res)
+		}
+	}
+	if len(resList) == 0 {
+		return nil
+	}
+	return resList
+}
+
+func (h *jsonrpcHandler) handleOne(raw json.RawMessage, meta map[string]string) *jsonrpcResponse {
+	req := jsonrpcRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return newJSONRPCErrorResponse(nil, JSONRPCInvalidRequest, err)
+	}
+	if req.JSONRPC != jsonrpcVersion || req.Method == "" {
+		return newJSONRPCErrorResponse(req.ID, JSONRPCInvalidRequest, errors.New("invalid request"))
+	}
+	params := req.Params
+	if len(params) == 0 {
+		params = nullID
+	}
+	b, err := json.Marshal(message{
+		Cmd:  req.Method,
+		Meta: meta,
+		Body: params,
+	})
+	if err != nil {
+		return newJSONRPCErrorResponse(req.ID, JSONRPCInternalError, err)
+	}
+
+	output, err := h.dispatcher.Handle(b)
+	if req.ID == nil { // notification
+		return nil
+	}
+	if err != nil {
+		code := JSONRPCServerError
+		switch {
+		case errors.Is(err, ErrCommandNotFound):
+			code = JSONRPCMethodNotFound
+		case errors.Is(err, ErrInvalidParams):
+			code = JSONRPCInvalidParams
+		}
+		return newJSONRPCErrorResponse(req.ID, code, err)
+	}
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		Result:  output,
+		ID:      req.ID,
+	}
+}
+
+// JSONRPCTransport - client of NewJSONRPCHandler served at url
+func JSONRPCTransport(ctx context.Context, url string) TransportFunc {
+	client := &http.Client{Timeout: DEFAULT_TCP_TIMEOUT}
+	lastID := uint64(0)
+	return func(b []byte) ([]byte, error) {
+		msg := message{}
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return nil, err
+		}
+		id, err := json.Marshal(atomic.AddUint64(&lastID, 1))
+		if err != nil {
+			return nil, err
+		}
+		req := jsonrpcRequest{
+			JSONRPC: jsonrpcVersion,
+			Method:  msg.Cmd,
+			Params:  msg.Body,
+			ID:      id,
+		}
+		if bytes.Equal(req.Params, nullID) {
+			req.Params = nil
+		}
+		reqBody, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		for key, val := range msg.Meta {
+			httpReq.Header.Set(metaHeaderPrefix+key, val)
+		}
+		httpRes, err := client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		defer httpRes.Body.Close()
+		if httpRes.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("http status %s", httpRes.Status)
+		}
+
+		res := jsonrpcResponse{}
+		if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+			return nil, err
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return res.Result, nil
+	}
+}
@@ -0,0 +1,20 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// PipeTransport - in-process transport for tests, every call goes through msgIO over net.Pipe
+func PipeTransport(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO) TransportFunc {
+	return func(b []byte) ([]byte, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			_ = serverConn.SetReadDeadline(time.Now().Add(DEFAULT_TCP_TIMEOUT))
+			_ = serveRequest(ctx, dispatcher, msgIO, serverConn, DEFAULT_TCP_TIMEOUT)
+		}()
+		return roundTrip(ctx, clientConn, msgIO, b)
+	}
+}
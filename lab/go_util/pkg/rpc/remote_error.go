@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrRemote = errors.New("remote error")
+
+// errorPrefix - a response starting with it is the error of the request, a JSON response never does
+const errorPrefix = 0
+
+// remoteErrors - errors of the server that the client can still match with errors.Is
+var remoteErrors = []error{
+	ErrMessageTooLarge,
+	ErrCommandNotFound,
+	ErrInvalidParams,
+	ErrUnauthorized,
+	ErrRateLimited,
+	ErrPanic,
+}
+
+func encodeError(err error) []byte {
+	return append([]byte{errorPrefix}, err.Error()...)
+}
+
+// remoteError - an error the server answered with, the round trip itself went fine
+type remoteError struct {
+	error
+}
+
+func (e remoteError) Unwrap() error {
+	return e.error
+}
+
+// isRemoteError - err came back from the server rather than from dialing, writing or reading
+func isRemoteError(err error) bool {
+	var remote remoteError
+	return errors.As(err, &remote)
+}
+
+// decodeError - the error in response b, nil if b is not an error
+func decodeError(b []byte) error {
+	if len(b) == 0 || b[0] != errorPrefix {
+		return nil
+	}
+	msg := string(b[1:])
+	for _, err := range remoteErrors {
+		if rest, ok := strings.CutPrefix(msg, err.Error()); ok {
+			return remoteError{fmt.Errorf("%w%s", err, rest)}
+		}
+	}
+	return remoteError{fmt.Errorf("%w: %s", ErrRemote, msg)}
+}
@@ -0,0 +1,218 @@
+package rpcgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const rpcImportPath = "github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+
+// Service - an interface whose methods are all of form Method(*Request) *Response
+type Service struct {
+	Package    string
+	Name       string
+	StdImports []Import
+	Imports    []Import
+	Methods    []Method
+}
+
+type Import struct {
+	Name string
+	Path string
+}
+
+type Method struct {
+	Name     string
+	Cmd      string
+	Request  string // element type of the request pointer
+	Response string // element type of the response pointer
+}
+
+// Parse - find interface typeName among the go files in dir, command names are prefix + method name
+func Parse(dir string, typeName string, prefix string) (*Service, error) {
+	fset := token.NewFileSet()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		iface := findInterface(file, typeName)
+		if iface == nil {
+			continue
+		}
+		return newService(fset, file, typeName, iface, prefix)
+	}
+	return nil, fmt.Errorf("interface %s not found in %s", typeName, dir)
+}
+
+func findInterface(file *ast.File, typeName string) *ast.InterfaceType {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			if typeSpec.Name.Name != typeName {
+				continue
+			}
+			if iface, ok := typeSpec.Type.(*ast.InterfaceType); ok {
+				return iface
+			}
+		}
+	}
+	return nil
+}
+
+func newService(fset *token.FileSet, file *ast.File, typeName string, iface *ast.InterfaceType, prefix string) (*Service, error) {
+	s := &Service{
+		Package: file.Name.Name,
+		Name:    typeName,
+		Imports: []Import{{Path: rpcImportPath}},
+	}
+	used := make(map[string]bool) // package names used in request and response types
+	for _, field := range iface.Methods.List {
+		pos := fset.Position(field.Pos())
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) != 1 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", pos)
+		}
+		if fn.TypeParams != nil || fn.Params.NumFields() != 1 || fn.Results.NumFields() != 1 {
+			return nil, fmt.Errorf("%s: method must be of form %s(*SomeRequest) *SomeResponse", pos, field.Names[0].Name)
+		}
+		req, err := pointerElem(fset, fn.Params.List[0].Type, used)
+		if err != nil {
+			return nil, fmt.Errorf("%s: request %w", pos, err)
+		}
+		res, err := pointerElem(fset, fn.Results.List[0].Type, used)
+		if err != nil {
+			return nil, fmt.Errorf("%s: response %w", pos, err)
+		}
+		s.Methods = append(s.Methods, Method{
+			Name:     field.Names[0].Name,
+			Cmd:      prefix + field.Names[0].Name,
+			Request:  req,
+			Response: res,
+		})
+	}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := filepath.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if !used[name] {
+			continue
+		}
+		imp := Import{Path: path}
+		if spec.Name != nil {
+			imp.Name = spec.Name.Name
+		}
+		if isStd(path) {
+			s.StdImports = append(s.StdImports, imp)
+		} else {
+			s.Imports = append(s.Imports, imp)
+		}
+	}
+	for _, imports := range [][]Import{s.StdImports, s.Imports} {
+		slices.SortFunc(imports, func(a, b Import) int {
+			return strings.Compare(a.Path, b.Path)
+		})
+	}
+	return s, nil
+}
+
+// isStd - standard library paths have no dot in their first element
+func isStd(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+func pointerElem(fset *token.FileSet, expr ast.Expr, used map[string]bool) (string, error) {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return "", errors.New("must be a pointer")
+	}
+	ast.Inspect(star.X, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				used[ident.Name] = true
+			}
+		}
+		return true
+	})
+	buf := &bytes.Buffer{}
+	if err := format.Node(buf, fset, star.X); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var serviceTemplate = template.Must(template.New("service").Parse(`// Code generated by rpcgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .StdImports}}
+	{{if .Name}}{{.Name}} {{end}}"{{.Path}}"
+{{- end}}
+{{if .StdImports}}
+{{end}}
+{{- range .Imports}}
+	{{if .Name}}{{.Name}} {{end}}"{{.Path}}"
+{{- end}}
+)
+
+// Register{{.Name}} - register every method of s on d
+func Register{{.Name}}(d rpc.Dispatcher, s {{.Name}}) rpc.Dispatcher {
+	return d{{range .Methods}}.
+		Register("{{.Cmd}}", s.{{.Name}}){{end}}
+}
+
+// {{.Name}}Client - typed client of {{.Name}}
+type {{.Name}}Client struct {
+	transport    rpc.TransportFunc
+	interceptors []rpc.Interceptor
+}
+
+func New{{.Name}}Client(transport rpc.TransportFunc, interceptors ...rpc.Interceptor) *{{.Name}}Client {
+	return &{{.Name}}Client{
+		transport:    transport,
+		interceptors: interceptors,
+	}
+}
+{{$name := .Name}}
+{{- range .Methods}}
+func (c *{{$name}}Client) {{.Name}}(req *{{.Request}}) (*{{.Response}}, error) {
+	return rpc.RPC[{{.Request}}, {{.Response}}](c.transport, "{{.Cmd}}", req, c.interceptors...)
+}
+{{end -}}
+`))
+
+// Generate - formatted go source of the server adapter and the typed client
+func Generate(s *Service) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := serviceTemplate.Execute(buf, s); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
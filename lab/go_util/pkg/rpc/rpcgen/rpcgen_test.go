@@ -0,0 +1,35 @@
+package rpcgen_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc/rpcgen"
+)
+
+func TestGenerate(t *testing.T) {
+	s, err := rpcgen.Parse("testdata/service", "Clock", "clock.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rpcgen.Generate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("testdata/service/clock_rpc.go.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(expected) {
+		t.Fatalf("unexpected output\n%s", b)
+	}
+}
+
+func TestGenerateErr(t *testing.T) {
+	if _, err := rpcgen.Parse("testdata/bad", "Bad", ""); err == nil {
+		t.Fatal("expected error for invalid method")
+	}
+	if _, err := rpcgen.Parse("testdata/service", "Missing", ""); err == nil {
+		t.Fatal("expected error for missing interface")
+	}
+}
@@ -0,0 +1,5 @@
+package bad
+
+type Bad interface {
+	Add(a int, b int) int
+}
@@ -0,0 +1,14 @@
+package service
+
+import (
+	"net/url"
+	tm "time"
+	"unused"
+)
+
+var _ unused.T
+
+type Clock interface {
+	Now(req *struct{}) *tm.Time
+	Parse(req *string) *url.URL
+}
@@ -0,0 +1,294 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+	ErrDrainTimeout = errors.New("drain timeout")
+)
+
+// Server - serve a dispatcher over a stream listener
+// when ctx of ListenAndServe is done, the server stops accepting, waits for in-flight requests
+// up to DrainTimeout then closes the remaining connections. Close closes everything immediately.
+type Server interface {
+	ListenAndServe(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO) error
+	Close() error
+}
+
+// ServerConfig - zero timeout means no timeout
+type ServerConfig struct {
+	MaxConns     int             // maximum number of concurrent connections, 0 - unlimited
+	ReadTimeout  time.Duration   // time to read the first request of a connection
+	WriteTimeout time.Duration   // time to write one response
+	IdleTimeout  time.Duration   // time to wait for and read the next request, 0 - one request per connection
+	DrainTimeout time.Duration   // time to wait for in-flight requests on shutdown
+	OnError      func(err error) // errors that end a connection, nil - ignored
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		MaxConns:     0,
+		ReadTimeout:  DEFAULT_TCP_TIMEOUT,
+		WriteTimeout: DEFAULT_TCP_TIMEOUT,
+		IdleTimeout:  0,
+		DrainTimeout: DEFAULT_TCP_TIMEOUT,
+	}
+}
+
+func NewServer(listener net.Listener, config ServerConfig) Server {
+	var slots chan struct{}
+	if config.MaxConns > 0 {
+		slots = make(chan struct{}, config.MaxConns)
+	}
+	return &server{
+		listener: listener,
+		config:   config,
+		slots:    slots,
+		mu:       sync.Mutex{},
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+type server struct {
+	listener net.Listener
+	config   ServerConfig
+	slots    chan struct{} // nil if unlimited
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // protected by mu
+	closed chan struct{}         // closed on shutdown
+	wg     sync.WaitGroup
+}
+
+func (s *server) ListenAndServe(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO) error {
+	// in-flight requests must not be cancelled together with ctx
+	connCtx := context.WithoutCancel(ctx)
+	acceptErr := make(chan error, 1)
+	go func() {
+		acceptErr <- s.acceptLoop(connCtx, dispatcher, msgIO)
+	}()
+
+	select {
+	case err := <-acceptErr:
+		return err
+	case <-ctx.Done():
+		_ = s.shutdown()
+		<-acceptErr
+		return s.drain()
+	}
+}
+
+func (s *server) Close() error {
+	err := s.shutdown()
+	s.closeConns()
+	return err
+}
+
+func (s *server) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown - stop accepting new connections
+func (s *server) shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return nil
+	}
+	close(s.closed)
+	// wake up connections waiting for a request, in-flight requests are not affected
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	return s.listener.Close()
+}
+
+func (s *server) drain() error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if s.config.DrainTimeout > 0 {
+		timer := time.NewTimer(s.config.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+		return ErrServerClosed
+	case <-timeout:
+		n := s.closeConns()
+		return fmt.Errorf("%w: %d connections closed", ErrDrainTimeout, n)
+	}
+}
+
+func (s *server) closeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return len(s.conns)
+}
+
+func (s *server) acceptLoop(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO) error {
+	for {
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.closed:
+				return ErrServerClosed
+			}
+		}
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.release()
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			_ = conn.Close()
+			s.release()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.release()
+			defer s.untrack(conn)
+			s.serveConn(ctx, dispatcher, msgIO, conn)
+		}()
+	}
+}
+
+func (s *server) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// beginRead - set read deadline unless the server is shutting down
+func (s *server) beginRead(conn net.Conn, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return false
+	}
+	return conn.SetReadDeadline(deadlineAfter(timeout)) == nil
+}
+
+func (s *server) serveConn(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO, conn net.Conn) {
+	defer conn.Close()
+	timeout, first := s.config.ReadTimeout, true
+	for {
+		if !s.beginRead(conn, timeout) {
+			return
+		}
+		err := serveRequest(ctx, dispatcher, msgIO, conn, s.config.WriteTimeout)
+		if err != nil {
+			// an idle connection going away or a shutdown is not an error
+			expected := isEndOfConn(err) && (!first || s.isClosed())
+			if !expected && s.config.OnError != nil {
+				s.config.OnError(err)
+			}
+			return
+		}
+		if s.config.IdleTimeout <= 0 {
+			return
+		}
+		timeout, first = s.config.IdleTimeout, false
+	}
+}
+
+// serveRequest - read one request, handle it and write the response, read deadline is set by caller
+// errors of the dispatcher are sent back, the returned error ends the connection
+func serveRequest(ctx context.Context, dispatcher Dispatcher, msgIO MessageIO, conn net.Conn, writeTimeout time.Duration) error {
+	b, err := msgIO.Read(ctx, conn)
+	if errors.Is(err, ErrMessageTooLarge) {
+		return errors.Join(err, rejectRequest(ctx, msgIO, conn, err, writeTimeout))
+	}
+	if err != nil {
+		return err
+	}
+
+	b, err = dispatcher.Handle(b)
+	if err != nil {
+		b = encodeError(err)
+	}
+
+	if err = conn.SetWriteDeadline(deadlineAfter(writeTimeout)); err != nil {
+		return err
+	}
+	return msgIO.Write(ctx, conn, b)
+}
+
+// rejectRequest - answer a request that is left unread with err, the client may still be writing it
+// so it is read and discarded until the client closes or the read deadline
+func rejectRequest(ctx context.Context, msgIO MessageIO, conn net.Conn, err error, writeTimeout time.Duration) error {
+	discarded := make(chan struct{})
+	go func() {
+		defer close(discarded)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	defer func() {
+		<-discarded
+	}()
+
+	if err := conn.SetWriteDeadline(deadlineAfter(writeTimeout)); err != nil {
+		return err
+	}
+	if err := msgIO.Write(ctx, conn, encodeError(err)); err != nil {
+		return err
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// isEndOfConn - the peer closed the connection or did not send anything in time
+func isEndOfConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,186 @@
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+type sleepReq struct {
+	Duration time.Duration
+}
+
+func newSleepDispatcher(running *int64) rpc.Dispatcher {
+	return newAddDispatcher().Register("sleep", func(req *sleepReq) *sleepReq {
+		atomic.AddInt64(running, 1)
+		defer atomic.AddInt64(running, -1)
+		time.Sleep(req.Duration)
+		return req
+	})
+}
+
+func startServer(t *testing.T, config rpc.ServerConfig, d rpc.Dispatcher) (addr string, cancel func(), done <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rpc.NewServer(listener, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe(ctx, d, rpc.NewMessageIO())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Close()
+	})
+	return listener.Addr().String(), cancel, errCh
+}
+
+func waitRunning(t *testing.T, running *int64, n int64) {
+	t.Helper()
+	for i := 0; atomic.LoadInt64(running) != n; i++ {
+		if i > 100 {
+			t.Fatalf("expected %d running handlers", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerGracefulDrain(t *testing.T) {
+	running := int64(0)
+	config := rpc.DefaultServerConfig()
+	config.DrainTimeout = 2 * time.Second
+	addr, cancel, done := startServer(t, config, newSleepDispatcher(&running))
+
+	transport := rpc.TCPTransport(context.Background(), addr, rpc.NewMessageIO())
+	resCh := make(chan error, 1)
+	go func() {
+		_, err := rpc.RPC[sleepReq, sleepReq](transport, "sleep", &sleepReq{Duration: 200 * time.Millisecond})
+		resCh <- err
+	}()
+	waitRunning(t, &running, 1)
+	cancel()
+
+	if err := <-resCh; err != nil {
+		t.Fatalf("in-flight request must complete, got %v", err)
+	}
+	if err := <-done; !errors.Is(err, rpc.ErrServerClosed) {
+		t.Fatalf("expected server closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("server must stop accepting")
+	}
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	running := int64(0)
+	config := rpc.DefaultServerConfig()
+	config.DrainTimeout = 50 * time.Millisecond
+	addr, cancel, done := startServer(t, config, newSleepDispatcher(&running))
+
+	transport := rpc.TCPTransport(context.Background(), addr, rpc.NewMessageIO())
+	go rpc.RPC[sleepReq, sleepReq](transport, "sleep", &sleepReq{Duration: time.Second})
+	waitRunning(t, &running, 1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, rpc.ErrDrainTimeout) {
+		t.Fatalf("expected drain timeout, got %v", err)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	running := int64(0)
+	config := rpc.DefaultServerConfig()
+	config.MaxConns = 1
+	addr, _, _ := startServer(t, config, newSleepDispatcher(&running))
+
+	transport := rpc.TCPTransport(context.Background(), addr, rpc.NewMessageIO())
+	for i := 0; i < 3; i++ {
+		go rpc.RPC[sleepReq, sleepReq](transport, "sleep", &sleepReq{Duration: 100 * time.Millisecond})
+	}
+	for i := 0; i < 10; i++ {
+		if atomic.LoadInt64(&running) > 1 {
+			t.Fatal("more handlers than MaxConns")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServerIdleKeepAlive(t *testing.T) {
+	config := rpc.DefaultServerConfig()
+	config.IdleTimeout = time.Second
+	addr, _, _ := startServer(t, config, newAddDispatcher())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msgIO := rpc.NewMessageIO()
+	ctx := context.Background()
+	// two requests on the same connection
+	for i := 0; i < 2; i++ {
+		var req []byte // capture the encoded request
+		_, _ = rpc.RPC[addReq, addRes](func(b []byte) ([]byte, error) {
+			req = b
+			return []byte("{}"), nil
+		}, "add", &addReq{Values: []int{1, i}})
+		if err := msgIO.Write(ctx, conn, req); err != nil {
+			t.Fatal(err)
+		}
+		res, err := msgIO.Read(ctx, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != fmt.Sprintf(`{"Sum":%d}`, 1+i) {
+			t.Fatalf("unexpected response %s", res)
+		}
+	}
+}
+
+func TestMessageIOLimit(t *testing.T) {
+	ctx := context.Background()
+	b := &bytes.Buffer{}
+	if err := rpc.NewMessageIO().Write(ctx, b, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rpc.NewMessageIOWithLimit(100).Read(ctx, b); !errors.Is(err, rpc.ErrMessageTooLarge) {
+		t.Fatalf("expected message too large, got %v", err)
+	}
+	if err := rpc.NewMessageIOWithLimit(100).Write(ctx, b, make([]byte, 1024)); !errors.Is(err, rpc.ErrMessageTooLarge) {
+		t.Fatalf("expected message too large, got %v", err)
+	}
+}
+
+func TestServerSendsErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rpc.NewServer(listener, rpc.DefaultServerConfig())
+	go s.ListenAndServe(context.Background(), newAddDispatcher(), rpc.NewMessageIOWithLimit(1024))
+	defer s.Close()
+
+	for _, transport := range []rpc.TransportFunc{
+		rpc.TCPTransport(context.Background(), listener.Addr().String(), rpc.NewMessageIO()),
+		rpc.PipeTransport(context.Background(), newAddDispatcher(), rpc.NewMessageIOWithLimit(1024)),
+	} {
+		values := make([]int, 1<<20)
+		if _, err := rpc.RPC[addReq, addRes](transport, "add", &addReq{Values: values}); !errors.Is(err, rpc.ErrMessageTooLarge) {
+			t.Fatalf("expected message too large, got %v", err)
+		}
+		if _, err := rpc.RPC[addReq, addRes](transport, "missing", &addReq{}); !errors.Is(err, rpc.ErrCommandNotFound) {
+			t.Fatalf("expected command not found, got %v", err)
+		}
+		checkAdd(t, transport)
+	}
+}
@@ -0,0 +1,122 @@
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fbundle/lab_public/lab/go_util/pkg/rpc"
+)
+
+func checkAdd(t *testing.T, transport rpc.TransportFunc) {
+	t.Helper()
+	res, err := rpc.RPC[addReq, addRes](transport, "add", &addReq{Values: []int{4, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sum != 9 {
+		t.Fatalf("expected 9, got %d", res.Sum)
+	}
+}
+
+func TestPipeTransport(t *testing.T) {
+	checkAdd(t, rpc.PipeTransport(context.Background(), newAddDispatcher(), rpc.NewMessageIO()))
+}
+
+func TestUnixTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socketPath := filepath.Join(t.TempDir(), "rpc.sock")
+	s, err := rpc.NewUnixServer(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.ListenAndServe(ctx, newAddDispatcher(), rpc.NewMessageIO())
+
+	checkAdd(t, rpc.UnixTransport(ctx, socketPath, rpc.NewMessageIO()))
+}
+
+func TestJSONRPCTransport(t *testing.T) {
+	d := newAddDispatcher().Use(rpc.RequireToken(func(token string) bool {
+		return token == "secret"
+	}))
+	server := httptest.NewServer(rpc.NewJSONRPCHandler(d))
+	defer server.Close()
+
+	transport := rpc.JSONRPCTransport(context.Background(), server.URL)
+	res, err := rpc.RPC[addReq, addRes](transport, "add", &addReq{Values: []int{4, 5}}, rpc.AttachToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sum != 9 {
+		t.Fatalf("expected 9, got %d", res.Sum)
+	}
+
+	_, err = rpc.RPC[addReq, addRes](transport, "mul", &addReq{}, rpc.AttachToken("secret"))
+	jsonrpcErr := &rpc.JSONRPCError{}
+	if !errors.As(err, &jsonrpcErr) || jsonrpcErr.Code != rpc.JSONRPCMethodNotFound {
+		t.Fatalf("expected method not found, got %v", err)
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	server := httptest.NewServer(rpc.NewJSONRPCHandler(newAddDispatcher()))
+	defer server.Close()
+
+	post := func(body string) (*http.Response, []map[string]any) {
+		res, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out []map[string]any
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return res, out
+	}
+
+	res, out := post(`[
+		{"jsonrpc": "2.0", "method": "add", "params": {"Values": [1, 2]}, "id": 1},
+		{"jsonrpc": "2.0", "method": "add", "params": {"Values": [3]}},
+		{"jsonrpc": "2.0", "method": "add", "params": [1], "id": "b"},
+		1
+	]`)
+	if res.StatusCode != http.StatusOK || len(out) != 3 {
+		t.Fatalf("expected 3 responses, got %d %v", res.StatusCode, out)
+	}
+	if out[0]["result"].(map[string]any)["Sum"] != float64(3) {
+		t.Fatalf("wrong result %v", out[0])
+	}
+	if out[1]["id"] != "b" || out[1]["error"].(map[string]any)["code"] != float64(rpc.JSONRPCInvalidParams) {
+		t.Fatalf("expected invalid params, got %v", out[1])
+	}
+	if out[2]["error"].(map[string]any)["code"] != float64(rpc.JSONRPCInvalidRequest) {
+		t.Fatalf("expected invalid request, got %v", out[2])
+	}
+
+	res, _ = post(`{"jsonrpc": "2.0", "method": "add", "params": {"Values": [3]}}`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected no content for notification, got %d", res.StatusCode)
+	}
+}
+
+func TestJSONRPCBodyLimit(t *testing.T) {
+	server := httptest.NewServer(rpc.NewJSONRPCHandlerWithLimit(newAddDispatcher(), 128))
+	defer server.Close()
+
+	body := `{"jsonrpc": "2.0", "method": "add", "params": {"Values": [` + strings.Repeat("1, ", 32) + `1]}, "id": 1}`
+	res, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", res.StatusCode)
+	}
+	checkAdd(t, rpc.JSONRPCTransport(context.Background(), server.URL))
+}
@@ -0,0 +1,19 @@
+package rpc
+
+import (
+	"context"
+	"net"
+)
+
+// NewUnixServer - same as NewTCPServer but listen on a unix domain socket
+func NewUnixServer(socketPath string) (Server, error) {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(listener, DefaultServerConfig()), nil
+}
+
+func UnixTransport(ctx context.Context, socketPath string, msgIO MessageIO) TransportFunc {
+	return dialTransport(ctx, "unix", socketPath, msgIO)
+}